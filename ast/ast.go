@@ -11,6 +11,7 @@ import (
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() token.Position
 }
 
 type Statement interface {
@@ -31,6 +32,7 @@ type LetStatement struct {
 
 func (ls *LetStatement) statementNode()       {}
 func (ls *LetStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *LetStatement) Pos() token.Position  { return ls.Token.Pos }
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString(ls.TokenLiteral() + " ")
@@ -50,6 +52,7 @@ type Identifier struct {
 
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() token.Position  { return i.Token.Pos }
 func (i *Identifier) String() string       { return i.Value }
 
 type ReturnStatement struct {
@@ -59,6 +62,7 @@ type ReturnStatement struct {
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() token.Position  { return rs.Token.Pos }
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString(rs.TokenLiteral() + " ")
@@ -76,6 +80,7 @@ type ExpressionStatement struct {
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() token.Position  { return es.Token.Pos }
 func (es *ExpressionStatement) String() string {
 	if es != nil {
 		return es.Expression.String()
@@ -90,8 +95,19 @@ type IntegerLiteral struct {
 
 func (i *IntegerLiteral) expressionNode()      {}
 func (i *IntegerLiteral) TokenLiteral() string { return i.Token.Literal }
+func (i *IntegerLiteral) Pos() token.Position  { return i.Token.Pos }
 func (i *IntegerLiteral) String() string       { return i.Token.Literal }
 
+type FloatLiteral struct {
+	Token token.Token
+	Value float64
+}
+
+func (f *FloatLiteral) expressionNode()      {}
+func (f *FloatLiteral) TokenLiteral() string { return f.Token.Literal }
+func (f *FloatLiteral) Pos() token.Position  { return f.Token.Pos }
+func (f *FloatLiteral) String() string       { return f.Token.Literal }
+
 type StringLiteral struct {
 	Token token.Token
 	Value string
@@ -99,6 +115,7 @@ type StringLiteral struct {
 
 func (s *StringLiteral) expressionNode()      {}
 func (s *StringLiteral) TokenLiteral() string { return s.Token.Literal }
+func (s *StringLiteral) Pos() token.Position  { return s.Token.Pos }
 func (s *StringLiteral) String() string       { return s.Token.Literal }
 
 type Boolean struct {
@@ -108,6 +125,7 @@ type Boolean struct {
 
 func (b *Boolean) expressionNode()      {}
 func (b *Boolean) TokenLiteral() string { return b.Token.Literal }
+func (b *Boolean) Pos() token.Position  { return b.Token.Pos }
 func (b *Boolean) String() string       { return b.Token.Literal }
 
 type ArrayLiteral struct {
@@ -117,6 +135,7 @@ type ArrayLiteral struct {
 
 func (a *ArrayLiteral) expressionNode()      {}
 func (a *ArrayLiteral) TokenLiteral() string { return a.Token.Literal }
+func (a *ArrayLiteral) Pos() token.Position  { return a.Token.Pos }
 func (a *ArrayLiteral) String() string {
 	var out bytes.Buffer
 	out.WriteString("[")
@@ -137,6 +156,7 @@ type PrefixExpression struct {
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() token.Position  { return pe.Token.Pos }
 func (pe *PrefixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -156,6 +176,7 @@ type InfixExpression struct {
 
 func (ie *InfixExpression) expressionNode()      {}
 func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *InfixExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -176,6 +197,7 @@ type IfExpression struct {
 
 func (ie *IfExpression) expressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *IfExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("if ")
@@ -196,6 +218,7 @@ type BlockStatement struct {
 
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() token.Position  { return bs.Token.Pos }
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 	for _, s := range bs.Statements {
@@ -213,6 +236,7 @@ type FunctionLiteral struct {
 
 func (fl *FunctionLiteral) expressionNode()      {}
 func (fl *FunctionLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FunctionLiteral) Pos() token.Position  { return fl.Token.Pos }
 func (fl *FunctionLiteral) String() string {
 	var out bytes.Buffer
 	params := []string{}
@@ -238,6 +262,7 @@ type CallExpression struct {
 
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() token.Position  { return ce.Token.Pos }
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 	args := []string{}
@@ -251,18 +276,27 @@ func (ce *CallExpression) String() string {
 	return out.String()
 }
 
+// IncrementExpression is ++x, --x, x++ or x--. The prefix forms evaluate to
+// the updated value, the postfix forms to the value before the update.
 type IncrementExpression struct {
 	Token    token.Token
 	Value    Expression
 	Operator string
+	Postfix  bool
 }
 
 func (ie *IncrementExpression) expressionNode()      {}
 func (ie *IncrementExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IncrementExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ce *IncrementExpression) String() string {
 	var out bytes.Buffer
-	out.WriteString(ce.Token.Literal)
-	out.WriteString(ce.Value.String())
+	if ce.Postfix {
+		out.WriteString(ce.Value.String())
+		out.WriteString(ce.Operator)
+	} else {
+		out.WriteString(ce.Operator)
+		out.WriteString(ce.Value.String())
+	}
 	return out.String()
 }
 
@@ -274,6 +308,7 @@ type IndexExpression struct {
 
 func (ie *IndexExpression) expressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() token.Position  { return ie.Token.Pos }
 func (ie *IndexExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("(")
@@ -285,18 +320,47 @@ func (ie *IndexExpression) String() string {
 	return out.String()
 }
 
+// SliceExpression is left[start:end]. Start and End are nil when left out.
+type SliceExpression struct {
+	Token token.Token // the [ token
+	Left  Expression
+	Start Expression
+	End   Expression
+}
+
+func (se *SliceExpression) expressionNode()      {}
+func (se *SliceExpression) TokenLiteral() string { return se.Token.Literal }
+func (se *SliceExpression) Pos() token.Position  { return se.Token.Pos }
+func (se *SliceExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("(")
+	out.WriteString(se.Left.String())
+	out.WriteString("[")
+	if se.Start != nil {
+		out.WriteString(se.Start.String())
+	}
+	out.WriteString(":")
+	if se.End != nil {
+		out.WriteString(se.End.String())
+	}
+	out.WriteString("])")
+	return out.String()
+}
+
 type HashLiteral struct {
 	Token token.Token
 	Pairs map[Expression]Expression
+	Keys  []Expression // the keys of Pairs in source order
 }
 
 func (hl *HashLiteral) expressionNode()      {}
 func (hl *HashLiteral) TokenLiteral() string { return hl.Token.Literal }
+func (hl *HashLiteral) Pos() token.Position  { return hl.Token.Pos }
 func (hl *HashLiteral) String() string {
 	var out bytes.Buffer
 	pairs := []string{}
-	for k, v := range hl.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s", k.String(), v.String()))
+	for _, k := range hl.Keys {
+		pairs = append(pairs, fmt.Sprintf("%s: %s", k.String(), hl.Pairs[k].String()))
 	}
 	out.WriteString("{")
 	out.WriteString(strings.Join(pairs, ","))
@@ -304,6 +368,46 @@ func (hl *HashLiteral) String() string {
 	return out.String()
 }
 
+type AssignExpression struct {
+	Token    token.Token // the assignment operator token
+	Name     *Identifier
+	Operator string // = += -= *= /= &= |=
+	Value    Expression
+}
+
+func (ae *AssignExpression) expressionNode()      {}
+func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) Pos() token.Position  { return ae.Token.Pos }
+func (ae *AssignExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString(ae.Name.String())
+	out.WriteString(" " + ae.Operator + " ")
+	out.WriteString(ae.Value.String())
+	return out.String()
+}
+
+// IndexAssignExpression is left[index] = value.
+type IndexAssignExpression struct {
+	Token  token.Token // the = token
+	Target *IndexExpression
+	Value  Expression
+}
+
+func (ia *IndexAssignExpression) expressionNode()      {}
+func (ia *IndexAssignExpression) TokenLiteral() string { return ia.Token.Literal }
+func (ia *IndexAssignExpression) Pos() token.Position  { return ia.Token.Pos }
+func (ia *IndexAssignExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString(ia.Target.Left.String())
+	out.WriteString("[")
+	out.WriteString(ia.Target.Index.String())
+	out.WriteString("] = ")
+	out.WriteString(ia.Value.String())
+	return out.String()
+}
+
+// ForLoop is for (Initialization; Test; Update) { Block }. Each of the three
+// clauses may be nil.
 type ForLoop struct {
 	Token          token.Token
 	Initialization Statement
@@ -314,16 +418,23 @@ type ForLoop struct {
 
 func (fl *ForLoop) expressionNode()      {}
 func (fl *ForLoop) TokenLiteral() string { return fl.Token.Literal }
+func (fl *ForLoop) Pos() token.Position  { return fl.Token.Pos }
 func (fl *ForLoop) String() string {
 	var out bytes.Buffer
 
 	out.WriteString("for")
 	out.WriteString("(")
-	out.WriteString(fl.Initialization.String())
-	out.WriteString(";")
-	out.WriteString(fl.Test.String())
-	out.WriteString(";")
-	out.WriteString(fl.Update.String())
+	if fl.Initialization != nil {
+		out.WriteString(strings.TrimSuffix(fl.Initialization.String(), ";"))
+	}
+	out.WriteString("; ")
+	if fl.Test != nil {
+		out.WriteString(fl.Test.String())
+	}
+	out.WriteString("; ")
+	if fl.Update != nil {
+		out.WriteString(fl.Update.String())
+	}
 	out.WriteString(")")
 
 	out.WriteString("{")
@@ -334,6 +445,96 @@ func (fl *ForLoop) String() string {
 	return out.String()
 }
 
+type WhileLoop struct {
+	Token     token.Token
+	Condition Expression
+	Block     *BlockStatement
+}
+
+func (wl *WhileLoop) expressionNode()      {}
+func (wl *WhileLoop) TokenLiteral() string { return wl.Token.Literal }
+func (wl *WhileLoop) Pos() token.Position  { return wl.Token.Pos }
+func (wl *WhileLoop) String() string {
+	var out bytes.Buffer
+	out.WriteString("while")
+	out.WriteString("(")
+	out.WriteString(wl.Condition.String())
+	out.WriteString(")")
+	out.WriteString("{")
+	out.WriteString(wl.Block.String())
+	out.WriteString("}")
+	return out.String()
+}
+
+type BreakStatement struct {
+	Token token.Token // the BREAK token
+}
+
+func (bs *BreakStatement) statementNode()       {}
+func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() token.Position  { return bs.Token.Pos }
+func (bs *BreakStatement) String() string       { return bs.Token.Literal + ";" }
+
+type ContinueStatement struct {
+	Token token.Token // the CONTINUE token
+}
+
+func (cs *ContinueStatement) statementNode()       {}
+func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) Pos() token.Position  { return cs.Token.Pos }
+func (cs *ContinueStatement) String() string       { return cs.Token.Literal + ";" }
+
+// TryExpression is try { Block } catch (Parameter) { Catch } finally
+// { Finally }. Either the catch or the finally clause may be missing.
+type TryExpression struct {
+	Token     token.Token // the TRY token
+	Block     *BlockStatement
+	Parameter *Identifier
+	Catch     *BlockStatement
+	Finally   *BlockStatement
+}
+
+func (te *TryExpression) expressionNode()      {}
+func (te *TryExpression) TokenLiteral() string { return te.Token.Literal }
+func (te *TryExpression) Pos() token.Position  { return te.Token.Pos }
+func (te *TryExpression) String() string {
+	var out bytes.Buffer
+	out.WriteString("try{")
+	out.WriteString(te.Block.String())
+	out.WriteString("}")
+	if te.Catch != nil {
+		out.WriteString("catch(")
+		out.WriteString(te.Parameter.String())
+		out.WriteString("){")
+		out.WriteString(te.Catch.String())
+		out.WriteString("}")
+	}
+	if te.Finally != nil {
+		out.WriteString("finally{")
+		out.WriteString(te.Finally.String())
+		out.WriteString("}")
+	}
+	return out.String()
+}
+
+type ThrowStatement struct {
+	Token token.Token // the THROW token
+	Value Expression
+}
+
+func (ts *ThrowStatement) statementNode()       {}
+func (ts *ThrowStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *ThrowStatement) Pos() token.Position  { return ts.Token.Pos }
+func (ts *ThrowStatement) String() string {
+	var out bytes.Buffer
+	out.WriteString(ts.TokenLiteral() + " ")
+	if ts.Value != nil {
+		out.WriteString(ts.Value.String())
+	}
+	out.WriteString(";")
+	return out.String()
+}
+
 type Program struct {
 	Statements []Statement
 }
@@ -346,6 +547,13 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Pos() token.Position {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return token.Position{}
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 	for _, s := range p.Statements {
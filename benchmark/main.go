@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"testing"
 	"time"
 
 	"demeulder.us/monkey/compiler"
@@ -14,6 +15,9 @@ import (
 )
 
 var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
+var allocs = flag.Bool("allocs", false, "measure the allocation cost of vm.New instead")
+var optimize = flag.Bool("optimize", true, "let the compiler optimize the bytecode")
+var compare = flag.Bool("compare", false, "compare the VM with and without compiler optimizations instead")
 
 var input = `
 	let fibonacci = fn(x) {
@@ -32,6 +36,14 @@ var input = `
 
 func main() {
 	flag.Parse()
+	if *allocs {
+		benchmarkNew()
+		return
+	}
+	if *compare {
+		benchmarkOptimize()
+		return
+	}
 
 	var duration time.Duration
 	var result object.Object
@@ -41,7 +53,7 @@ func main() {
 	program := p.ParseProgram()
 
 	if *engine == "vm" {
-		comp := compiler.New()
+		comp := compiler.NewWithConfig(compiler.Config{DisableOptimizations: !*optimize})
 		err := comp.Compile(program)
 		if err != nil {
 			fmt.Printf("compiler error: %s", err)
@@ -64,3 +76,100 @@ func main() {
 
 	fmt.Printf("engine=%s, result=%s, duration=%s\n", *engine, result.Inspect(), duration)
 }
+
+// The sizes that vm.New used to preallocate, before the stack, frames and
+// globals grew on demand.
+const (
+	fixedStackSize   = 2048
+	fixedGlobalsSize = 65536
+	fixedMaxFrames   = 1025
+)
+
+// sink keeps the preallocated slices alive so that they are not optimized
+// away.
+var sink []interface{}
+
+// newFixed allocates what vm.New allocated with fixed sizes.
+func newFixed(bc *compiler.Bytecode) *vm.VirtualMachine {
+	sink = []interface{}{
+		make([]object.Object, fixedStackSize),
+		make([]*vm.Frame, fixedMaxFrames),
+	}
+	return vm.NewWithGlobalsStore(bc, make([]object.Object, fixedGlobalsSize))
+}
+
+// benchmarkNew compares the cost of creating a VM, alone and with a run of
+// a small program, with fixed and growable sizes.
+func benchmarkNew() {
+	comp := compiler.New()
+	err := comp.Compile(parser.New(lexer.New(`let a = [1, 2, 3]; a[1] + 2`)).ParseProgram())
+	if err != nil {
+		fmt.Printf("compiler error: %s", err)
+		return
+	}
+	bc := comp.Bytecode()
+
+	constructors := []struct {
+		name string
+		new  func(*compiler.Bytecode) *vm.VirtualMachine
+	}{
+		{"fixed", newFixed},
+		{"growable", vm.New},
+	}
+	for _, run := range []bool{false, true} {
+		for _, c := range constructors {
+			result := testing.Benchmark(func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					machine := c.new(bc)
+					if run {
+						if err := machine.Run(); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+			fmt.Printf("new=%s, run=%t: %s %s\n", c.name, run, result, result.MemString())
+		}
+	}
+}
+
+// loopInput leaves the peephole optimizer jumps to remove and dead code to
+// drop in a hot loop.
+var loopInput = `
+	let sum = fn(n) {
+		let total = 0;
+		let i = 0;
+		while (true) {
+			if (i == n) { break; }
+			if (true) { total = total + i; }
+			if (false) { total = 0; }
+			i = i + 1;
+		}
+		return total;
+		total
+	}
+	sum(2000000)
+`
+
+// benchmarkOptimize times the VM on bytecode compiled with and without
+// optimizations.
+func benchmarkOptimize() {
+	program := parser.New(lexer.New(loopInput)).ParseProgram()
+	for _, disable := range []bool{true, false} {
+		comp := compiler.NewWithConfig(compiler.Config{DisableOptimizations: disable})
+		if err := comp.Compile(program); err != nil {
+			fmt.Printf("compiler error: %s", err)
+			return
+		}
+		machine := vm.New(comp.Bytecode())
+		start := time.Now()
+		if err := machine.Run(); err != nil {
+			fmt.Printf("vm error: %s", err)
+			return
+		}
+		duration := time.Since(start)
+		fmt.Printf("optimize=%t, result=%s, duration=%s\n",
+			!disable, machine.LastPoppedStackElement().Inspect(), duration)
+	}
+}
@@ -4,10 +4,34 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sort"
+
+	"demeulder.us/monkey/token"
 )
 
 type Instructions []byte
 
+// SourcePosition maps the instruction starting at Offset back to the source
+// position it was compiled from.
+type SourcePosition struct {
+	Offset int
+	Pos    token.Position
+}
+
+// PositionTable is sorted by Offset. Each entry covers every instruction up
+// to the offset of the next entry.
+type PositionTable []SourcePosition
+
+// Lookup returns the source position of the instruction at offset, or the
+// zero Position if the table has no entry for it.
+func (pt PositionTable) Lookup(offset int) token.Position {
+	i := sort.Search(len(pt), func(i int) bool { return pt[i].Offset > offset })
+	if i == 0 {
+		return token.Position{}
+	}
+	return pt[i-1].Pos
+}
+
 type Opcode byte
 
 const (
@@ -56,11 +80,33 @@ const (
 	OpClosure
 	OpGetFree
 	OpCurrentClosure
+
+	OpBoxLocal
+	OpGetLocalCell
+	OpSetLocalCell
+	OpSetFree
+	OpCaptureFree
+
+	OpSetIndex
+	OpSlice
+
+	OpTry
+	OpEndTry
+	OpThrow
+
+	OpTailCall
+
+	// OpWide is the prefix of an instruction whose operands are twice as
+	// wide, for the values that do not fit in its usual operands.
+	OpWide
 )
 
 type Definition struct {
 	Name          string
 	OperandWidths []int
+	// Wide is set on the definitions of the instructions after OpWide,
+	// whose width includes the prefix.
+	Wide bool
 }
 
 var definitions = map[Opcode]*Definition{
@@ -97,6 +143,35 @@ var definitions = map[Opcode]*Definition{
 	OpClosure:        {Name: "OpClosure", OperandWidths: []int{2, 1}},
 	OpGetFree:        {Name: "OpGetFree", OperandWidths: []int{1}},
 	OpCurrentClosure: {Name: "OpCurrentClosure", OperandWidths: []int{}},
+	OpBoxLocal:       {Name: "OpBoxLocal", OperandWidths: []int{1}},
+	OpGetLocalCell:   {Name: "OpGetLocalCell", OperandWidths: []int{1}},
+	OpSetLocalCell:   {Name: "OpSetLocalCell", OperandWidths: []int{1}},
+	OpSetFree:        {Name: "OpSetFree", OperandWidths: []int{1}},
+	OpCaptureFree:    {Name: "OpCaptureFree", OperandWidths: []int{1}},
+	OpSetIndex:       {Name: "OpSetIndex", OperandWidths: []int{}},
+	OpSlice:          {Name: "OpSlice", OperandWidths: []int{}},
+	OpTry:            {Name: "OpTry", OperandWidths: []int{2}},
+	OpEndTry:         {Name: "OpEndTry", OperandWidths: []int{}},
+	OpThrow:          {Name: "OpThrow", OperandWidths: []int{}},
+	OpTailCall:       {Name: "OpTailCall", OperandWidths: []int{1}},
+	OpWide:           {Name: "OpWide", OperandWidths: []int{}},
+}
+
+// wideDefinitions holds the definitions of the instructions that take the
+// OpWide prefix: those with operands.
+var wideDefinitions = map[Opcode]*Definition{}
+
+func init() {
+	for op, def := range definitions {
+		if len(def.OperandWidths) == 0 {
+			continue
+		}
+		widths := make([]int, len(def.OperandWidths))
+		for i, w := range def.OperandWidths {
+			widths[i] = 2 * w
+		}
+		wideDefinitions[op] = &Definition{Name: "OpWide " + def.Name, OperandWidths: widths, Wide: true}
+	}
 }
 
 func (ins Instructions) String() string {
@@ -104,19 +179,53 @@ func (ins Instructions) String() string {
 
 	i := 0
 	for i < len(ins) {
-		def, err := Lookup(ins[i])
+		def, operands, err := ins.Decode(i)
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			fmt.Fprintf(&out, "%04d ERROR: %s\n", i, err)
+			i++
 			continue
 		}
-		operands, read := ReadOperands(def, ins[i+1:])
 		fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
-		i += 1 + read
+		i += def.Width()
 	}
 
 	return out.String()
 }
 
+// Decode reads the instruction at offset, with its OpWide prefix if it has
+// one. It fails on an undefined opcode and on an instruction cut short by
+// the end of ins.
+func (ins Instructions) Decode(offset int) (*Definition, []int, error) {
+	var def *Definition
+	var err error
+	if Opcode(ins[offset]) == OpWide && offset+1 < len(ins) {
+		def, err = LookupWide(ins[offset+1])
+	} else {
+		def, err = Lookup(ins[offset])
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset+def.Width() > len(ins) {
+		return nil, nil, fmt.Errorf("%s at %d is cut short", def.Name, offset)
+	}
+	start := offset + 1
+	if def.Wide {
+		start++
+	}
+	operands, _ := ReadOperands(def, ins[start:])
+	return def, operands, nil
+}
+
+// Opcode returns the opcode of the instruction at offset, the one after the
+// prefix for a wide instruction.
+func (ins Instructions) Opcode(offset int) Opcode {
+	if Opcode(ins[offset]) == OpWide && offset+1 < len(ins) {
+		return Opcode(ins[offset+1])
+	}
+	return Opcode(ins[offset])
+}
+
 func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	operandCount := len(def.OperandWidths)
 
@@ -137,32 +246,121 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
 }
 
+// Make returns the instruction op with operands. It panics when an operand
+// does not fit in its width: Encode picks the wide form for those.
 func Make(op Opcode, operands ...int) []byte {
 	def, ok := definitions[op]
 	if !ok {
 		return []byte{}
 	}
+	instruction, err := encode(op, def, operands)
+	if err != nil {
+		panic(err)
+	}
+	return instruction
+}
 
-	instructionLen := 1
-	for _, w := range def.OperandWidths {
-		instructionLen += w
+// MakeWide returns the instruction op with operands twice as wide, after
+// the OpWide prefix. Like Make, it panics when an operand does not fit.
+func MakeWide(op Opcode, operands ...int) []byte {
+	if _, ok := wideDefinitions[op]; !ok {
+		return []byte{}
 	}
+	instruction, err := EncodeWide(op, operands...)
+	if err != nil {
+		panic(err)
+	}
+	return instruction
+}
 
-	instruction := make([]byte, instructionLen)
-	instruction[0] = byte(op)
+// Encode returns the instruction op with operands, in its wide form when
+// they do not fit in the usual one. It fails when they do not fit in either.
+func Encode(op Opcode, operands ...int) ([]byte, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+	if Fits(op, operands...) {
+		return encode(op, def, operands)
+	}
+	return EncodeWide(op, operands...)
+}
+
+// EncodeWide returns the wide form of the instruction op with operands, like
+// MakeWide, and fails when they do not fit.
+func EncodeWide(op Opcode, operands ...int) ([]byte, error) {
+	def, ok := wideDefinitions[op]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d has no wide form", op)
+	}
+	return encode(op, def, operands)
+}
+
+// Fits reports whether the operands fit in the instruction op made by Make.
+func Fits(op Opcode, operands ...int) bool {
+	def, ok := definitions[op]
+	if !ok {
+		return false
+	}
+	for i, o := range operands {
+		if i >= len(def.OperandWidths) || !fits(o, def.OperandWidths[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func fits(operand, width int) bool {
+	return operand >= 0 && uint64(operand) < 1<<(8*uint(width))
+}
+
+func encode(op Opcode, def *Definition, operands []int) ([]byte, error) {
+	if len(operands) > len(def.OperandWidths) {
+		return nil, fmt.Errorf("%s takes %d operands, got %d", def.Name, len(def.OperandWidths), len(operands))
+	}
+	instruction := make([]byte, def.Width())
+	offset := 0
+	if def.Wide {
+		instruction[0] = byte(OpWide)
+		offset++
+	}
+	instruction[offset] = byte(op)
+	offset++
 
-	offset := 1
 	for i, o := range operands {
 		width := def.OperandWidths[i]
+		if !fits(o, width) {
+			return nil, fmt.Errorf("operand %d of %s does not fit in %d bytes", o, def.Name, width)
+		}
 		switch width {
 		case 1:
 			instruction[offset] = byte(o)
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		}
 		offset += width
 	}
-	return instruction
+	return instruction, nil
+}
+
+// Width returns the number of bytes of an instruction, its opcode and
+// prefix included.
+func (def *Definition) Width() int {
+	width := 1 + def.operandsWidth()
+	if def.Wide {
+		width++
+	}
+	return width
+}
+
+func (def *Definition) operandsWidth() int {
+	width := 0
+	for _, w := range def.OperandWidths {
+		width += w
+	}
+	return width
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -173,22 +371,43 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
+// LookupWide returns the definition of op after the OpWide prefix.
+func LookupWide(op byte) (*Definition, error) {
+	def, ok := wideDefinitions[Opcode(op)]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d has no wide form", op)
+	}
+	return def, nil
+}
+
 func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
 	operands := make([]int, len(def.OperandWidths))
 	offset := 0
 	for i, width := range def.OperandWidths {
-		switch width {
-		case 2:
-			operands[i] = int(ReadUint16(ins[offset:]))
-		case 1:
-			operands[i] = int(ReadUint8(ins[offset:]))
-		}
+		operands[i] = ReadOperand(ins[offset:], width)
 		offset += width
 	}
 
 	return operands, offset
 }
 
+// ReadOperand reads an operand of width bytes.
+func ReadOperand(ins Instructions, width int) int {
+	switch width {
+	case 4:
+		return int(ReadUint32(ins))
+	case 2:
+		return int(ReadUint16(ins))
+	case 1:
+		return int(ReadUint8(ins))
+	}
+	return 0
+}
+
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
@@ -1,6 +1,7 @@
 package code
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -43,6 +44,69 @@ func TestMake(t *testing.T) {
 	}
 }
 
+func TestMakeWide(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpGetLocal, []int{300}, []byte{byte(OpWide), byte(OpGetLocal), 1, 44}},
+		{OpJump, []int{70000}, []byte{byte(OpWide), byte(OpJump), 0, 1, 17, 112}},
+		{OpClosure, []int{65536, 256}, []byte{byte(OpWide), byte(OpClosure), 0, 1, 0, 0, 1, 0}},
+	}
+
+	for _, tt := range tests {
+		instruction := MakeWide(tt.op, tt.operands...)
+		if !bytes.Equal(instruction, tt.expected) {
+			t.Errorf("wrong instruction. want=%v, got=%v", tt.expected, instruction)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+		err      string
+	}{
+		{OpGetLocal, []int{255}, Make(OpGetLocal, 255), ""},
+		{OpGetLocal, []int{256}, MakeWide(OpGetLocal, 256), ""},
+		{OpConstant, []int{65536}, MakeWide(OpConstant, 65536), ""},
+		{OpClosure, []int{1, 256}, MakeWide(OpClosure, 1, 256), ""},
+		{OpGetLocal, []int{65536}, nil, "operand 65536 of OpWide OpGetLocal does not fit in 2 bytes"},
+		{OpCall, []int{-1}, nil, "operand -1 of OpWide OpCall does not fit in 2 bytes"},
+		{OpAdd, []int{1}, nil, "opcode 1 has no wide form"},
+		{OpGetLocal, []int{1, 2}, nil, "OpWide OpGetLocal takes 1 operands, got 2"},
+		{Opcode(200), nil, nil, "opcode 200 undefined"},
+	}
+
+	for _, tt := range tests {
+		instruction, err := Encode(tt.op, tt.operands...)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("wrong error. want=%q, got=%v", tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !bytes.Equal(instruction, tt.expected) {
+			t.Errorf("wrong instruction. want=%v, got=%v", tt.expected, instruction)
+		}
+	}
+}
+
+func TestMakeRejectsLargeOperands(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Make did not reject an operand that does not fit")
+		}
+	}()
+	Make(OpGetLocal, 256)
+}
+
 func TestInstructionsString(t *testing.T) {
 	instructions := []Instructions{
 		Make(OpAdd),
@@ -50,6 +114,7 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpClosure, 65535, 255),
+		MakeWide(OpGetLocal, 300),
 		Make(OpPop),
 	}
 
@@ -58,7 +123,8 @@ func TestInstructionsString(t *testing.T) {
 0003 OpConstant 2
 0006 OpConstant 65535
 0009 OpClosure 65535 255
-0013 OpPop
+0013 OpWide OpGetLocal 300
+0017 OpPop
 `
 
 	concatted := Instructions{}
@@ -72,6 +138,20 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsStringErrors(t *testing.T) {
+	ins := Instructions{255, byte(OpPop)}
+	ins = append(ins, Make(OpConstant, 1)[:2]...)
+
+	expected := `0000 ERROR: opcode 255 undefined
+0001 OpPop
+0002 ERROR: OpConstant at 2 is cut short
+0003 ERROR: OpConstant at 3 is cut short
+`
+	if ins.String() != expected {
+		t.Errorf("instructions wrongly formatted.\nwant=%q\ngot =%q", expected, ins.String())
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	tests := []struct {
 		op        Opcode
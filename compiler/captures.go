@@ -0,0 +1,177 @@
+package compiler
+
+import "demeulder.us/monkey/ast"
+
+// captureScope mirrors the symbol tables the compiler creates, so that
+// findCaptures resolves names the same way Compile does.
+type captureScope struct {
+	// names maps a name to the identifier that declared it. Function names
+	// map to nil: they are loaded with OpCurrentClosure and never boxed.
+	names map[string]*ast.Identifier
+	outer *captureScope
+	// fn is the scope of the enclosing function, nil at the top level.
+	fn *captureScope
+}
+
+func newCaptureScope(outer *captureScope, function bool) *captureScope {
+	s := &captureScope{names: map[string]*ast.Identifier{}, outer: outer}
+	if function {
+		s.fn = s
+	} else if outer != nil {
+		s.fn = outer.fn
+	}
+	return s
+}
+
+// captureResolver finds the local variables that are referenced from a
+// nested function. Those live in cells (see object.Cell) so that the
+// function and its closures share them.
+type captureResolver struct {
+	scope    *captureScope
+	captured map[*ast.Identifier]bool
+}
+
+// findCaptures returns the declaring identifiers (let names and parameters)
+// of every local variable of the program that a closure captures.
+func findCaptures(program *ast.Program) map[*ast.Identifier]bool {
+	r := &captureResolver{
+		scope:    newCaptureScope(nil, false),
+		captured: map[*ast.Identifier]bool{},
+	}
+	for _, s := range program.Statements {
+		r.walk(s)
+	}
+	return r.captured
+}
+
+func (r *captureResolver) define(ident *ast.Identifier) {
+	// like SymbolTable.Define, a redeclaration in the same scope is the
+	// same variable
+	if existing := r.scope.names[ident.Value]; existing == nil {
+		r.scope.names[ident.Value] = ident
+	}
+}
+
+func (r *captureResolver) resolve(name string) {
+	for s := r.scope; s != nil; s = s.outer {
+		decl, ok := s.names[name]
+		if !ok {
+			continue
+		}
+		if decl != nil && s.fn != nil && s.fn != r.scope.fn {
+			r.captured[decl] = true
+		}
+		return
+	}
+}
+
+func (r *captureResolver) enter(function bool) {
+	r.scope = newCaptureScope(r.scope, function)
+}
+
+func (r *captureResolver) leave() {
+	r.scope = r.scope.outer
+}
+
+func (r *captureResolver) walk(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.LetStatement:
+		r.define(node.Name)
+		r.walk(node.Value)
+	case *ast.ReturnStatement:
+		r.walk(node.ReturnValue)
+	case *ast.ThrowStatement:
+		r.walk(node.Value)
+	case *ast.ExpressionStatement:
+		r.walk(node.Expression)
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			r.walk(s)
+		}
+	case *ast.Identifier:
+		r.resolve(node.Value)
+	case *ast.PrefixExpression:
+		r.walk(node.Right)
+	case *ast.InfixExpression:
+		r.walk(node.Left)
+		r.walk(node.Right)
+	case *ast.IfExpression:
+		r.walk(node.Condition)
+		r.walk(node.Consequence)
+		if node.Alternative != nil {
+			r.walk(node.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		r.enter(true)
+		if node.Name != "" {
+			r.scope.names[node.Name] = nil
+		}
+		for _, p := range node.Parameters {
+			r.define(p)
+		}
+		r.walk(node.Body)
+		r.leave()
+	case *ast.CallExpression:
+		r.walk(node.Function)
+		for _, a := range node.Arguments {
+			r.walk(a)
+		}
+	case *ast.ArrayLiteral:
+		for _, item := range node.Items {
+			r.walk(item)
+		}
+	case *ast.IndexExpression:
+		r.walk(node.Left)
+		r.walk(node.Index)
+	case *ast.HashLiteral:
+		for _, k := range node.Keys {
+			r.walk(k)
+			r.walk(node.Pairs[k])
+		}
+	case *ast.AssignExpression:
+		r.resolve(node.Name.Value)
+		r.walk(node.Value)
+	case *ast.IncrementExpression:
+		r.walk(node.Value)
+	case *ast.SliceExpression:
+		r.walk(node.Left)
+		if node.Start != nil {
+			r.walk(node.Start)
+		}
+		if node.End != nil {
+			r.walk(node.End)
+		}
+	case *ast.IndexAssignExpression:
+		r.walk(node.Target)
+		r.walk(node.Value)
+	case *ast.ForLoop:
+		r.enter(false)
+		if node.Initialization != nil {
+			r.walk(node.Initialization)
+		}
+		if node.Test != nil {
+			r.walk(node.Test)
+		}
+		r.walk(node.Block)
+		if node.Update != nil {
+			r.walk(node.Update)
+		}
+		r.leave()
+	case *ast.TryExpression:
+		r.walk(node.Block)
+		if node.Catch != nil {
+			r.enter(false)
+			r.define(node.Parameter)
+			r.walk(node.Catch)
+			r.leave()
+		}
+		if node.Finally != nil {
+			r.walk(node.Finally)
+		}
+	case *ast.WhileLoop:
+		r.enter(false)
+		r.walk(node.Condition)
+		r.walk(node.Block)
+		r.leave()
+	}
+}
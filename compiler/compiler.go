@@ -2,12 +2,13 @@ package compiler
 
 import (
 	"fmt"
-	"sort"
+	"strings"
 
 	"demeulder.us/monkey/ast"
 
 	"demeulder.us/monkey/code"
 	"demeulder.us/monkey/object"
+	"demeulder.us/monkey/token"
 )
 
 type Compiler struct {
@@ -15,15 +16,80 @@ type Compiler struct {
 	symbolTable *SymbolTable
 	scopes      []CompilationScope
 	scopeIndex  int
+
+	pos token.Position // source position of the node being compiled
+
+	// captured holds the declarations of locals that closures capture, see
+	// findCaptures
+	captured map[*ast.Identifier]bool
+	// tailCalls holds the calls in tail position of the functions compiled
+	// so far, see findTailCalls
+	tailCalls map[*ast.CallExpression]bool
+
+	config Config
+	// folded holds the values of the constant expressions, see
+	// foldConstants
+	folded map[ast.Expression]object.Object
+	// interned maps the keys of the constants to their index, see
+	// constantKey
+	interned map[interface{}]int
+
+	// err reports the first instruction whose operands do not fit even in
+	// its wide form, see encode
+	err error
+	// main holds the main program as Compile laid it out, for Bytecode
+	main *mainCode
+}
+
+// mainCode is the main program after scopeCode, and the length of the
+// instructions it was made from.
+type mainCode struct {
+	length       int
+	instructions code.Instructions
+	positions    code.PositionTable
+}
+
+// Config sets the optimizations of a compiler. The zero Config enables all
+// of them.
+type Config struct {
+	// DisableOptimizations turns off constant folding, the sharing of
+	// identical constants and the peephole optimizer, see optimize.
+	DisableOptimizations bool
 }
 
 type CompilationScope struct {
 	instructions    code.Instructions
+	positions       code.PositionTable
 	lastInstruction EmittedInstruction
 	prevInstruction EmittedInstruction
+	loops           []*loopContext
+	tries           []*tryContext
+	// farJumps holds the targets of the jumps that do not fit in their
+	// operand, by the offset of the jump, see changeOperand
+	farJumps map[int]int
+}
+
+// loopContext collects the jumps emitted for break and continue inside one
+// loop, so they can be patched once the loop's targets are known.
+type loopContext struct {
+	breakJumps    []int
+	continueJumps []int
+	tries         int // the number of enclosing try expressions
+}
+
+// tryContext is a try expression being compiled. handler is set while
+// its handler is installed, finally is nil without a finally clause.
+type tryContext struct {
+	finally *ast.BlockStatement
+	handler bool
+	loops   int // the number of enclosing loops
 }
 
 func New() *Compiler {
+	return NewWithConfig(Config{})
+}
+
+func NewWithConfig(config Config) *Compiler {
 
 	symbolTable := NewSymbolTable()
 	for i, v := range object.Builtins {
@@ -40,6 +106,9 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+		tailCalls:   map[*ast.CallExpression]bool{},
+		config:      config,
+		interned:    map[interface{}]int{},
 	}
 }
 
@@ -47,6 +116,11 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	compiler := New()
 	compiler.symbolTable = s
 	compiler.constants = constants
+	for i, c := range constants {
+		if key := constantKey(c); key != nil {
+			compiler.interned[key] = i
+		}
+	}
 	return compiler
 }
 
@@ -56,16 +130,32 @@ type EmittedInstruction struct {
 }
 
 func (c *Compiler) Compile(node ast.Node) error {
+	if pos := node.Pos(); pos.IsValid() {
+		outer := c.pos
+		c.pos = pos
+		defer func() { c.pos = outer }()
+	}
 
 	switch node := node.(type) {
 
 	case *ast.Program:
+		c.captured = findCaptures(node)
+		if !c.config.DisableOptimizations {
+			c.folded = foldConstants(node)
+		}
 		for _, s := range node.Statements {
 			err := c.Compile(s)
 			if err != nil {
 				return err
 			}
 		}
+		// lay out the main program now, so that its errors are compile
+		// errors
+		instructions, positions, err := c.scopeCode(false)
+		if err != nil {
+			return err
+		}
+		c.main = &mainCode{len(c.currentInstructions()), instructions, positions}
 
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression)
@@ -75,6 +165,13 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpPop)
 
 	case *ast.InfixExpression:
+		if value, ok := c.folded[node]; ok {
+			c.emitValue(value)
+			return nil
+		}
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
+		}
 		err := c.Compile(node.Left)
 		if err != nil {
 			return err
@@ -113,6 +210,11 @@ func (c *Compiler) Compile(node ast.Node) error {
 		addr := c.addConstant(integer)
 		c.emit(code.OpConstant, addr)
 
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		addr := c.addConstant(float)
+		c.emit(code.OpConstant, addr)
+
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -126,6 +228,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpConstant, addr)
 
 	case *ast.PrefixExpression:
+		if value, ok := c.folded[node]; ok {
+			c.emitValue(value)
+			return nil
+		}
 		err := c.Compile(node.Right)
 		if err != nil {
 			return err
@@ -158,8 +264,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		jumpPos := c.emit(code.OpJump, 9999)
 
 		afterConsequencePos := len(c.currentInstructions())
-		newInstruction := code.Make(code.OpJumpNotTruthy, afterConsequencePos)
-		c.replaceInstruction(jumpNotTruthyPos, newInstruction)
+		c.changeOperand(jumpNotTruthyPos, afterConsequencePos)
 
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
@@ -173,8 +278,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 		afterAlternativePos := len(c.currentInstructions())
-		newInstruction = code.Make(code.OpJump, afterAlternativePos)
-		c.replaceInstruction(jumpPos, newInstruction)
+		c.changeOperand(jumpPos, afterAlternativePos)
 
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
@@ -185,17 +289,56 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 
 	case *ast.LetStatement:
-		symbol := c.symbolTable.Define(node.Name.Value)
+		symbol := c.define(node.Name)
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
-		switch symbol.Scope {
-		case LocalScope:
-			c.emit(code.OpSetLocal, symbol.Index)
-		case GlobalScope:
-			c.emit(code.OpSetGlobal, symbol.Index)
+		c.storeSymbol(symbol)
+
+	case *ast.AssignExpression:
+		return c.compileAssignExpression(node)
+
+	case *ast.IncrementExpression:
+		return c.compileIncrementExpression(node)
+
+	case *ast.ForLoop:
+		return c.compileForLoop(node)
+
+	case *ast.WhileLoop:
+		return c.compileWhileLoop(node)
+
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("break outside of loop")
+		}
+		err := c.exitTries(loop.tries)
+		if err != nil {
+			return err
+		}
+		loop.breakJumps = append(loop.breakJumps, c.emit(code.OpJump, 9999))
+
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("continue outside of loop")
+		}
+		err := c.exitTries(loop.tries)
+		if err != nil {
+			return err
+		}
+		loop.continueJumps = append(loop.continueJumps, c.emit(code.OpJump, 9999))
+
+	case *ast.TryExpression:
+		return c.compileTryExpression(node)
+
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
 		}
+		c.emit(code.OpThrow)
 
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
@@ -214,12 +357,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(code.OpArray, len(node.Items))
 
 	case *ast.HashLiteral:
-		keys := []ast.Expression{}
-		for k := range node.Pairs {
-			keys = append(keys, k)
-		}
-		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
-		for _, k := range keys {
+		for _, k := range node.Keys {
 			err := c.Compile(k)
 			if err != nil {
 				return err
@@ -242,14 +380,52 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpIndex)
 
+	case *ast.SliceExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+		for _, bound := range []ast.Expression{node.Start, node.End} {
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+			err := c.Compile(bound)
+			if err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpSlice)
+
+	case *ast.IndexAssignExpression:
+		err := c.Compile(node.Target.Left)
+		if err != nil {
+			return err
+		}
+		err = c.Compile(node.Target.Index)
+		if err != nil {
+			return err
+		}
+		err = c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpSetIndex)
+
 	case *ast.FunctionLiteral:
 		c.enterScope()
 		if node.Name != "" {
 			c.symbolTable.DefineFunctionName(node.Name)
 		}
 		for _, param := range node.Parameters {
-			c.symbolTable.Define(param.Value)
+			c.define(param)
 		}
+		for _, param := range node.Parameters {
+			if s, _ := c.symbolTable.Resolve(param.Value); s.Scope == CellScope {
+				c.emit(code.OpBoxLocal, s.Index)
+			}
+		}
+		findTailCalls(node.Body, c.tailCalls)
 		err := c.Compile(node.Body)
 		if err != nil {
 			return err
@@ -262,14 +438,20 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
+		instructions, positions, err := c.scopeCode(true)
+		if err != nil {
+			return err
+		}
+		c.leaveScope()
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
+			c.captureSymbol(s)
 		}
 		cf := &object.CompiledFunction{
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			Positions:     positions,
 		}
 		addr := c.addConstant(cf)
 		c.emit(code.OpClosure, addr, len(freeSymbols))
@@ -279,6 +461,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
+		err = c.exitTries(0)
+		if err != nil {
+			return err
+		}
 		c.emit(code.OpReturnValue)
 
 	case *ast.CallExpression:
@@ -292,8 +478,356 @@ func (c *Compiler) Compile(node ast.Node) error {
 				return err
 			}
 		}
-		c.emit(code.OpCall, len(node.Arguments))
+		if c.tailCalls[node] {
+			c.emit(code.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(code.OpCall, len(node.Arguments))
+		}
+
+	}
+	return c.err
+}
+
+// compileLogicalExpression compiles && and || so that the right operand is
+// skipped when the left one decides the result. Both leave a boolean:
+//
+//	a && b:  a; JumpNotTruthy F; b; JumpNotTruthy F; True; Jump E; F: False; E:
+//	a || b:  a; JumpNotTruthy R; True; Jump E; R: b; JumpNotTruthy F; True; Jump E; F: False; E:
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+	jumpToFalse := []int{c.emit(code.OpJumpNotTruthy, 9999)}
+	jumpToEnd := []int{}
+
+	if node.Operator == "||" {
+		// a truthy left operand skips the right one
+		c.emit(code.OpTrue)
+		jumpToEnd = append(jumpToEnd, c.emit(code.OpJump, 9999))
+		c.changeOperand(jumpToFalse[0], len(c.currentInstructions()))
+		jumpToFalse = jumpToFalse[:0]
+	}
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+	jumpToFalse = append(jumpToFalse, c.emit(code.OpJumpNotTruthy, 9999))
+	c.emit(code.OpTrue)
+	jumpToEnd = append(jumpToEnd, c.emit(code.OpJump, 9999))
+
+	for _, pos := range jumpToFalse {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+	c.emit(code.OpFalse)
+	for _, pos := range jumpToEnd {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+	return nil
+}
+
+var compoundAssignOps = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+}
+
+// compileAssignExpression stores the new value in an existing binding and
+// leaves it on the stack as the value of the expression.
+func (c *Compiler) compileAssignExpression(node *ast.AssignExpression) error {
+	symbol, err := c.resolveAssignable(node.Name.Value)
+	if err != nil {
+		return err
+	}
+
+	switch node.Operator {
+	case "=":
+		err = c.Compile(node.Value)
+	case "&=", "|=":
+		err = c.compileLogicalExpression(&ast.InfixExpression{
+			Token:    node.Token,
+			Left:     node.Name,
+			Operator: strings.Repeat(node.Operator[:1], 2),
+			Right:    node.Value,
+		})
+	default:
+		op, ok := compoundAssignOps[node.Operator]
+		if !ok {
+			return fmt.Errorf("unknown assignment operator %s", node.Operator)
+		}
+		c.loadSymbol(symbol)
+		err = c.Compile(node.Value)
+		c.emit(op)
+	}
+	if err != nil {
+		return err
+	}
+	c.storeSymbol(symbol)
+	c.loadSymbol(symbol)
+	return nil
+}
 
+// compileIncrementExpression compiles ++x as x = x + 1 leaving the new value
+// on the stack. For x++ the old value is loaded first and left underneath.
+func (c *Compiler) compileIncrementExpression(node *ast.IncrementExpression) error {
+	symbol, err := c.resolveAssignable(node.Value.(*ast.Identifier).Value)
+	if err != nil {
+		return err
+	}
+	op := code.OpAdd
+	if node.Operator == "--" {
+		op = code.OpSub
+	}
+
+	if node.Postfix {
+		c.loadSymbol(symbol)
+	}
+	c.loadSymbol(symbol)
+	c.emit(code.OpConstant, c.addConstant(&object.Integer{Value: 1}))
+	c.emit(op)
+	c.storeSymbol(symbol)
+	if !node.Postfix {
+		c.loadSymbol(symbol)
+	}
+	return nil
+}
+
+// resolveAssignable looks up a name that is about to be assigned to.
+func (c *Compiler) resolveAssignable(name string) (Symbol, error) {
+	symbol, ok := c.symbolTable.Resolve(name)
+	if !ok {
+		return symbol, fmt.Errorf("assignment to undeclared variable %s", name)
+	}
+	switch symbol.Scope {
+	case GlobalScope, LocalScope, CellScope:
+		return symbol, nil
+	case FreeScope:
+		if c.symbolTable.original(symbol).Scope != CellScope {
+			return symbol, fmt.Errorf("cannot assign to %s", name)
+		}
+		return symbol, nil
+	default:
+		return symbol, fmt.Errorf("cannot assign to %s", name)
+	}
+}
+
+// compileForLoop compiles
+//
+//	init; L: test; JumpNotTruthy E; body; update; Jump L; E: Null
+//
+// The loop variables live in a block scope that ends with the loop.
+func (c *Compiler) compileForLoop(node *ast.ForLoop) error {
+	outer := c.symbolTable
+	c.symbolTable = NewBlockSymbolTable(outer)
+	defer func() { c.symbolTable = outer }()
+
+	if node.Initialization != nil {
+		err := c.Compile(node.Initialization)
+		if err != nil {
+			return err
+		}
+	}
+
+	testPos := len(c.currentInstructions())
+	jumpNotTruthyPos := -1
+	if node.Test != nil {
+		err := c.Compile(node.Test)
+		if err != nil {
+			return err
+		}
+		jumpNotTruthyPos = c.emit(code.OpJumpNotTruthy, 9999)
+	}
+
+	c.enterLoop()
+	err := c.Compile(node.Block)
+	if err != nil {
+		return err
+	}
+	continuePos := len(c.currentInstructions())
+	if node.Update != nil {
+		err := c.Compile(node.Update)
+		if err != nil {
+			return err
+		}
+	}
+	c.emit(code.OpJump, testPos)
+
+	afterLoopPos := len(c.currentInstructions())
+	if jumpNotTruthyPos >= 0 {
+		c.changeOperand(jumpNotTruthyPos, afterLoopPos)
+	}
+	c.leaveLoop(continuePos, afterLoopPos)
+	c.emit(code.OpNull)
+	return nil
+}
+
+// compileWhileLoop compiles
+//
+//	L: condition; JumpNotTruthy E; body; Jump L; E: Null
+func (c *Compiler) compileWhileLoop(node *ast.WhileLoop) error {
+	outer := c.symbolTable
+	c.symbolTable = NewBlockSymbolTable(outer)
+	defer func() { c.symbolTable = outer }()
+
+	conditionPos := len(c.currentInstructions())
+	err := c.Compile(node.Condition)
+	if err != nil {
+		return err
+	}
+	jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	c.enterLoop()
+	err = c.Compile(node.Block)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpJump, conditionPos)
+
+	afterLoopPos := len(c.currentInstructions())
+	c.changeOperand(jumpNotTruthyPos, afterLoopPos)
+	c.leaveLoop(conditionPos, afterLoopPos)
+	c.emit(code.OpNull)
+	return nil
+}
+
+func (c *Compiler) enterLoop() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, &loopContext{tries: len(scope.tries)})
+}
+
+// leaveLoop patches the loop's continue jumps to continuePos and its break
+// jumps to breakPos.
+func (c *Compiler) leaveLoop(continuePos int, breakPos int) {
+	scope := &c.scopes[c.scopeIndex]
+	loop := scope.loops[len(scope.loops)-1]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+	for _, pos := range loop.continueJumps {
+		c.changeOperand(pos, continuePos)
+	}
+	for _, pos := range loop.breakJumps {
+		c.changeOperand(pos, breakPos)
+	}
+}
+
+// currentLoop returns the innermost loop of the current function, or nil.
+func (c *Compiler) currentLoop() *loopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+// compileTryExpression compiles
+//
+//	Try C; block; EndTry; Jump F
+//	C: catch = error; Try T; catch block; EndTry; Jump F
+//	T: finally block; Throw
+//	F: finally block; Null
+//
+// Try installs a handler that sends an error to C, or to T without a catch
+// clause, with the caught value on the stack. Without a finally clause the
+// catch block runs without a handler and T and F are empty.
+//
+// The finally block is compiled once for every way out of the try: at T,
+// at F and, by exitTries, before each return, break or continue that
+// leaves it. The copies are deliberate: each one knows how to continue, so
+// the VM does not have to keep a pending throw, return or jump while a
+// finally block runs. The price is code size: a try with a finally clause
+// inside a finally block is compiled at least twice for every copy of
+// the outer one.
+func (c *Compiler) compileTryExpression(node *ast.TryExpression) error {
+	try := c.enterTry(node.Finally)
+	handlerPos := c.emit(code.OpTry, 9999)
+	err := c.Compile(node.Block)
+	if err != nil {
+		return err
+	}
+	c.emit(code.OpEndTry)
+	jumpPos := []int{c.emit(code.OpJump, 9999)}
+
+	if node.Catch != nil {
+		c.changeOperand(handlerPos, len(c.currentInstructions()))
+		outer := c.symbolTable
+		c.symbolTable = NewBlockSymbolTable(outer)
+		c.storeSymbol(c.define(node.Parameter))
+		try.handler = node.Finally != nil
+		if try.handler {
+			handlerPos = c.emit(code.OpTry, 9999)
+		}
+		err := c.Compile(node.Catch)
+		c.symbolTable = outer
+		if err != nil {
+			return err
+		}
+		if try.handler {
+			c.emit(code.OpEndTry)
+			jumpPos = append(jumpPos, c.emit(code.OpJump, 9999))
+		}
+	}
+	c.leaveTry()
+
+	if node.Finally != nil {
+		c.changeOperand(handlerPos, len(c.currentInstructions()))
+		err := c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
+	}
+	for _, pos := range jumpPos {
+		c.changeOperand(pos, len(c.currentInstructions()))
+	}
+	if node.Finally != nil {
+		err := c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+	}
+	c.emit(code.OpNull)
+	return nil
+}
+
+func (c *Compiler) enterTry(finally *ast.BlockStatement) *tryContext {
+	scope := &c.scopes[c.scopeIndex]
+	try := &tryContext{finally: finally, handler: true, loops: len(scope.loops)}
+	scope.tries = append(scope.tries, try)
+	return try
+}
+
+func (c *Compiler) leaveTry() {
+	scope := &c.scopes[c.scopeIndex]
+	scope.tries = scope.tries[:len(scope.tries)-1]
+}
+
+// exitTries is emitted before a return, break or continue that leaves the
+// try expressions of the current function above depth. It removes their
+// handlers and runs their finally blocks, innermost first.
+func (c *Compiler) exitTries(depth int) error {
+	scope := &c.scopes[c.scopeIndex]
+	tries, loops := scope.tries, scope.loops
+	defer func() {
+		scope := &c.scopes[c.scopeIndex]
+		scope.tries, scope.loops = tries, loops
+	}()
+
+	for i := len(tries) - 1; i >= depth; i-- {
+		if tries[i].handler {
+			c.emit(code.OpEndTry)
+		}
+		if tries[i].finally == nil {
+			continue
+		}
+		// the finally block only sees the loops and tries around its
+		// try expression
+		scope := &c.scopes[c.scopeIndex]
+		scope.tries, scope.loops = tries[:i], loops[:tries[i].loops]
+		err := c.Compile(tries[i].finally)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -301,29 +835,108 @@ func (c *Compiler) Compile(node ast.Node) error {
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	Positions    code.PositionTable
 }
 
+// Bytecode returns the compiled program. It is only complete after Compile
+// succeeded.
 func (c *Compiler) Bytecode() *Bytecode {
+	main := c.main
+	if main == nil || main.length != len(c.currentInstructions()) {
+		instructions, positions, _ := c.scopeCode(false)
+		main = &mainCode{instructions: instructions, positions: positions}
+	}
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: main.instructions,
 		Constants:    c.constants,
+		Positions:    main.positions,
 	}
 }
 
+// scopeCode returns the instructions and positions of the current scope,
+// the main program or a function body, with the far jumps in their wide
+// form and, unless optimizations are off, optimized.
+func (c *Compiler) scopeCode(function bool) (code.Instructions, code.PositionTable, error) {
+	scope := c.scopes[c.scopeIndex]
+	if c.config.DisableOptimizations && len(scope.farJumps) == 0 {
+		return scope.instructions, scope.positions, nil
+	}
+	o, ok := newOptimizer(scope.instructions, scope.positions, scope.farJumps, function)
+	if !ok {
+		return scope.instructions, scope.positions, nil
+	}
+	if !c.config.DisableOptimizations {
+		o.optimize()
+	}
+	return o.encode()
+}
+
+// addConstant adds obj to the constant pool and returns its index. Unless
+// optimizations are off, an integer, float or string that is already in the
+// pool is shared.
 func (c *Compiler) addConstant(obj object.Object) int {
+	key := constantKey(obj)
+	if key != nil && !c.config.DisableOptimizations {
+		if i, ok := c.interned[key]; ok {
+			return i
+		}
+		c.interned[key] = len(c.constants)
+	}
 	c.constants = append(c.constants, obj)
 	return len(c.constants) - 1
 }
 
+// emitValue loads value, the result of a constant expression.
+func (c *Compiler) emitValue(value object.Object) {
+	switch value := value.(type) {
+	case *object.Boolean:
+		if value.Value {
+			c.emit(code.OpTrue)
+		} else {
+			c.emit(code.OpFalse)
+		}
+	default:
+		c.emit(code.OpConstant, c.addConstant(value))
+	}
+}
+
+// emit appends the instruction op, in its wide form when the operands do
+// not fit in the usual one, and returns its offset. An instruction that does
+// not fit at all is left out and fails the compilation.
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
-	ins := code.Make(op, operands...)
+	ins := c.encode(op, operands...)
 	posNewInstruction := len(c.currentInstructions())
 	updatedInstructions := append(c.currentInstructions(), ins...)
 	c.scopes[c.scopeIndex].instructions = updatedInstructions
 	c.setLastInstruction(op, posNewInstruction)
+	c.addPosition(posNewInstruction)
 	return posNewInstruction
 }
 
+// encode returns the instruction op with operands, see code.Encode. The
+// first error is kept in c.err, which Compile returns.
+func (c *Compiler) encode(op code.Opcode, operands ...int) code.Instructions {
+	ins, err := code.Encode(op, operands...)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return ins
+}
+
+// addPosition records the current source position for the instruction at
+// offset, unless the previous entry already covers it.
+func (c *Compiler) addPosition(offset int) {
+	if !c.pos.IsValid() {
+		return
+	}
+	positions := c.scopes[c.scopeIndex].positions
+	if len(positions) > 0 && positions[len(positions)-1].Pos == c.pos {
+		return
+	}
+	entry := code.SourcePosition{Offset: offset, Pos: c.pos}
+	c.scopes[c.scopeIndex].positions = append(positions, entry)
+}
+
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
@@ -336,6 +949,43 @@ func (c *Compiler) loadSymbol(s Symbol) {
 		c.emit(code.OpGetFree, s.Index)
 	case FunctionScope:
 		c.emit(code.OpCurrentClosure)
+	case CellScope:
+		c.emit(code.OpGetLocalCell, s.Index)
+	}
+}
+
+// captureSymbol pushes what a new closure stores for the free symbol s:
+// the cell of a captured variable rather than its value.
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case CellScope:
+		c.emit(code.OpGetLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
+// define binds the name declared by ident, in a cell if a closure
+// captures it.
+func (c *Compiler) define(ident *ast.Identifier) Symbol {
+	if c.captured[ident] {
+		return c.symbolTable.DefineCell(ident.Value)
+	}
+	return c.symbolTable.Define(ident.Value)
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpSetLocal, s.Index)
+	case CellScope:
+		c.emit(code.OpSetLocalCell, s.Index)
+	case FreeScope:
+		c.emit(code.OpSetFree, s.Index)
 	}
 }
 
@@ -363,6 +1013,15 @@ func (c *Compiler) removeLastPop() {
 
 	c.scopes[c.scopeIndex].instructions = new
 	c.scopes[c.scopeIndex].lastInstruction = previous
+	c.truncatePositions(last.Position)
+}
+
+func (c *Compiler) truncatePositions(offset int) {
+	positions := c.scopes[c.scopeIndex].positions
+	for len(positions) > 0 && positions[len(positions)-1].Offset >= offset {
+		positions = positions[:len(positions)-1]
+	}
+	c.scopes[c.scopeIndex].positions = positions
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstr []byte) {
@@ -373,6 +1032,22 @@ func (c *Compiler) replaceInstruction(pos int, newInstr []byte) {
 	}
 }
 
+// changeOperand sets the target of the jump emitted at opPos. A target that
+// does not fit in the operand goes to farJumps instead, and scopeCode widens
+// the jump.
+func (c *Compiler) changeOperand(opPos int, operand int) {
+	op := code.Opcode(c.currentInstructions()[opPos])
+	if !code.Fits(op, operand) {
+		scope := &c.scopes[c.scopeIndex]
+		if scope.farJumps == nil {
+			scope.farJumps = map[int]int{}
+		}
+		scope.farJumps[opPos] = operand
+		return
+	}
+	c.replaceInstruction(opPos, c.encode(op, operand))
+}
+
 func (c *Compiler) enterScope() {
 	newScope := CompilationScope{
 		instructions:    code.Instructions{},
@@ -398,6 +1073,6 @@ func (c *Compiler) currentInstructions() code.Instructions {
 
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
-	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
+	c.replaceInstruction(lastPos, c.encode(code.OpReturnValue))
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
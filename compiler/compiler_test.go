@@ -1,7 +1,12 @@
 package compiler
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"reflect"
+	"strings"
 	"testing"
 
 	"demeulder.us/monkey/ast"
@@ -78,6 +83,16 @@ func TestIntegerArithmetic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "1.5 + 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTests(t, tests)
@@ -221,28 +236,449 @@ func TestConditionals(t *testing.T) {
 			input:             "if (true) { 10; } else { 20; } 3333;",
 			expectedConstants: []interface{}{10, 20, 3333},
 			expectedInstructions: []code.Instructions{
-				// 0000
-				code.Make(code.OpTrue),
-				// 0001
-				code.Make(code.OpJumpNotTruthy, 10),
-				// 0004
-				code.Make(code.OpConstant, 0),
-				// 0007
-				code.Make(code.OpJump, 13),
-				// 0010
-				code.Make(code.OpConstant, 1),
-				// 0013
-				code.Make(code.OpPop),
-				// 0014
-				code.Make(code.OpConstant, 2),
-				// 0017
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 10),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpJump, 13),
+				// 0010
+				code.Make(code.OpConstant, 1),
+				// 0013
+				code.Make(code.OpPop),
+				// 0014
+				code.Make(code.OpConstant, 2),
+				// 0017
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestLogicalExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "true && false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpJumpNotTruthy, 12),
+				// 0008
+				code.Make(code.OpTrue),
+				// 0009
+				code.Make(code.OpJump, 13),
+				// 0012
+				code.Make(code.OpFalse),
+				// 0013
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "true || false",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 8),
+				// 0004
+				code.Make(code.OpTrue),
+				// 0005
+				code.Make(code.OpJump, 17),
+				// 0008
+				code.Make(code.OpFalse),
+				// 0009
+				code.Make(code.OpJumpNotTruthy, 16),
+				// 0012
+				code.Make(code.OpTrue),
+				// 0013
+				code.Make(code.OpJump, 17),
+				// 0016
+				code.Make(code.OpFalse),
+				// 0017
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestForLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "for (let i = 0; i < 10; i += 1) { i }",
+			expectedConstants: []interface{}{0, 10, 1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpSetGlobal, 0),
+				// 0006
+				code.Make(code.OpGetGlobal, 0),
+				// 0009
+				code.Make(code.OpConstant, 1),
+				// 0012
+				code.Make(code.OpLess),
+				// 0013
+				code.Make(code.OpJumpNotTruthy, 37),
+				// 0016
+				code.Make(code.OpGetGlobal, 0),
+				// 0019
+				code.Make(code.OpPop),
+				// 0020
+				code.Make(code.OpGetGlobal, 0),
+				// 0023
+				code.Make(code.OpConstant, 2),
+				// 0026
+				code.Make(code.OpAdd),
+				// 0027
+				code.Make(code.OpSetGlobal, 0),
+				// 0030
+				code.Make(code.OpGetGlobal, 0),
+				// 0033
+				code.Make(code.OpPop),
+				// 0034
+				code.Make(code.OpJump, 6),
+				// 0037
+				code.Make(code.OpNull),
+				// 0038
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { for (;;) { 1 } }",
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpJump, 0),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "while (true) { if (false) { break; }; continue; }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 22),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpJumpNotTruthy, 14),
+				// 0008
+				code.Make(code.OpJump, 22),
+				// 0011
+				code.Make(code.OpJump, 15),
+				// 0014
+				code.Make(code.OpNull),
+				// 0015
+				code.Make(code.OpPop),
+				// 0016
+				code.Make(code.OpJump, 0),
+				// 0019
+				code.Make(code.OpJump, 0),
+				// 0022
+				code.Make(code.OpNull),
+				// 0023
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "try { throw 1; } catch (e) { e }",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 11),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpThrow),
+				// 0007
+				code.Make(code.OpEndTry),
+				// 0008
+				code.Make(code.OpJump, 18),
+				// 0011
+				code.Make(code.OpSetGlobal, 0),
+				// 0014
+				code.Make(code.OpGetGlobal, 0),
+				// 0017
+				code.Make(code.OpPop),
+				// 0018
+				code.Make(code.OpNull),
+				// 0019
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "try { 1 } finally { 2 }",
+			expectedConstants: []interface{}{1, 2, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 11),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpPop),
+				// 0007
+				code.Make(code.OpEndTry),
+				// 0008
+				code.Make(code.OpJump, 16),
+				// 0011
+				code.Make(code.OpConstant, 1),
+				// 0014
+				code.Make(code.OpPop),
+				// 0015
+				code.Make(code.OpThrow),
+				// 0016
+				code.Make(code.OpConstant, 2),
+				// 0019
+				code.Make(code.OpPop),
+				// 0020
+				code.Make(code.OpNull),
+				// 0021
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { try { return 1; } finally { 2 } }",
+			expectedConstants: []interface{}{
+				1, 2, 2, 2,
+				[]code.Instructions{
+					code.Make(code.OpTry, 16),
+					code.Make(code.OpConstant, 0),
+					// the return leaves the try and runs the finally block
+					code.Make(code.OpEndTry),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpPop),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpEndTry),
+					code.Make(code.OpJump, 21),
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpPop),
+					code.Make(code.OpThrow),
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpPop),
+					code.Make(code.OpNull),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let x = 1; x = 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let x = 1; x -= 2 }",
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSub),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestIncrementExpressions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "let x = 1; ++x",
+			expectedConstants: []interface{}{1, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: "fn() { let x = 1; x-- }",
+			expectedConstants: []interface{}{
+				1,
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSub),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 2, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestMutableClosures(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+			fn() {
+				let a = 1;
+				fn() { a = 2 }
+			}
+			`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetFree, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocalCell, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `
+			fn(a, b) {
+				let c = a;
+				fn() { b }
+			}
+			`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpBoxLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpSetLocal, 2),
+					code.Make(code.OpGetLocal, 1),
+					code.Make(code.OpClosure, 0, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
 				code.Make(code.OpPop),
 			},
 		},
 	}
+
 	runCompilerTests(t, tests)
 }
 
+func TestCompilerErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 1", "assignment to undeclared variable x"},
+		{"len = 1", "cannot assign to len"},
+		{"x++", "assignment to undeclared variable x"},
+		{"len++", "cannot assign to len"},
+		{"let f = fn() { fn() { f = 1 } }", "cannot assign to f"},
+		{"for (let i = 0; i < 1; i += 1) { i }; i", "undefined variable i"},
+		{"break", "break outside of loop"},
+		{"if (true) { continue }", "continue outside of loop"},
+		{"while (true) { fn() { break } }", "break outside of loop"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		compiler := New()
+		err := compiler.Compile(program)
+		if err == nil {
+			t.Fatalf("expected compiler error for %q, got none", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong compiler error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -434,6 +870,33 @@ func TestIndexExpressions(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "[1, 2][1:]",
+			expectedConstants: []interface{}{1, 2, 1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpArray, 2),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpNull),
+				code.Make(code.OpSlice),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "let a = [1]; a[0] = 2",
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+				code.Make(code.OpPop),
+			},
+		},
 	}
 
 	runCompilerTests(t, tests)
@@ -614,7 +1077,7 @@ func TestBuiltins(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpGetBuiltin, 0),
 					code.Make(code.OpArray, 0),
-					code.Make(code.OpCall, 1),
+					code.Make(code.OpTailCall, 1),
 					code.Make(code.OpReturnValue),
 				},
 			},
@@ -646,6 +1109,7 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
+					code.Make(code.OpBoxLocal, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
@@ -676,12 +1140,14 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpBoxLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
+					code.Make(code.OpBoxLocal, 0),
 					code.Make(code.OpGetLocal, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
@@ -712,75 +1178,644 @@ func TestClosures(t *testing.T) {
 				77,
 				88,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 3),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetGlobal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpAdd),
-					code.Make(code.OpGetFree, 1),
-					code.Make(code.OpAdd),
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpGetGlobal, 0),
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetFree, 1),
+					code.Make(code.OpAdd),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 2),
+					code.Make(code.OpSetLocalCell, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 4, 2),
+					code.Make(code.OpReturnValue),
+				},
+				[]code.Instructions{
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpSetLocalCell, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpClosure, 5, 1),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpClosure, 6, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestRecursiveFunctions(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `
+					let countDown = fn(x) { countDown(x - 1); };
+					countDown(1);
+					`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpCurrentClosure),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSub),
+					code.Make(code.OpTailCall, 1),
+					code.Make(code.OpReturnValue),
+				},
+				1,
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpCall, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestConstantFolding(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1 + 2 * 3 - -4",
+			expectedConstants: []interface{}{11},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "7 / 2; 1.5 * 2; 1 + 0.5",
+			expectedConstants: []interface{}{3, 3.0, 1.5},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `1 < 2; 2.5 >= 3; "a" < "b"; "a" == "a"; true != false; !true; !5; 1 == 1.0`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpFalse),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"mon" + "key"; let x = 2; x * (3 + 4)`,
+			expectedConstants: []interface{}{"monkey", 2, 7},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// left for the VM to throw at run time
+			input:             `1 / 0; true + false`,
+			expectedConstants: []interface{}{1, 0},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpDiv),
+				code.Make(code.OpPop),
+				code.Make(code.OpTrue),
+				code.Make(code.OpFalse),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn() { 2 * 3 }`,
+			expectedConstants: []interface{}{
+				6,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithConfig(t, tests, Config{})
+}
+
+func TestConstantInterning(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `1; "a"; 1.0; 1; "a"; 1.0; fn() { 1 }`,
+			expectedConstants: []interface{}{
+				1, "a", 1.0,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTestsWithConfig(t, tests, Config{})
+
+	// the constants of earlier compilations are shared too
+	constants := []object.Object{&object.String{Value: "a"}}
+	compiler := NewWithState(NewSymbolTable(), constants)
+	err := compiler.Compile(parse(`"b"; "a"`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err = testInstructions([]code.Instructions{
+		code.Make(code.OpConstant, 1),
+		code.Make(code.OpPop),
+		code.Make(code.OpConstant, 0),
+		code.Make(code.OpPop),
+	}, compiler.Bytecode().Instructions)
+	if err != nil {
+		t.Errorf("testInstructions failed: %s", err)
+	}
+}
+
+func TestPeephole(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "if (true) { 10 } else { 20 }; 3333",
+			expectedConstants: []interface{}{10, 20, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// the main program keeps OpNull; OpPop for its result
+			input:             "if (false) { 10 }; 3333",
+			expectedConstants: []interface{}{10, 3333},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "while (true) { if (false) { break; }; continue; }",
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpNull),
+				// 0001
+				code.Make(code.OpPop),
+				// 0002
+				code.Make(code.OpJump, 0),
+			},
+		},
+		{
+			// the jump to the dropped OpNull; OpPop goes to the instruction
+			// after them
+			input: "fn(x) { if (x) { return 1; 9 }; 2 }",
+			expectedConstants: []interface{}{
+				1, 9, 2,
+				[]code.Instructions{
+					// 0000
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpAdd),
+					// 0002
+					code.Make(code.OpJumpNotTruthy, 9),
+					// 0005
+					code.Make(code.OpConstant, 0),
+					// 0008
 					code.Make(code.OpReturnValue),
-				},
-				[]code.Instructions{
+					// 0009
 					code.Make(code.OpConstant, 2),
-					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 4, 2),
+					// 0012
 					code.Make(code.OpReturnValue),
 				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 3, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			// the jumps after a dropped pattern move with the code
+			input: "fn(x) { if (true) { x }; if (x) { 1 } else { 2 }; 3 }",
+			expectedConstants: []interface{}{
+				1, 2, 3,
 				[]code.Instructions{
-					code.Make(code.OpConstant, 1),
-					code.Make(code.OpSetLocal, 0),
+					// 0000
 					code.Make(code.OpGetLocal, 0),
-					code.Make(code.OpClosure, 5, 1),
+					// 0002
+					code.Make(code.OpPop),
+					// 0003
+					code.Make(code.OpGetLocal, 0),
+					// 0005
+					code.Make(code.OpJumpNotTruthy, 14),
+					// 0008
+					code.Make(code.OpConstant, 0),
+					// 0011
+					code.Make(code.OpJump, 17),
+					// 0014
+					code.Make(code.OpConstant, 1),
+					// 0017
+					code.Make(code.OpPop),
+					// 0018
+					code.Make(code.OpConstant, 2),
+					// 0021
 					code.Make(code.OpReturnValue),
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpConstant, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpClosure, 6, 0),
+				code.Make(code.OpClosure, 3, 0),
 				code.Make(code.OpPop),
 			},
 		},
-	}
-
-	runCompilerTests(t, tests)
-}
-
-func TestRecursiveFunctions(t *testing.T) {
-	tests := []compilerTestCase{
 		{
-			input: `
-					let countDown = fn(x) { countDown(x - 1); };
-					countDown(1);
-					`,
+			// the patterns that a jump lands in the middle of are kept
+			input: "fn(x) { if (x) { 1 }; x && true; 5 }",
 			expectedConstants: []interface{}{
-				1,
+				1, 5,
 				[]code.Instructions{
-					code.Make(code.OpCurrentClosure),
+					// 0000
 					code.Make(code.OpGetLocal, 0),
+					// 0002
+					code.Make(code.OpJumpNotTruthy, 11),
+					// 0005
 					code.Make(code.OpConstant, 0),
-					code.Make(code.OpSub),
-					code.Make(code.OpCall, 1),
+					// 0008
+					code.Make(code.OpJump, 12),
+					// 0011
+					code.Make(code.OpNull),
+					// 0012
+					code.Make(code.OpPop),
+					// 0013
+					code.Make(code.OpGetLocal, 0),
+					// 0015
+					code.Make(code.OpJumpNotTruthy, 22),
+					// 0018
+					code.Make(code.OpTrue),
+					// 0019
+					code.Make(code.OpJump, 23),
+					// 0022
+					code.Make(code.OpFalse),
+					// 0023
+					code.Make(code.OpPop),
+					// 0024
+					code.Make(code.OpConstant, 1),
+					// 0027
 					code.Make(code.OpReturnValue),
 				},
-				1,
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 1, 0),
-				code.Make(code.OpSetGlobal, 0),
-				code.Make(code.OpGetGlobal, 0),
-				code.Make(code.OpConstant, 2),
-				code.Make(code.OpCall, 1),
+				code.Make(code.OpClosure, 2, 0),
 				code.Make(code.OpPop),
 			},
 		},
 	}
-	runCompilerTests(t, tests)
+
+	runCompilerTestsWithConfig(t, tests, Config{})
+}
+
+func TestBytecodeEncoding(t *testing.T) {
+	comp := New()
+	err := comp.Compile(parse(`let f = fn(a, b) { let c = a * 2.5; c + -7 }; puts("monkey", f(1, 2))`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bc := comp.Bytecode()
+
+	data, err := bc.MarshalBinary()
+	if err != nil {
+		t.Fatalf("encoding failed: %s", err)
+	}
+	loaded := &Bytecode{}
+	err = loaded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("decoding failed: %s", err)
+	}
+	if !reflect.DeepEqual(bc, loaded) {
+		t.Errorf("wrong bytecode after a round trip.\nwant=%#v\ngot =%#v", bc, loaded)
+	}
+
+	// resum fixes the checksum of an edited encoding
+	resum := func(data []byte) []byte {
+		binary.LittleEndian.PutUint32(data[len(data)-4:], crc32.ChecksumIEEE(data[:len(data)-4]))
+		return data
+	}
+	edit := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte{}, data...))
+	}
+	encode := func(ins []code.Instructions, constants ...object.Object) []byte {
+		data, err := (&Bytecode{Instructions: concatInstructions(ins), Constants: constants}).MarshalBinary()
+		if err != nil {
+			t.Fatalf("encoding failed: %s", err)
+		}
+		return data
+	}
+	// the low byte of the operand of the OpConstant at 9, which loads "monkey"
+	constant := bytes.Index(data, bc.Instructions) + 11
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("let x = 1;"), "not a Monkey bytecode file"},
+		{edit(func(d []byte) []byte { d[10]++; return d }), "bytecode checksum mismatch"},
+		{edit(func(d []byte) []byte { d[4]++; return resum(d) }), "unsupported bytecode version 3, want 2"},
+		{edit(func(d []byte) []byte { return resum(append(d[:len(d)-10], 0, 0, 0, 0)) }), "truncated bytecode"},
+		{edit(func(d []byte) []byte { return resum(append(d[:len(d)-4], 9, 0, 0, 0, 0)) }), "1 bytes after the bytecode"},
+		{edit(func(d []byte) []byte { d[constant] = 9; return resum(d) }), "invalid bytecode in main program: OpConstant at 9: constant 9 out of range"},
+		{
+			encode([]code.Instructions{code.Make(code.OpClosure, 0, 0)}, &object.Integer{Value: 1}),
+			"invalid bytecode in main program: OpClosure at 0: constant 0 is not a function",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpGetBuiltin, 200)}),
+			"invalid bytecode in main program: OpGetBuiltin at 0: builtin 200 out of range",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 5)}),
+			"invalid bytecode in main program: OpJumpNotTruthy at 1: target 5 is not an instruction",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpTry, 2), code.Make(code.OpEndTry)}),
+			"invalid bytecode in main program: OpTry at 0: target 2 is not an instruction",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpNull), code.Make(code.OpWide)}),
+			"invalid bytecode in main program: OpWide at 1 has no instruction",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpWide), code.Make(code.OpPop)}),
+			"invalid bytecode in main program: at 0: opcode 11 has no wide form",
+		},
+		{
+			encode([]code.Instructions{code.MakeWide(code.OpConstant, 0)[:4]}, &object.Integer{Value: 1}),
+			"invalid bytecode in main program: at 0: OpWide OpConstant at 0 is cut short",
+		},
+		{
+			encode(nil, &object.CompiledFunction{Instructions: code.Make(code.OpJump, 4)}),
+			"invalid bytecode in constant 0: OpJump at 0: target 4 is not an instruction",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpPop)}),
+			"invalid bytecode in main program: OpPop at 0: pops 1 from a stack of 0",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpNull), code.Make(code.OpCall, 1)}),
+			"invalid bytecode in main program: OpCall at 1: pops 2 from a stack of 1",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 5), code.Make(code.OpNull), code.Make(code.OpPop)}),
+			"invalid bytecode in main program: OpPop at 5: pops 1 from a stack of 0",
+		},
+		{
+			encode(nil, &object.CompiledFunction{NumLocals: 1, Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpGetLocal, 200), code.Make(code.OpReturnValue)})}),
+			"invalid bytecode in constant 0: OpGetLocal at 0: local 200 out of range, there are 1",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpGetLocal, 0)}),
+			"invalid bytecode in main program: OpGetLocal at 0: local 0 out of range, there are 0",
+		},
+		{
+			encode(nil, &object.CompiledFunction{NumParameters: 2, NumLocals: 1, Instructions: code.Make(code.OpReturn)}),
+			"invalid bytecode in constant 0: 2 parameters but 1 locals",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpEndTry)}),
+			"invalid bytecode in main program: OpEndTry at 0: has no handler to remove",
+		},
+		{
+			encode(nil, &object.CompiledFunction{Instructions: concatInstructions([]code.Instructions{
+				code.Make(code.OpTry, 5), code.Make(code.OpReturn), code.Make(code.OpPop), code.Make(code.OpReturn)})}),
+			"invalid bytecode in constant 0: OpReturn at 3: returns with 1 handlers installed",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 8), code.Make(code.OpTry, 8),
+				code.Make(code.OpNull), code.Make(code.OpPop)}),
+			"invalid bytecode in main program: OpNull at 7: reaches 8 with 1 handlers, and with 0 on another path",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpGetFree, 0)}),
+			"invalid bytecode in main program: OpGetFree at 0: free variable 0 out of range, there are 0",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpNull), code.Make(code.OpClosure, 0, 1), code.Make(code.OpClosure, 0, 0)},
+				&object.CompiledFunction{Instructions: concatInstructions([]code.Instructions{code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)})}),
+			"invalid bytecode in main program: OpClosure at 5: constant 0 is captured with 1 free variables elsewhere",
+		},
+		{
+			encode([]code.Instructions{code.Make(code.OpClosure, 0, 0)},
+				&object.CompiledFunction{Instructions: concatInstructions([]code.Instructions{code.Make(code.OpGetFree, 0), code.Make(code.OpReturnValue)})}),
+			"invalid bytecode in constant 0: OpGetFree at 0: free variable 0 out of range, there are 0",
+		},
+		{
+			encode(nil, &object.CompiledFunction{Instructions: code.Make(code.OpNull)}),
+			"invalid bytecode in constant 0: the function does not end with a return",
+		},
+	}
+
+	for _, tt := range tests {
+		err := (&Bytecode{}).UnmarshalBinary(tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("wrong error. want=%q, got=%v", tt.expected, err)
+		}
+	}
+
+	_, err = (&Bytecode{Constants: []object.Object{&object.Boolean{Value: true}}}).MarshalBinary()
+	if err == nil || err.Error() != "cannot encode constant of type BOOLEAN" {
+		t.Errorf("wrong error for an unsupported constant. got=%v", err)
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	var locals []string
+	for i := 0; i < 300; i++ {
+		locals = append(locals, fmt.Sprintf("let %s = %d;", strings.Repeat("v", i+1), i))
+	}
+	input := fmt.Sprintf("fn() { %s %s }", strings.Join(locals, " "), strings.Repeat("v", 300))
+	for _, config := range []Config{{}, {DisableOptimizations: true}} {
+		compiler := NewWithConfig(config)
+		err := compiler.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		constants := compiler.Bytecode().Constants
+		fn, ok := constants[len(constants)-1].(*object.CompiledFunction)
+		if !ok {
+			t.Fatalf("last constant is not a function: %T", constants[len(constants)-1])
+		}
+		if fn.NumLocals != 300 {
+			t.Errorf("wrong number of locals. want=300, got=%d", fn.NumLocals)
+		}
+		for _, ins := range [][]byte{code.MakeWide(code.OpSetLocal, 299), code.MakeWide(code.OpGetLocal, 299)} {
+			if !strings.Contains(string(fn.Instructions), string(ins)) {
+				t.Errorf("instructions do not contain %s", code.Instructions(ins))
+			}
+		}
+	}
+
+	// the jumps over more than 64KB of code are wide, and land on
+	// instructions
+	input = fmt.Sprintf("let x = 0; while (x < 1) { %s }; if (x > 0) { %[1]s } else { 0 }",
+		strings.Repeat("x = x + 1; ", 6000))
+	for _, config := range []Config{{}, {DisableOptimizations: true}} {
+		compiler := NewWithConfig(config)
+		err := compiler.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		ins := compiler.Bytecode().Instructions
+		starts := map[int]bool{len(ins): true}
+		var targets []int
+		wide := 0
+		for i := 0; i < len(ins); {
+			def, operands, err := ins.Decode(i)
+			if err != nil {
+				t.Fatalf("decoding failed: %s", err)
+			}
+			starts[i] = true
+			switch ins.Opcode(i) {
+			case code.OpJump, code.OpJumpNotTruthy:
+				targets = append(targets, operands[0])
+				if def.Wide {
+					wide++
+				}
+			}
+			i += def.Width()
+		}
+		if len(ins) <= 2*65536 || wide == 0 {
+			t.Errorf("want more than 128KB of code with wide jumps, got %d bytes and %d wide jumps", len(ins), wide)
+		}
+		for _, target := range targets {
+			if !starts[target] {
+				t.Errorf("jump to %d, which is not an instruction", target)
+			}
+		}
+	}
+
+	args := strings.Repeat("0, ", 65536)
+	tests := []struct {
+		input string
+		op    string
+	}{
+		{"len(%s0)", "OpCall"},
+		{"fn() { len(%s0); 1 }", "OpCall"},
+		{"fn() { return len(%s0) }", "OpTailCall"},
+	}
+	for _, tt := range tests {
+		err := New().Compile(parse(fmt.Sprintf(tt.input, args)))
+		want := fmt.Sprintf("operand 65537 of OpWide %s does not fit in 2 bytes", tt.op)
+		if err == nil || err.Error() != want {
+			t.Errorf("wrong error for %q. want=%q, got=%v", tt.input, want, err)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	input := `let f = fn(x) {
+  if (x) { len("ab") } else { 2.5 }
+};
+f(true);`
+	comp := New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bc := comp.Bytecode()
+	// an undefined opcode must not stop the listing
+	bc.Instructions = append(bc.Instructions, 255)
+
+	expected := `constants:
+     0  STRING "ab"
+     1  FLOAT 2.5
+     2  FUNCTION f
+
+main:
+     1 | let f = fn(x) {
+        0000 OpClosure 2 0            ; FUNCTION f
+        0004 OpSetGlobal 0
+     4 | f(true);
+        0007 OpGetGlobal 0
+        0010 OpTrue
+        0011 OpCall 1
+        0013 OpPop
+        0014 ERROR: opcode 255 undefined
+
+function 2 f: 1 params, 1 locals, 0 free
+     2 |   if (x) { len("ab") } else { 2.5 }
+        0000 OpGetLocal 0
+        0002 OpJumpNotTruthy 15       ; -> 0015
+        0005 OpGetBuiltin 0           ; len
+        0007 OpConstant 0             ; STRING "ab"
+        0010 OpTailCall 1
+        0012 OpJump 18                ; -> 0018
+        0015 OpConstant 1             ; FLOAT 2.5
+        0018 OpReturnValue
+`
+	var out strings.Builder
+	err = bc.Disassemble(&out, input)
+	if err != nil {
+		t.Fatalf("disassembly failed: %s", err)
+	}
+	if out.String() != expected {
+		t.Errorf("wrong listing.\nwant=%s\ngot =%s", expected, out.String())
+	}
 }
 
 func parse(input string) *ast.Program {
@@ -789,13 +1824,20 @@ func parse(input string) *ast.Program {
 	return parser.ParseProgram()
 }
 
+// runCompilerTests compiles without optimizations, so that the tests see
+// the instructions of every expression.
 func runCompilerTests(t *testing.T, tests []compilerTestCase) {
 	t.Helper()
+	runCompilerTestsWithConfig(t, tests, Config{DisableOptimizations: true})
+}
+
+func runCompilerTestsWithConfig(t *testing.T, tests []compilerTestCase, config Config) {
+	t.Helper()
 
 	for _, tt := range tests {
 		program := parse(tt.input)
 
-		compiler := New()
+		compiler := NewWithConfig(config)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("compiler error: %s", err)
@@ -850,6 +1892,11 @@ func testConstants(
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
 			}
+		case float64:
+			err := testFloatObject(constant, actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed: %s", i, err)
+			}
 		case string:
 			err := testStringObject(constant, actual[i])
 			if err != nil {
@@ -870,6 +1917,88 @@ func testConstants(
 	return nil
 }
 
+func TestTailCalls(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input: `fn(f) { if (true) { f() } else { 1 + f() } }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpTrue),
+					code.Make(code.OpJumpNotTruthy, 11),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 0),
+					code.Make(code.OpJump, 19),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 0),
+					code.Make(code.OpAdd),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { return f(); }`,
+			expectedConstants: []interface{}{
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 0, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { if (f) { return f() }; 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpJumpNotTruthy, 13),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpTailCall, 0),
+					code.Make(code.OpReturnValue),
+					code.Make(code.OpJump, 14),
+					code.Make(code.OpNull),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input: `fn(f) { f(); 1 }`,
+			expectedConstants: []interface{}{
+				1,
+				[]code.Instructions{
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCall, 0),
+					code.Make(code.OpPop),
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpReturnValue),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 1, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestCompilerScopes(t *testing.T) {
 	compiler := New()
 	if compiler.scopeIndex != 0 {
@@ -954,6 +2083,19 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+
+	return nil
+}
+
 func testStringObject(expected string, actual object.Object) error {
 	result, ok := actual.(*object.String)
 	if !ok {
@@ -1040,3 +2182,59 @@ func TestLetStatementScopes(t *testing.T) {
 
 	runCompilerTests(t, tests)
 }
+
+func TestSourcePositions(t *testing.T) {
+	input := "let add = fn(a, b) {\n  a + b\n};\nadd(1,\n  2);"
+
+	program := parse(input)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.Bytecode()
+
+	mainPositions := []struct {
+		offset   int
+		expected string
+	}{
+		{0, "1:11"}, // OpClosure
+		{4, "1:1"},  // OpSetGlobal
+		{7, "4:1"},  // OpGetGlobal add
+		{10, "4:5"}, // OpConstant 1
+		{13, "5:3"}, // OpConstant 2
+		{16, "4:4"}, // OpCall
+		{18, "4:1"}, // OpPop
+	}
+	for _, tt := range mainPositions {
+		pos := bytecode.Positions.Lookup(tt.offset)
+		if pos.String() != tt.expected {
+			t.Errorf("main offset %d: wrong position. want=%s, got=%s",
+				tt.offset, tt.expected, pos)
+		}
+	}
+
+	fn, ok := bytecode.Constants[0].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 0 - not a function: %T", bytecode.Constants[0])
+	}
+	if fn.Name != "add" {
+		t.Errorf("function name wrong. want=%q, got=%q", "add", fn.Name)
+	}
+	fnPositions := []struct {
+		offset   int
+		expected string
+	}{
+		{0, "2:3"}, // OpGetLocal a
+		{2, "2:7"}, // OpGetLocal b
+		{4, "2:5"}, // OpAdd
+		{5, "2:3"}, // OpReturnValue
+	}
+	for _, tt := range fnPositions {
+		pos := fn.Positions.Lookup(tt.offset)
+		if pos.String() != tt.expected {
+			t.Errorf("function offset %d: wrong position. want=%s, got=%s",
+				tt.offset, tt.expected, pos)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"demeulder.us/monkey/code"
+	"demeulder.us/monkey/object"
+)
+
+// Disassemble writes a listing of the bytecode to w: the constant pool, the
+// main program and the body of every function in the pool. source is the
+// program the bytecode was compiled from. When it is not empty, the source
+// lines are shown above the instructions compiled from them.
+func (b *Bytecode) Disassemble(w io.Writer, source string) error {
+	d := &disassembler{w: w, bc: b, free: map[int]int{}}
+	if source != "" {
+		d.lines = strings.Split(source, "\n")
+	}
+	// the free variable counts are operands of the OpClosure instructions
+	// that create the closures
+	d.findClosures(b.Instructions)
+	for _, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			d.findClosures(fn.Instructions)
+		}
+	}
+
+	d.printf("constants:\n")
+	for i := range b.Constants {
+		d.printf("%6d  %s\n", i, d.constant(i))
+	}
+	d.printf("\nmain:\n")
+	d.instructions(b.Instructions, b.Positions)
+	for i, c := range b.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		d.printf("\nfunction %d %s: %d params, %d locals, %d free\n",
+			i, functionName(fn), fn.NumParameters, fn.NumLocals, d.free[i])
+		d.instructions(fn.Instructions, fn.Positions)
+	}
+	return d.err
+}
+
+type disassembler struct {
+	w     io.Writer
+	err   error // the first error writing to w
+	bc    *Bytecode
+	lines []string
+	free  map[int]int // the number of free variables by function constant
+}
+
+func (d *disassembler) printf(format string, a ...interface{}) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, a...)
+	}
+}
+
+func (d *disassembler) findClosures(ins code.Instructions) {
+	for i := 0; i < len(ins); {
+		def, operands, err := ins.Decode(i)
+		if err != nil {
+			i++
+			continue
+		}
+		if ins.Opcode(i) == code.OpClosure {
+			d.free[operands[0]] = operands[1]
+		}
+		i += def.Width()
+	}
+}
+
+// instructions lists ins, one instruction per line, with a comment that
+// resolves the constants, builtins and jump targets they refer to.
+func (d *disassembler) instructions(ins code.Instructions, positions code.PositionTable) {
+	starts := map[int]bool{}
+	for i := 0; i < len(ins); {
+		starts[i] = true
+		def, _, err := ins.Decode(i)
+		if err != nil {
+			i++
+			continue
+		}
+		i += def.Width()
+	}
+
+	line := 0
+	for i := 0; i < len(ins); {
+		if pos := positions.Lookup(i); pos.IsValid() && pos.Line != line {
+			line = pos.Line
+			d.printf("%6d |%s\n", line, d.sourceLine(line))
+		}
+		def, operands, err := ins.Decode(i)
+		if err != nil {
+			d.printf("        %04d ERROR: %s\n", i, err)
+			i++
+			continue
+		}
+
+		text := def.Name
+		for _, o := range operands {
+			text += " " + strconv.Itoa(o)
+		}
+		var comment string
+		switch ins.Opcode(i) {
+		case code.OpConstant, code.OpClosure:
+			comment = d.constant(operands[0])
+		case code.OpGetBuiltin:
+			if operands[0] < len(object.Builtins) {
+				comment = object.Builtins[operands[0]].Name
+			}
+		case code.OpJump, code.OpJumpNotTruthy, code.OpTry:
+			switch target := operands[0]; {
+			case target == len(ins):
+				comment = fmt.Sprintf("-> %04d (end)", target)
+			case !starts[target]:
+				comment = fmt.Sprintf("-> %04d (not an instruction)", target)
+			default:
+				comment = fmt.Sprintf("-> %04d", target)
+			}
+		}
+		if comment == "" {
+			d.printf("        %04d %s\n", i, text)
+		} else {
+			d.printf("        %04d %-24s ; %s\n", i, text, comment)
+		}
+		i += def.Width()
+	}
+}
+
+// constant describes the constant at index.
+func (d *disassembler) constant(index int) string {
+	if index >= len(d.bc.Constants) {
+		return "invalid constant"
+	}
+	switch c := d.bc.Constants[index].(type) {
+	case *object.String:
+		return "STRING " + strconv.Quote(c.Value)
+	case *object.CompiledFunction:
+		return "FUNCTION " + functionName(c)
+	default:
+		return fmt.Sprintf("%s %s", c.Type(), c.Inspect())
+	}
+}
+
+// sourceLine returns the source line with a space in front, or "" when
+// the line is blank or there is no source.
+func (d *disassembler) sourceLine(line int) string {
+	if line > len(d.lines) {
+		return ""
+	}
+	text := strings.TrimRight(d.lines[line-1], " \t\r")
+	if text == "" {
+		return ""
+	}
+	return " " + text
+}
+
+func functionName(fn *object.CompiledFunction) string {
+	if fn.Name == "" {
+		return "<anonymous>"
+	}
+	return fn.Name
+}
@@ -0,0 +1,261 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"demeulder.us/monkey/code"
+	"demeulder.us/monkey/object"
+	"demeulder.us/monkey/token"
+)
+
+// A .mbc file holds the Bytecode of a program:
+//
+//	magic     "MBC\x00"
+//	version   uint16
+//	body      instructions, positions, constants
+//	checksum  uint32, the CRC-32 (IEEE) of everything before it
+//
+// Fixed size integers are little endian, the integers of the body are
+// varints. Instructions and strings are their length followed by their
+// bytes, a position table is its length followed by the instruction offset,
+// source offset, line and column of each entry, and the constants are their
+// number followed by a tag byte and the value of each constant.
+//
+// BytecodeVersion changes whenever the format or the meaning of the
+// instructions changes, and files of other versions are rejected.
+const BytecodeVersion = 2
+
+var bytecodeMagic = []byte("MBC\x00")
+
+// The tags of the constants.
+const (
+	tagInteger  = 'i'
+	tagFloat    = 'f'
+	tagString   = 's'
+	tagFunction = 'F'
+)
+
+// MarshalBinary encodes the bytecode in the .mbc format.
+func (b *Bytecode) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	e.buf.Write(bytecodeMagic)
+	e.fixed(2, BytecodeVersion)
+	e.bytes(b.Instructions)
+	e.positions(b.Positions)
+	e.uint(len(b.Constants))
+	for _, c := range b.Constants {
+		switch c := c.(type) {
+		case *object.Integer:
+			e.buf.WriteByte(tagInteger)
+			e.int(c.Value)
+		case *object.Float:
+			e.buf.WriteByte(tagFloat)
+			e.fixed(8, math.Float64bits(c.Value))
+		case *object.String:
+			e.buf.WriteByte(tagString)
+			e.bytes([]byte(c.Value))
+		case *object.CompiledFunction:
+			e.buf.WriteByte(tagFunction)
+			e.bytes([]byte(c.Name))
+			e.uint(c.NumLocals)
+			e.uint(c.NumParameters)
+			e.bytes(c.Instructions)
+			e.positions(c.Positions)
+		default:
+			return nil, fmt.Errorf("cannot encode constant of type %s", c.Type())
+		}
+	}
+	e.fixed(4, uint64(crc32.ChecksumIEEE(e.buf.Bytes())))
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes bytecode in the .mbc format, as written by
+// MarshalBinary, into b. It rejects the instructions that verify finds
+// wrong.
+func (b *Bytecode) UnmarshalBinary(data []byte) error {
+	if len(data) < len(bytecodeMagic)+2+4 || !bytes.HasPrefix(data, bytecodeMagic) {
+		return fmt.Errorf("not a Monkey bytecode file")
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return fmt.Errorf("bytecode checksum mismatch")
+	}
+	body = body[len(bytecodeMagic):]
+	version := binary.LittleEndian.Uint16(body)
+	if version != BytecodeVersion {
+		return fmt.Errorf("unsupported bytecode version %d, want %d", version, BytecodeVersion)
+	}
+
+	d := &decoder{data: body[2:]}
+	instructions := code.Instructions(d.bytes())
+	positions := d.positions()
+	constants := make([]object.Object, d.count())
+	for i := range constants {
+		switch tag := d.byte(); tag {
+		case tagInteger:
+			constants[i] = &object.Integer{Value: d.int()}
+		case tagFloat:
+			constants[i] = &object.Float{Value: d.float()}
+		case tagString:
+			constants[i] = &object.String{Value: string(d.bytes())}
+		case tagFunction:
+			constants[i] = &object.CompiledFunction{
+				Name:          string(d.bytes()),
+				NumLocals:     d.uint(),
+				NumParameters: d.uint(),
+				Instructions:  d.bytes(),
+				Positions:     d.positions(),
+			}
+		default:
+			d.fail(fmt.Errorf("unknown constant tag %q", tag))
+		}
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.fail(fmt.Errorf("%d bytes after the bytecode", len(d.data)))
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if err := verify(instructions, constants); err != nil {
+		return err
+	}
+
+	b.Instructions = instructions
+	b.Positions = positions
+	b.Constants = constants
+	return nil
+}
+
+type encoder struct {
+	buf     bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) fixed(size int, v uint64) {
+	switch size {
+	case 2:
+		binary.LittleEndian.PutUint16(e.scratch[:], uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(e.scratch[:], uint32(v))
+	case 8:
+		binary.LittleEndian.PutUint64(e.scratch[:], v)
+	}
+	e.buf.Write(e.scratch[:size])
+}
+
+func (e *encoder) uint(v int) {
+	e.buf.Write(e.scratch[:binary.PutUvarint(e.scratch[:], uint64(v))])
+}
+
+func (e *encoder) int(v int64) {
+	e.buf.Write(e.scratch[:binary.PutVarint(e.scratch[:], v)])
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint(len(b))
+	e.buf.Write(b)
+}
+
+func (e *encoder) positions(pt code.PositionTable) {
+	e.uint(len(pt))
+	for _, p := range pt {
+		e.uint(p.Offset)
+		e.uint(p.Pos.Offset)
+		e.uint(p.Pos.Line)
+		e.uint(p.Pos.Column)
+	}
+}
+
+// decoder reads the body of a .mbc file. After the first error it only
+// returns zero values, and err holds the error.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail(fmt.Errorf("truncated bytecode"))
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) float() float64 {
+	if len(d.data) < 8 {
+		d.fail(fmt.Errorf("truncated bytecode"))
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.data)
+	d.data = d.data[8:]
+	return math.Float64frombits(v)
+}
+
+func (d *decoder) uint() int {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(fmt.Errorf("truncated bytecode"))
+		return 0
+	}
+	if v > math.MaxInt32 {
+		d.fail(fmt.Errorf("invalid bytecode: %d is out of range", v))
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *decoder) int() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(fmt.Errorf("truncated bytecode"))
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// count reads the number of entries that follow. Every entry takes at least
+// one byte, which bounds what a corrupt count can allocate.
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > len(d.data) {
+		d.fail(fmt.Errorf("truncated bytecode"))
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	b := make([]byte, n)
+	copy(b, d.data)
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) positions() code.PositionTable {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+	pt := make(code.PositionTable, n)
+	for i := range pt {
+		pt[i].Offset = d.uint()
+		pt[i].Pos = token.Position{Offset: d.uint(), Line: d.uint(), Column: d.uint()}
+	}
+	return pt
+}
@@ -0,0 +1,296 @@
+package compiler
+
+import (
+	"math"
+
+	"demeulder.us/monkey/ast"
+	"demeulder.us/monkey/object"
+)
+
+// foldConstants returns the value of every prefix and infix expression of
+// the program whose operands are constants, computed the way the VM would
+// compute it. Expressions that fail in the VM, like an integer division by
+// zero or an unsupported operator, are not folded, so that they still throw
+// their catchable error at run time. Float divisions by zero are not folded
+// either, to keep infinities and NaN out of the constants.
+func foldConstants(program *ast.Program) map[ast.Expression]object.Object {
+	f := &folder{values: map[ast.Expression]object.Object{}}
+	for _, s := range program.Statements {
+		f.walk(s)
+	}
+	return f.values
+}
+
+type folder struct {
+	values map[ast.Expression]object.Object
+}
+
+// walk folds the expressions in node and returns the value of node, or nil
+// when it is not a constant.
+func (f *folder) walk(node ast.Node) object.Object {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
+	case *ast.StringLiteral:
+		return &object.String{Value: node.Value}
+	case *ast.Boolean:
+		return nativeBoolean(node.Value)
+	case *ast.PrefixExpression:
+		right := f.walk(node.Right)
+		if right == nil {
+			return nil
+		}
+		return f.record(node, foldPrefix(node.Operator, right))
+	case *ast.InfixExpression:
+		left := f.walk(node.Left)
+		right := f.walk(node.Right)
+		if left == nil || right == nil || node.Operator == "&&" || node.Operator == "||" {
+			return nil
+		}
+		return f.record(node, foldInfix(node.Operator, left, right))
+
+	case *ast.LetStatement:
+		f.walk(node.Value)
+	case *ast.ReturnStatement:
+		f.walk(node.ReturnValue)
+	case *ast.ThrowStatement:
+		f.walk(node.Value)
+	case *ast.ExpressionStatement:
+		f.walk(node.Expression)
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			f.walk(s)
+		}
+	case *ast.IfExpression:
+		f.walk(node.Condition)
+		f.walk(node.Consequence)
+		if node.Alternative != nil {
+			f.walk(node.Alternative)
+		}
+	case *ast.FunctionLiteral:
+		f.walk(node.Body)
+	case *ast.CallExpression:
+		f.walk(node.Function)
+		for _, a := range node.Arguments {
+			f.walk(a)
+		}
+	case *ast.ArrayLiteral:
+		for _, item := range node.Items {
+			f.walk(item)
+		}
+	case *ast.IndexExpression:
+		f.walk(node.Left)
+		f.walk(node.Index)
+	case *ast.HashLiteral:
+		for _, k := range node.Keys {
+			f.walk(k)
+			f.walk(node.Pairs[k])
+		}
+	case *ast.AssignExpression:
+		f.walk(node.Value)
+	case *ast.IncrementExpression:
+		f.walk(node.Value)
+	case *ast.SliceExpression:
+		f.walk(node.Left)
+		if node.Start != nil {
+			f.walk(node.Start)
+		}
+		if node.End != nil {
+			f.walk(node.End)
+		}
+	case *ast.IndexAssignExpression:
+		f.walk(node.Target)
+		f.walk(node.Value)
+	case *ast.ForLoop:
+		if node.Initialization != nil {
+			f.walk(node.Initialization)
+		}
+		if node.Test != nil {
+			f.walk(node.Test)
+		}
+		f.walk(node.Block)
+		if node.Update != nil {
+			f.walk(node.Update)
+		}
+	case *ast.WhileLoop:
+		f.walk(node.Condition)
+		f.walk(node.Block)
+	case *ast.TryExpression:
+		f.walk(node.Block)
+		if node.Catch != nil {
+			f.walk(node.Catch)
+		}
+		if node.Finally != nil {
+			f.walk(node.Finally)
+		}
+	}
+	return nil
+}
+
+func (f *folder) record(node ast.Expression, value object.Object) object.Object {
+	if value != nil {
+		f.values[node] = value
+	}
+	return value
+}
+
+// foldPrefix mirrors OpMinus and OpBang.
+func foldPrefix(operator string, right object.Object) object.Object {
+	switch operator {
+	case "-":
+		switch right := right.(type) {
+		case *object.Integer:
+			return &object.Integer{Value: (-1) * right.Value}
+		case *object.Float:
+			return &object.Float{Value: (-1) * right.Value}
+		}
+	case "!":
+		if b, ok := right.(*object.Boolean); ok {
+			return nativeBoolean(!b.Value)
+		}
+		return nativeBoolean(false)
+	}
+	return nil
+}
+
+// foldInfix mirrors the arithmetic and comparison instructions of the VM.
+func foldInfix(operator string, left, right object.Object) object.Object {
+	l, lInt := left.(*object.Integer)
+	r, rInt := right.(*object.Integer)
+	if lInt && rInt {
+		a, b := l.Value, r.Value
+		switch operator {
+		case "+":
+			return &object.Integer{Value: a + b}
+		case "-":
+			return &object.Integer{Value: a - b}
+		case "*":
+			return &object.Integer{Value: a * b}
+		case "/":
+			if b == 0 {
+				return nil
+			}
+			return &object.Integer{Value: a / b}
+		}
+		return compare(operator, compareInt64(a, b))
+	}
+
+	if a, ok := toFloat(left); ok {
+		if b, ok := toFloat(right); ok {
+			switch operator {
+			case "+":
+				return &object.Float{Value: a + b}
+			case "-":
+				return &object.Float{Value: a - b}
+			case "*":
+				return &object.Float{Value: a * b}
+			case "/":
+				if b == 0 {
+					return nil
+				}
+				return &object.Float{Value: a / b}
+			}
+			return compareFloats(operator, a, b)
+		}
+	}
+
+	switch operator {
+	case "+":
+		l, lString := left.(*object.String)
+		r, rString := right.(*object.String)
+		if lString && rString {
+			return &object.String{Value: l.Value + r.Value}
+		}
+	case "==":
+		return nativeBoolean(object.Equal(left, right))
+	case "!=":
+		return nativeBoolean(!object.Equal(left, right))
+	case "<", ">", "<=", ">=":
+		if c, ok := object.Compare(left, right); ok {
+			return compare(operator, c)
+		}
+	}
+	return nil
+}
+
+// compare applies a comparison operator to c, the result of comparing two
+// values that are ordered, -1, 0 or 1.
+func compare(operator string, c int) object.Object {
+	switch operator {
+	case "==":
+		return nativeBoolean(c == 0)
+	case "!=":
+		return nativeBoolean(c != 0)
+	case "<":
+		return nativeBoolean(c < 0)
+	case ">":
+		return nativeBoolean(c > 0)
+	case "<=":
+		return nativeBoolean(c <= 0)
+	case ">=":
+		return nativeBoolean(c >= 0)
+	}
+	return nil
+}
+
+// compareFloats applies a comparison operator to a and b, which need not be
+// ordered when one is NaN.
+func compareFloats(operator string, a, b float64) object.Object {
+	switch operator {
+	case "==":
+		return nativeBoolean(a == b)
+	case "!=":
+		return nativeBoolean(a != b)
+	case "<":
+		return nativeBoolean(a < b)
+	case ">":
+		return nativeBoolean(a > b)
+	case "<=":
+		return nativeBoolean(a <= b)
+	case ">=":
+		return nativeBoolean(a >= b)
+	}
+	return nil
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func toFloat(obj object.Object) (float64, bool) {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value), true
+	case *object.Float:
+		return obj.Value, true
+	}
+	return 0, false
+}
+
+func nativeBoolean(value bool) *object.Boolean {
+	return &object.Boolean{Value: value}
+}
+
+// constantKey returns the key under which addConstant interns obj, or nil
+// for constants that are never shared. The keys of different types differ
+// in their dynamic types.
+func constantKey(obj object.Object) interface{} {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return obj.Value
+	case *object.Float:
+		return math.Float64bits(obj.Value)
+	case *object.String:
+		return obj.Value
+	}
+	return nil
+}
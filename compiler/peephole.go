@@ -0,0 +1,249 @@
+package compiler
+
+import (
+	"demeulder.us/monkey/code"
+	"demeulder.us/monkey/token"
+)
+
+// peephole is one instruction of the code that optimize rewrites. The
+// target of a jump is the index of an instruction, or the number of
+// instructions for the end of the code.
+type peephole struct {
+	op       code.Opcode
+	operands []int
+	width    int
+	wide     bool
+	pos      token.Position
+	dead     bool
+	targeted int // the number of jumps to this instruction
+}
+
+// The widths of the jump instructions, which all have the same operands.
+var (
+	jumpWidth     = len(code.Make(code.OpJump, 0))
+	wideJumpWidth = len(code.MakeWide(code.OpJump, 0))
+)
+
+// isJump reports whether the first operand of op is an instruction offset.
+func isJump(op code.Opcode) bool {
+	return op == code.OpJump || op == code.OpJumpNotTruthy || op == code.OpTry
+}
+
+type optimizer struct {
+	ins      []*peephole
+	function bool
+}
+
+// newOptimizer decodes ins, whose jumps at the offsets in far go to the
+// targets there instead of their operand, see Compiler.changeOperand. It
+// reports false when ins does not decode.
+func newOptimizer(ins code.Instructions, positions code.PositionTable, far map[int]int, function bool) (*optimizer, bool) {
+	index := map[int]int{}
+	var list []*peephole
+	for offset := 0; offset < len(ins); {
+		def, operands, err := ins.Decode(offset)
+		if err != nil {
+			return nil, false
+		}
+		if target, ok := far[offset]; ok {
+			operands[0] = target
+		}
+		index[offset] = len(list)
+		list = append(list, &peephole{
+			op:       ins.Opcode(offset),
+			operands: operands,
+			width:    def.Width(),
+			wide:     def.Wide,
+			pos:      positions.Lookup(offset),
+		})
+		offset += def.Width()
+	}
+	index[len(ins)] = len(list)
+	for _, p := range list {
+		if isJump(p.op) {
+			target, ok := index[p.operands[0]]
+			if !ok {
+				return nil, false
+			}
+			p.operands[0] = target
+		}
+	}
+	return &optimizer{ins: list, function: function}, true
+}
+
+// optimize rewrites the instructions of the main program or of a function
+// body:
+//
+//   - it drops the instructions that no path reaches, such as the code
+//     after an OpReturnValue
+//   - it drops an OpJump to the next instruction
+//   - it drops OpTrue; OpJumpNotTruthy, which never jumps, and turns
+//     OpFalse; OpJumpNotTruthy into OpJump
+//   - in a function body, it drops OpNull; OpPop. The main program keeps
+//     them, since the last popped value is its result.
+//
+// Jumps to a dropped instruction go to the instruction after it. The
+// patterns are only rewritten when no jump lands in their middle.
+func (o *optimizer) optimize() {
+	for o.dropUnreachable() || o.rewrite() {
+	}
+}
+
+// live returns the index of the first instruction at or after i that is
+// not dropped, or the number of instructions.
+func (o *optimizer) live(i int) int {
+	for i < len(o.ins) && o.ins[i].dead {
+		i++
+	}
+	return i
+}
+
+// dropUnreachable drops the instructions that no path from the first one
+// reaches, and reports whether it dropped any.
+func (o *optimizer) dropUnreachable() bool {
+	reached := make([]bool, len(o.ins)+1)
+	work := []int{o.live(0)}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if reached[i] {
+			continue
+		}
+		reached[i] = true
+		if i == len(o.ins) {
+			continue
+		}
+		p := o.ins[i]
+		if isJump(p.op) {
+			work = append(work, o.live(p.operands[0]))
+		}
+		switch p.op {
+		case code.OpJump, code.OpReturnValue, code.OpReturn, code.OpThrow:
+		default:
+			work = append(work, o.live(i+1))
+		}
+	}
+
+	dropped := false
+	for i, p := range o.ins {
+		if !p.dead && !reached[i] {
+			p.dead = true
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// rewrite rewrites the patterns of optimize in one pass over the code, and
+// reports whether it rewrote any.
+func (o *optimizer) rewrite() bool {
+	for _, p := range o.ins {
+		p.targeted = 0
+	}
+	for _, p := range o.ins {
+		if !p.dead && isJump(p.op) {
+			if t := o.live(p.operands[0]); t < len(o.ins) {
+				o.ins[t].targeted++
+			}
+		}
+	}
+
+	rewritten := false
+	for i := o.live(0); i < len(o.ins); i = o.live(i + 1) {
+		p := o.ins[i]
+		next := o.live(i + 1)
+		switch {
+		case p.op == code.OpJump && o.live(p.operands[0]) == next:
+			o.drop(i)
+		case next == len(o.ins) || o.ins[next].targeted > 0:
+			continue
+		case p.op == code.OpTrue && o.ins[next].op == code.OpJumpNotTruthy:
+			o.drop(i)
+			o.drop(next)
+		case p.op == code.OpFalse && o.ins[next].op == code.OpJumpNotTruthy:
+			o.drop(i)
+			o.ins[next].op = code.OpJump
+		case o.function && p.op == code.OpNull && o.ins[next].op == code.OpPop:
+			o.drop(i)
+			o.drop(next)
+		default:
+			continue
+		}
+		rewritten = true
+	}
+	return rewritten
+}
+
+// drop drops the instruction at i, and moves the jumps to it on to the
+// next instruction.
+func (o *optimizer) drop(i int) {
+	o.ins[i].dead = true
+	if next := o.live(i); next < len(o.ins) {
+		o.ins[next].targeted += o.ins[i].targeted
+	}
+}
+
+// encode lays out the instructions that are left. The jumps start out
+// narrow, and take the wide form when their target does not fit, which
+// moves the code after them: the layout is repeated until no jump grows.
+// It fails when a target does not fit in the wide form either.
+func (o *optimizer) encode() (code.Instructions, code.PositionTable, error) {
+	for _, p := range o.ins {
+		if isJump(p.op) {
+			p.wide = false
+			p.width = jumpWidth
+		}
+	}
+	offsets := make([]int, len(o.ins)+1)
+	for grown := true; grown; {
+		offset := 0
+		for i, p := range o.ins {
+			offsets[i] = offset
+			if !p.dead {
+				offset += p.width
+			}
+		}
+		offsets[len(o.ins)] = offset
+
+		grown = false
+		for _, p := range o.ins {
+			if !p.dead && isJump(p.op) && !p.wide && !code.Fits(p.op, o.operands(p, offsets)...) {
+				p.wide = true
+				p.width = wideJumpWidth
+				grown = true
+			}
+		}
+	}
+
+	ins := code.Instructions{}
+	var positions code.PositionTable
+	for i, p := range o.ins {
+		if p.dead {
+			continue
+		}
+		if p.pos.IsValid() && (len(positions) == 0 || positions[len(positions)-1].Pos != p.pos) {
+			positions = append(positions, code.SourcePosition{Offset: offsets[i], Pos: p.pos})
+		}
+		var instruction []byte
+		var err error
+		if p.wide {
+			instruction, err = code.EncodeWide(p.op, o.operands(p, offsets)...)
+		} else {
+			instruction, err = code.Encode(p.op, o.operands(p, offsets)...)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ins = append(ins, instruction...)
+	}
+	return ins, positions, nil
+}
+
+// operands returns the operands of p, with the offset of its target for a
+// jump.
+func (o *optimizer) operands(p *peephole, offsets []int) []int {
+	if !isJump(p.op) {
+		return p.operands
+	}
+	return append([]int{offsets[o.live(p.operands[0])]}, p.operands[1:]...)
+}
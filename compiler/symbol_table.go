@@ -8,6 +8,9 @@ const (
 	BuiltinScope  SymbolScope = "BUILTIN"
 	FreeScope     SymbolScope = "FREE"
 	FunctionScope SymbolScope = "FUNCTION"
+	// CellScope is a local captured by a closure; its slot holds an
+	// object.Cell.
+	CellScope SymbolScope = "CELL"
 )
 
 type Symbol struct {
@@ -19,6 +22,7 @@ type Symbol struct {
 type SymbolTable struct {
 	store          map[string]Symbol
 	numDefinitions int
+	block          bool
 
 	Outer       *SymbolTable
 	FreeSymbols []Symbol
@@ -36,6 +40,25 @@ func NewEnclosedSymbolTable(enclosing *SymbolTable) *SymbolTable {
 	return st
 }
 
+// NewBlockSymbolTable returns a table for a block inside enclosing, such as
+// the body of a loop. Names defined in it are only visible inside the block,
+// but they are stored in the slots of the enclosing function (or the
+// globals), so no new frame is needed to run the block.
+func NewBlockSymbolTable(enclosing *SymbolTable) *SymbolTable {
+	st := NewEnclosedSymbolTable(enclosing)
+	st.block = true
+	return st
+}
+
+// owner returns the table that allocates slots for s: s itself, or for a
+// block table the nearest enclosing function or global table.
+func (s *SymbolTable) owner() *SymbolTable {
+	for s.block {
+		s = s.Outer
+	}
+	return s
+}
+
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
 	s.FreeSymbols = append(s.FreeSymbols, original)
 	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1}
@@ -44,18 +67,46 @@ func (s *SymbolTable) defineFree(original Symbol) Symbol {
 	return symbol
 }
 
+// Define binds name in s. Redefining a name that already has a slot in s
+// reuses that slot, so that `let x = x + 1` reads the old value.
 func (s *SymbolTable) Define(name string) Symbol {
+	if existing, ok := s.store[name]; ok &&
+		(existing.Scope == GlobalScope || existing.Scope == LocalScope || existing.Scope == CellScope) {
+		return existing
+	}
+	owner := s.owner()
 	symbol := Symbol{
 		Name:  name,
-		Index: s.numDefinitions,
+		Index: owner.numDefinitions,
 	}
-	if s.Outer == nil {
+	if owner.Outer == nil {
 		symbol.Scope = GlobalScope
 	} else {
 		symbol.Scope = LocalScope
 	}
 	s.store[name] = symbol
-	s.numDefinitions += 1
+	owner.numDefinitions += 1
+	return symbol
+}
+
+// DefineCell defines a local that is captured by a closure.
+func (s *SymbolTable) DefineCell(name string) Symbol {
+	symbol := s.Define(name)
+	if symbol.Scope == LocalScope {
+		symbol.Scope = CellScope
+		s.store[name] = symbol
+	}
+	return symbol
+}
+
+// original follows a free symbol back to the symbol it captures in an
+// enclosing function.
+func (s *SymbolTable) original(symbol Symbol) Symbol {
+	for symbol.Scope == FreeScope {
+		fn := s.owner()
+		symbol = fn.FreeSymbols[symbol.Index]
+		s = fn.Outer
+	}
 	return symbol
 }
 
@@ -63,7 +114,7 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
 	if !ok && s.Outer != nil {
 		obj, ok = s.Outer.Resolve(name)
-		if !ok {
+		if !ok || s.block {
 			return obj, ok
 		}
 		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
@@ -333,3 +333,84 @@ func TestShadowingFunctionName(t *testing.T) {
 			expected.Name, expected, result)
 	}
 }
+
+func TestBlockScopes(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+
+	block := NewBlockSymbolTable(global)
+	i := block.Define("i")
+	if i != (Symbol{Name: "i", Scope: GlobalScope, Index: 1}) {
+		t.Errorf("block symbol in global scope wrong. got=%+v", i)
+	}
+
+	local := NewEnclosedSymbolTable(block)
+	local.Define("b")
+	inner := NewBlockSymbolTable(local)
+	j := inner.Define("j")
+	if j != (Symbol{Name: "j", Scope: LocalScope, Index: 1}) {
+		t.Errorf("block symbol in local scope wrong. got=%+v", j)
+	}
+	if local.numDefinitions != 2 {
+		t.Errorf("block symbol did not take a slot of its function. got=%d", local.numDefinitions)
+	}
+
+	if _, ok := global.Resolve("i"); ok {
+		t.Errorf("block symbol i visible outside its block")
+	}
+	if _, ok := local.Resolve("j"); ok {
+		t.Errorf("block symbol j visible outside its block")
+	}
+
+	resolved, ok := inner.Resolve("i")
+	if !ok || resolved != i {
+		t.Errorf("expected %+v from enclosing block, got=%+v", i, resolved)
+	}
+	resolved, ok = inner.Resolve("b")
+	if !ok || resolved.Scope != LocalScope || len(inner.FreeSymbols) != 0 {
+		t.Errorf("local of the same function resolved as %+v through a block", resolved)
+	}
+}
+
+func TestRedefineReusesSlot(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineBuiltin(0, "len")
+	a := global.Define("a")
+	if again := global.Define("a"); again != a {
+		t.Errorf("redefined symbol wrong. want=%+v, got=%+v", a, again)
+	}
+	if global.numDefinitions != 1 {
+		t.Errorf("redefinition took a new slot. got=%d", global.numDefinitions)
+	}
+
+	shadow := global.Define("len")
+	if shadow != (Symbol{Name: "len", Scope: GlobalScope, Index: 1}) {
+		t.Errorf("builtin shadowed wrong. got=%+v", shadow)
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	b := local.Define("a")
+	if b != (Symbol{Name: "a", Scope: LocalScope, Index: 0}) {
+		t.Errorf("global shadowed wrong. got=%+v", b)
+	}
+}
+
+func TestDefineCell(t *testing.T) {
+	global := NewSymbolTable()
+	outer := NewEnclosedSymbolTable(global)
+	outer.Define("a")
+	b := outer.DefineCell("b")
+	if b != (Symbol{Name: "b", Scope: CellScope, Index: 1}) {
+		t.Errorf("cell symbol wrong. got=%+v", b)
+	}
+
+	middle := NewEnclosedSymbolTable(outer)
+	inner := NewEnclosedSymbolTable(NewBlockSymbolTable(middle))
+	free, ok := inner.Resolve("b")
+	if !ok || free.Scope != FreeScope {
+		t.Fatalf("expected b to resolve as free, got=%+v", free)
+	}
+	if original := inner.original(free); original != b {
+		t.Errorf("original wrong. want=%+v, got=%+v", b, original)
+	}
+}
@@ -0,0 +1,102 @@
+package compiler
+
+import "demeulder.us/monkey/ast"
+
+// findTailCalls adds to calls the calls in tail position in node, the body
+// of a function: the calls whose result the function returns right away.
+// Those are the last expression of the body, the value of any return
+// statement, and the calls in tail position in the branches of an if
+// expression that ends either. Calls inside loops and try expressions are
+// never in tail position. The evaluator follows the same rules, see
+// evalTail.
+//
+// A tail call compiles to OpTailCall, which reuses the frame of the caller
+// when it calls a closure.
+func findTailCalls(node ast.Node, calls map[*ast.CallExpression]bool) {
+	markTailCalls(node, calls)
+	findReturns(node, calls)
+}
+
+// markTailCalls adds the calls in tail position when node ends the body.
+func markTailCalls(node ast.Node, calls map[*ast.CallExpression]bool) {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		if len(node.Statements) > 0 {
+			markTailCalls(node.Statements[len(node.Statements)-1], calls)
+		}
+	case *ast.ExpressionStatement:
+		markTailCalls(node.Expression, calls)
+	case *ast.ReturnStatement:
+		markTailCalls(node.ReturnValue, calls)
+	case *ast.IfExpression:
+		markTailCalls(node.Consequence, calls)
+		if node.Alternative != nil {
+			markTailCalls(node.Alternative, calls)
+		}
+	case *ast.CallExpression:
+		calls[node] = true
+	}
+}
+
+// findReturns marks the tail calls of the return statements in node,
+// outside of loops, try expressions and nested functions.
+func findReturns(node ast.Node, calls map[*ast.CallExpression]bool) {
+	switch node := node.(type) {
+	case *ast.ReturnStatement:
+		markTailCalls(node.ReturnValue, calls)
+		findReturns(node.ReturnValue, calls)
+	case *ast.LetStatement:
+		findReturns(node.Value, calls)
+	case *ast.ThrowStatement:
+		findReturns(node.Value, calls)
+	case *ast.ExpressionStatement:
+		findReturns(node.Expression, calls)
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			findReturns(s, calls)
+		}
+	case *ast.PrefixExpression:
+		findReturns(node.Right, calls)
+	case *ast.InfixExpression:
+		findReturns(node.Left, calls)
+		findReturns(node.Right, calls)
+	case *ast.IfExpression:
+		findReturns(node.Condition, calls)
+		findReturns(node.Consequence, calls)
+		if node.Alternative != nil {
+			findReturns(node.Alternative, calls)
+		}
+	case *ast.CallExpression:
+		findReturns(node.Function, calls)
+		for _, a := range node.Arguments {
+			findReturns(a, calls)
+		}
+	case *ast.ArrayLiteral:
+		for _, item := range node.Items {
+			findReturns(item, calls)
+		}
+	case *ast.IndexExpression:
+		findReturns(node.Left, calls)
+		findReturns(node.Index, calls)
+	case *ast.HashLiteral:
+		for _, k := range node.Keys {
+			findReturns(k, calls)
+			findReturns(node.Pairs[k], calls)
+		}
+	case *ast.AssignExpression:
+		findReturns(node.Value, calls)
+	case *ast.IncrementExpression:
+		findReturns(node.Value, calls)
+	case *ast.SliceExpression:
+		findReturns(node.Left, calls)
+		if node.Start != nil {
+			findReturns(node.Start, calls)
+		}
+		if node.End != nil {
+			findReturns(node.End, calls)
+		}
+	case *ast.IndexAssignExpression:
+		findReturns(node.Target, calls)
+		findReturns(node.Value, calls)
+	}
+}
@@ -0,0 +1,263 @@
+package compiler
+
+import (
+	"fmt"
+
+	"demeulder.us/monkey/code"
+	"demeulder.us/monkey/object"
+)
+
+// verify checks the instructions of the main program and of every function
+// of loaded bytecode, which the VM runs without checking what it reads:
+//
+//   - every instruction decodes, and no OpWide is left without one
+//   - the constants, functions, builtins, locals and free variables that
+//     the operands refer to exist
+//   - the jumps and try handlers land on an instruction, or at the end of
+//     the main program
+//   - along every path, no instruction takes more values than the stack of
+//     its frame holds, OpTry and OpEndTry pair up, and functions end with a
+//     return
+//
+// The VM still checks the values themselves, like the types of operands
+// and the number of arguments of a call.
+func verify(main code.Instructions, constants []object.Object) error {
+	streams := []*stream{{name: "main program", ins: main, constant: -1}}
+	for i, c := range constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		name := fmt.Sprintf("constant %d", i)
+		if fn.NumParameters > fn.NumLocals {
+			return fmt.Errorf("invalid bytecode in %s: %d parameters but %d locals", name, fn.NumParameters, fn.NumLocals)
+		}
+		streams = append(streams, &stream{name: name, ins: fn.Instructions, constant: i, numLocals: fn.NumLocals})
+	}
+	for _, s := range streams {
+		if err := s.decode(); err != nil {
+			return fmt.Errorf("invalid bytecode in %s: %s", s.name, err)
+		}
+	}
+
+	// a function has the free variables that its closures capture
+	free := map[int]int{}
+	for _, s := range streams {
+		for _, in := range s.decoded {
+			if in.op != code.OpClosure {
+				continue
+			}
+			if n, ok := free[in.operands[0]]; ok && n != in.operands[1] {
+				return fmt.Errorf("invalid bytecode in %s: %s at %d: constant %d is captured with %d free variables elsewhere",
+					s.name, in.def.Name, in.offset, in.operands[0], n)
+			}
+			free[in.operands[0]] = in.operands[1]
+		}
+	}
+	for _, s := range streams {
+		s.numFree = free[s.constant]
+		if err := s.checkOperands(constants); err != nil {
+			return fmt.Errorf("invalid bytecode in %s: %s", s.name, err)
+		}
+		if err := s.checkPaths(); err != nil {
+			return fmt.Errorf("invalid bytecode in %s: %s", s.name, err)
+		}
+	}
+	return nil
+}
+
+// stream is the code of the main program or of a function being verified.
+type stream struct {
+	name      string
+	ins       code.Instructions
+	constant  int // the index of the function, -1 for the main program
+	numLocals int
+	numFree   int
+
+	decoded []instruction
+	at      map[int]int // the index in decoded of the instruction at an offset
+}
+
+type instruction struct {
+	offset   int
+	op       code.Opcode
+	def      *code.Definition
+	operands []int
+}
+
+func (s *stream) decode() error {
+	s.at = map[int]int{}
+	for offset := 0; offset < len(s.ins); {
+		if code.Opcode(s.ins[offset]) == code.OpWide && offset+1 == len(s.ins) {
+			return fmt.Errorf("OpWide at %d has no instruction", offset)
+		}
+		def, operands, err := s.ins.Decode(offset)
+		if err != nil {
+			return fmt.Errorf("at %d: %s", offset, err)
+		}
+		s.at[offset] = len(s.decoded)
+		s.decoded = append(s.decoded, instruction{offset, s.ins.Opcode(offset), def, operands})
+		offset += def.Width()
+	}
+	return nil
+}
+
+func (s *stream) checkOperands(constants []object.Object) error {
+	for _, in := range s.decoded {
+		switch in.op {
+		case code.OpConstant, code.OpClosure:
+			if in.operands[0] >= len(constants) {
+				return in.errorf("constant %d out of range", in.operands[0])
+			}
+			if _, ok := constants[in.operands[0]].(*object.CompiledFunction); in.op == code.OpClosure && !ok {
+				return in.errorf("constant %d is not a function", in.operands[0])
+			}
+		case code.OpGetBuiltin:
+			if in.operands[0] >= len(object.Builtins) {
+				return in.errorf("builtin %d out of range", in.operands[0])
+			}
+		case code.OpGetLocal, code.OpSetLocal, code.OpBoxLocal, code.OpGetLocalCell, code.OpSetLocalCell:
+			if in.operands[0] >= s.numLocals {
+				return in.errorf("local %d out of range, there are %d", in.operands[0], s.numLocals)
+			}
+		case code.OpGetFree, code.OpSetFree, code.OpCaptureFree:
+			if in.operands[0] >= s.numFree {
+				return in.errorf("free variable %d out of range, there are %d", in.operands[0], s.numFree)
+			}
+		case code.OpJump, code.OpJumpNotTruthy, code.OpTry:
+			if _, ok := s.at[in.operands[0]]; !ok && in.operands[0] != len(s.ins) {
+				return in.errorf("target %d is not an instruction", in.operands[0])
+			}
+		}
+	}
+	return nil
+}
+
+// state is what is known of the VM when it reaches an instruction: the
+// fewest values on the stack of the frame along the paths seen so far, and
+// the number of handlers that OpTry installed.
+type state struct {
+	depth    int
+	handlers int
+}
+
+// checkPaths follows every path through the stream, see verify.
+func (s *stream) checkPaths() error {
+	states := make([]*state, len(s.decoded)+1) // the last one is the end
+	work := []int{0}
+	states[0] = &state{}
+	// reach records st for the instruction at index i, and visits it again
+	// when st is new or has fewer values on the stack
+	reach := func(from instruction, i int, st state) error {
+		switch prev := states[i]; {
+		case prev == nil:
+			states[i] = &st
+		case prev.handlers != st.handlers:
+			return from.errorf("reaches %d with %d handlers, and with %d on another path", s.offset(i), st.handlers, prev.handlers)
+		case st.depth < prev.depth:
+			prev.depth = st.depth
+		default:
+			return nil
+		}
+		work = append(work, i)
+		return nil
+	}
+
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		if i == len(s.decoded) {
+			if s.constant >= 0 {
+				return fmt.Errorf("the function does not end with a return")
+			}
+			continue
+		}
+		in, st := s.decoded[i], *states[i]
+		pops, pushes := stackEffect(in)
+		if st.depth < pops {
+			return in.errorf("pops %d from a stack of %d", pops, st.depth)
+		}
+		st.depth += pushes - pops
+
+		switch in.op {
+		case code.OpReturnValue, code.OpReturn:
+			if st.handlers > 0 {
+				return in.errorf("returns with %d handlers installed", st.handlers)
+			}
+			continue
+		case code.OpThrow:
+			continue
+		case code.OpEndTry:
+			if st.handlers == 0 {
+				return in.errorf("has no handler to remove")
+			}
+			st.handlers--
+		case code.OpTry:
+			// the handler restores the stack and pushes the error
+			catch := state{depth: st.depth + 1, handlers: st.handlers}
+			if err := reach(in, s.index(in.operands[0]), catch); err != nil {
+				return err
+			}
+			st.handlers++
+		case code.OpJump:
+			if err := reach(in, s.index(in.operands[0]), st); err != nil {
+				return err
+			}
+			continue
+		case code.OpJumpNotTruthy:
+			if err := reach(in, s.index(in.operands[0]), st); err != nil {
+				return err
+			}
+		}
+		if err := reach(in, i+1, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// index returns the index in decoded of the instruction at offset, or
+// len(decoded) for the end.
+func (s *stream) index(offset int) int {
+	if i, ok := s.at[offset]; ok {
+		return i
+	}
+	return len(s.decoded)
+}
+
+func (s *stream) offset(i int) int {
+	if i == len(s.decoded) {
+		return len(s.ins)
+	}
+	return s.decoded[i].offset
+}
+
+// stackEffect returns the number of values that in takes from the stack,
+// and the number it leaves there.
+func stackEffect(in instruction) (pops, pushes int) {
+	switch in.op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal,
+		code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree, code.OpCaptureFree,
+		code.OpGetLocalCell, code.OpCurrentClosure:
+		return 0, 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpEqual, code.OpNotEqual,
+		code.OpGreater, code.OpGreatorEqual, code.OpLess, code.OpLessEqual, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang:
+		return 1, 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal,
+		code.OpSetFree, code.OpSetLocalCell, code.OpReturnValue, code.OpThrow:
+		return 1, 0
+	case code.OpSlice, code.OpSetIndex:
+		return 3, 1
+	case code.OpArray, code.OpHash, code.OpClosure:
+		return in.operands[len(in.operands)-1], 1
+	case code.OpCall, code.OpTailCall:
+		return in.operands[0] + 1, 1
+	}
+	return 0, 0
+}
+
+func (in instruction) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("%s at %d: %s", in.def.Name, in.offset, fmt.Sprintf(format, a...))
+}
@@ -5,10 +5,17 @@ import (
 )
 
 var builtins = map[string]*object.Builtin{
-	"len":   object.GetBuiltinByName("len"),
-	"first": object.GetBuiltinByName("first"),
-	"last":  object.GetBuiltinByName("last"),
-	"rest":  object.GetBuiltinByName("rest"),
-	"push":  object.GetBuiltinByName("push"),
-	"puts":  object.GetBuiltinByName("puts"),
+	"len":    object.GetBuiltinByName("len"),
+	"first":  object.GetBuiltinByName("first"),
+	"last":   object.GetBuiltinByName("last"),
+	"rest":   object.GetBuiltinByName("rest"),
+	"push":   object.GetBuiltinByName("push"),
+	"puts":   object.GetBuiltinByName("puts"),
+	"int":    object.GetBuiltinByName("int"),
+	"float":  object.GetBuiltinByName("float"),
+	"append": object.GetBuiltinByName("append"),
+	"delete": object.GetBuiltinByName("delete"),
+	"keys":   object.GetBuiltinByName("keys"),
+	"values": object.GetBuiltinByName("values"),
+	"items":  object.GetBuiltinByName("items"),
 }
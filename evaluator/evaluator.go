@@ -1,101 +1,182 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
+	"strings"
 
 	"demeulder.us/monkey/ast"
 	"demeulder.us/monkey/object"
 )
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL     = &object.Null{}
+	TRUE     = &object.Boolean{Value: true}
+	FALSE    = &object.Boolean{Value: false}
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
+// evaluator holds the state of one evaluation. The environments it uses
+// only hold bindings, so runs with different limits can share them.
+type evaluator struct {
+	meter *object.Meter // nil when there are no limits to check
+}
+
+// EvalContext evaluates node like Eval, within limits and until ctx is
+// done. When a limit is hit it returns one of the LimitError types of
+// package object.
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, limits object.Limits) (object.Object, error) {
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	meter := object.NewMeter(ctx, limits)
+	if meter != nil {
+		if err := meter.Done(); err != nil {
+			return nil, err
+		}
+	}
+	result := (&evaluator{meter: meter}).eval(node, env)
+	if err, ok := result.(*object.Error); ok && err.Limit != nil {
+		return nil, err.Limit
+	}
+	return result, nil
+}
+
+// Eval evaluates node in env, without limits.
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	return (&evaluator{}).eval(node, env)
+}
+
+func (e *evaluator) eval(node ast.Node, env *object.Environment) object.Object {
+	if err := e.step(); err != nil {
+		return err
+	}
 
 	switch node := node.(type) {
 	case *ast.Program:
-		return evalProgram(node, env)
+		return e.evalProgram(node, env)
 	case *ast.ExpressionStatement:
-		return Eval(node.Expression, env)
+		return e.eval(node.Expression, env)
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBooleanToBooleanOjbect(node.Value)
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 	case *ast.PrefixExpression:
-		right := Eval(node.Right, env)
-		if isError(right) {
+		right := e.eval(node.Right, env)
+		if isReturnOrError(right) {
 			return right
 		}
 		return evalPrefixExpression(node.Operator, right)
 	case *ast.InfixExpression:
-		left := Eval(node.Left, env)
-		if isError(left) {
+		if node.Operator == "&&" || node.Operator == "||" {
+			return e.evalLogicalExpression(node, env)
+		}
+		left := e.eval(node.Left, env)
+		if isReturnOrError(left) {
 			return left
 		}
-		right := Eval(node.Right, env)
-		if isError(right) {
+		right := e.eval(node.Right, env)
+		if isReturnOrError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		result := evalInfixExpression(node.Operator, left, right)
+		if result.Type() == object.STRING_OBJ {
+			return e.allocated(result)
+		}
+		return result
 	case *ast.IfExpression:
-		return evalConditionalExpression(node, env)
+		return e.evalConditionalExpression(node, env)
 	case *ast.ReturnStatement:
-		val := Eval(node.ReturnValue, env)
-		if isError(val) {
+		// the call it returns is a tail call, unless makeTailCall makes it
+		val := e.evalTail(node.ReturnValue, env)
+		if isReturnOrError(val) {
 			return val
 		}
 		return &object.ReturnValue{Value: val}
 	case *ast.LetStatement:
-		val := Eval(node.Value, env)
-		if isError(val) {
+		val := e.eval(node.Value, env)
+		if isReturnOrError(val) {
 			return val
 		}
 		env.Set(node.Name.Value, val)
 	case *ast.Identifier:
 		return evalIdentifier(node.Value, env)
 	case *ast.FunctionLiteral:
-		return &object.Function{Parameters: node.Parameters, Body: node.Body, Environment: env}
+		return e.allocated(&object.Function{Parameters: node.Parameters, Body: node.Body, Environment: env})
 	case *ast.CallExpression:
-		function := Eval(node.Function, env)
-		if isError(function) {
+		function := e.eval(node.Function, env)
+		if isReturnOrError(function) {
 			return function
 		}
-		args := evalExpressions(node.Arguments, env)
-		if len(args) == 1 && isError(args[0]) {
+		args := e.evalExpressions(node.Arguments, env)
+		if len(args) == 1 && isReturnOrError(args[0]) {
 			return args[0]
 		}
-		return applyFunction(function, args, env)
+		return e.applyFunction(function, args, env)
 	case *ast.BlockStatement:
-		return evalBlockStatement(node, env)
+		return e.evalBlockStatement(node, env)
 	case *ast.ArrayLiteral:
-		items := evalExpressions(node.Items, env)
-		return &object.Array{Items: items}
+		items := e.evalExpressions(node.Items, env)
+		if len(items) == 1 && isReturnOrError(items[0]) {
+			return items[0]
+		}
+		return e.allocated(&object.Array{Items: items})
 	case *ast.IndexExpression:
-		array := Eval(node.Left, env)
-		if isError(array) {
+		array := e.eval(node.Left, env)
+		if isReturnOrError(array) {
 			return array
 		}
-		index := Eval(node.Index, env)
-		if isError(index) {
+		index := e.eval(node.Index, env)
+		if isReturnOrError(index) {
 			return index
 		}
-		return evalIndexExpression(array, index)
+		result := evalIndexExpression(array, index)
+		if array.Type() == object.STRING_OBJ && result.Type() == object.STRING_OBJ {
+			return e.allocated(result)
+		}
+		return result
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return e.evalHashLiteral(node, env)
+	case *ast.AssignExpression:
+		return e.evalAssignExpression(node, env)
+	case *ast.IncrementExpression:
+		return e.evalIncrementExpression(node, env)
+	case *ast.IndexAssignExpression:
+		return e.evalIndexAssignExpression(node, env)
+	case *ast.SliceExpression:
+		return e.evalSliceExpression(node, env)
+	case *ast.ForLoop:
+		return e.evalForLoop(node, env)
+	case *ast.WhileLoop:
+		return e.evalWhileLoop(node, env)
+	case *ast.TryExpression:
+		return e.evalTryExpression(node, env)
+	case *ast.ThrowStatement:
+		val := e.eval(node.Value, env)
+		if isReturnOrError(val) {
+			return val
+		}
+		return object.Throw(val)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 	}
 	return nil
 }
 
-func evalExpressions(arguments []ast.Expression, env *object.Environment) []object.Object {
+func (e *evaluator) evalExpressions(arguments []ast.Expression, env *object.Environment) []object.Object {
 	retVal := []object.Object{}
 	for _, p := range arguments {
-		val := Eval(p, env)
-		if isError(val) {
+		val := e.eval(p, env)
+		if isReturnOrError(val) {
 			return []object.Object{val}
 		}
 		retVal = append(retVal, val)
@@ -123,45 +204,259 @@ func nativeBooleanToBooleanOjbect(input bool) object.Object {
 	return FALSE
 }
 
-func evalProgram(node *ast.Program, env *object.Environment) object.Object {
+func (e *evaluator) evalProgram(node *ast.Program, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, statement := range node.Statements {
-		result = Eval(statement, env)
+		result = e.makeTailCall(e.eval(statement, env), env)
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
 		case *object.Error:
 			return result
+		case *object.Break, *object.Continue:
+			return newError("%s outside of loop", result.Inspect())
 		}
 	}
 
 	return result
 }
 
-func evalConditionalExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
-	condition := Eval(ie.Condition, env)
-	if isError(condition) {
+func (e *evaluator) evalConditionalExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
+	condition := e.eval(ie.Condition, env)
+	if isReturnOrError(condition) {
 		return condition
 	}
 	if isTruthy(condition) {
-		return evalBlockStatement(ie.Consequence, env)
+		return e.evalBlockStatement(ie.Consequence, env)
 	} else {
 		if ie.Alternative != nil {
-			return evalBlockStatement(ie.Alternative, env)
+			return e.evalBlockStatement(ie.Alternative, env)
 		}
 		return NULL
 	}
 }
 
-func evalBlockStatement(node *ast.BlockStatement, env *object.Environment) object.Object {
+// evalLogicalExpression evaluates && and || with short-circuiting: the right
+// operand is only evaluated when the left one does not decide the result.
+func (e *evaluator) evalLogicalExpression(node *ast.InfixExpression, env *object.Environment) object.Object {
+	left := e.eval(node.Left, env)
+	if isReturnOrError(left) {
+		return left
+	}
+	if node.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+	if node.Operator == "||" && isTruthy(left) {
+		return TRUE
+	}
+	right := e.eval(node.Right, env)
+	if isReturnOrError(right) {
+		return right
+	}
+	return nativeBooleanToBooleanOjbect(isTruthy(right))
+}
+
+// evalAssignExpression updates an existing binding. For compound operators
+// the current value is read before the right side is evaluated, as in the
+// compiler. &= and |= short-circuit like && and ||.
+func (e *evaluator) evalAssignExpression(node *ast.AssignExpression, env *object.Environment) object.Object {
+	name := node.Name.Value
+	current, err := lookupAssignable(name, env)
+	if err != nil {
+		return err
+	}
+	if node.Operator == "&=" || node.Operator == "|=" {
+		value := e.evalLogicalExpression(&ast.InfixExpression{
+			Token:    node.Token,
+			Left:     node.Name,
+			Operator: strings.Repeat(node.Operator[:1], 2),
+			Right:    node.Value,
+		}, env)
+		if isReturnOrError(value) {
+			return value
+		}
+		env.Assign(name, value)
+		return value
+	}
+	value := e.eval(node.Value, env)
+	if isReturnOrError(value) {
+		return value
+	}
+	if node.Operator != "=" {
+		value = evalInfixExpression(strings.TrimSuffix(node.Operator, "="), current, value)
+		if isError(value) {
+			return value
+		}
+	}
+	env.Assign(name, value)
+	return value
+}
+
+// lookupAssignable returns the current value of a variable that is about
+// to be assigned to, with the compiler's errors for unknown names and
+// builtins.
+func lookupAssignable(name string, env *object.Environment) (object.Object, *object.Error) {
+	if current, ok := env.Get(name); ok {
+		return current, nil
+	}
+	if _, ok := builtins[name]; ok {
+		return nil, newError("cannot assign to %s", name)
+	}
+	return nil, newError("assignment to undeclared variable %s", name)
+}
+
+// evalIndexAssignExpression evaluates the container, the index and the value
+// in that order and stores the value in place.
+func (e *evaluator) evalIndexAssignExpression(node *ast.IndexAssignExpression, env *object.Environment) object.Object {
+	left := e.eval(node.Target.Left, env)
+	if isReturnOrError(left) {
+		return left
+	}
+	index := e.eval(node.Target.Index, env)
+	if isReturnOrError(index) {
+		return index
+	}
+	value := e.eval(node.Value, env)
+	if isReturnOrError(value) {
+		return value
+	}
+	if err := object.SetIndex(left, index, value); err != nil {
+		return newError("%s", err)
+	}
+	return value
+}
+
+// evalIncrementExpression adds or subtracts one from a numeric variable.
+func (e *evaluator) evalIncrementExpression(node *ast.IncrementExpression, env *object.Environment) object.Object {
+	name := node.Value.(*ast.Identifier).Value
+	current, err := lookupAssignable(name, env)
+	if err != nil {
+		return err
+	}
+	if !isNumber(current) {
+		return newError("unknown operator: %s%s", node.Operator, current.Type())
+	}
+	value := evalInfixExpression(node.Operator[:1], current, &object.Integer{Value: 1})
+	if isError(value) {
+		return value
+	}
+	env.Assign(name, value)
+	if node.Postfix {
+		return current
+	}
+	return value
+}
+
+// evalForLoop runs the loop in its own environment so that the loop
+// variables are not visible after it.
+func (e *evaluator) evalForLoop(fl *ast.ForLoop, env *object.Environment) object.Object {
+	loopEnv := object.NewEnvironment(env)
+	if fl.Initialization != nil {
+		init := e.eval(fl.Initialization, loopEnv)
+		if isReturnOrError(init) {
+			return init
+		}
+	}
+	for {
+		if fl.Test != nil {
+			condition := e.eval(fl.Test, loopEnv)
+			if isReturnOrError(condition) {
+				return condition
+			}
+			if !isTruthy(condition) {
+				break
+			}
+		}
+		result := e.makeTailCall(e.evalBlockStatement(fl.Block, loopEnv), loopEnv)
+		if result == BREAK {
+			break
+		}
+		if isReturnOrError(result) {
+			return result
+		}
+		if fl.Update != nil {
+			update := e.eval(fl.Update, loopEnv)
+			if isReturnOrError(update) {
+				return update
+			}
+		}
+	}
+	return NULL
+}
+
+func (e *evaluator) evalWhileLoop(wl *ast.WhileLoop, env *object.Environment) object.Object {
+	loopEnv := object.NewEnvironment(env)
+	for {
+		condition := e.eval(wl.Condition, loopEnv)
+		if isReturnOrError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			break
+		}
+		result := e.makeTailCall(e.evalBlockStatement(wl.Block, loopEnv), loopEnv)
+		if result == BREAK {
+			break
+		}
+		if isReturnOrError(result) {
+			return result
+		}
+	}
+	return NULL
+}
+
+// evalTryExpression runs the catch clause for an error of the try block and
+// the finally clause on the way out, whatever happened. A return, break,
+// continue or error of the finally clause replaces the outcome of the other
+// clauses.
+func (e *evaluator) evalTryExpression(te *ast.TryExpression, env *object.Environment) object.Object {
+	result := e.makeTailCall(e.evalBlockStatement(te.Block, env), env)
+	if err, ok := result.(*object.Error); ok && err.Limit == nil && te.Catch != nil {
+		catchEnv := object.NewEnvironment(env)
+		catchEnv.Set(te.Parameter.Value, err.Caught())
+		result = e.makeTailCall(e.evalBlockStatement(te.Catch, catchEnv), catchEnv)
+	}
+	if err, ok := result.(*object.Error); ok && err.Limit != nil {
+		return err
+	}
+	if te.Finally != nil {
+		final := e.makeTailCall(e.evalBlockStatement(te.Finally, env), env)
+		if isControlFlow(final) {
+			return final
+		}
+	}
+	if isControlFlow(result) {
+		return result
+	}
+	return NULL
+}
+
+// isControlFlow reports whether obj leaves the enclosing block early.
+func isControlFlow(obj object.Object) bool {
+	return isReturnOrError(obj) || obj == BREAK || obj == CONTINUE
+}
+
+// isReturnOrError reports whether obj ends the expression that uses it: a
+// return inside an argument, operand or condition returns from the
+// function, as in the compiled code.
+func isReturnOrError(obj object.Object) bool {
+	if obj == nil {
+		return false
+	}
+	rt := obj.Type()
+	return rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ
+}
+
+func (e *evaluator) evalBlockStatement(node *ast.BlockStatement, env *object.Environment) object.Object {
 	var result object.Object
 
 	for _, statement := range node.Statements {
-		result = Eval(statement, env)
+		result = e.eval(statement, env)
 		if result != nil {
 			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ ||
+				rt == object.BREAK_OBJ || rt == object.CONTINUE_OBJ {
 				return result
 			}
 		}
@@ -183,35 +478,72 @@ func evalPrefixExpression(operator string, right object.Object) object.Object {
 
 func evalInfixExpression(operator string, left object.Object, right object.Object) object.Object {
 	switch {
-	case left.Type() != right.Type():
-		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
+	case isNumber(left) && isNumber(right) && left.Type() != right.Type(),
+		left.Type() == object.FLOAT_OBJ && right.Type() == object.FLOAT_OBJ:
+		return evalInfixFloatExpression(operator, left, right)
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalInfixIntegerExpression(operator, left, right)
-	case left.Type() == object.BOOLEAN_OBJ && right.Type() == object.BOOLEAN_OBJ:
-		return evalInfixBooleanExpression(operator, left, right)
+	case operator == "==":
+		return nativeBooleanToBooleanOjbect(object.Equal(left, right))
+	case operator == "!=":
+		return nativeBooleanToBooleanOjbect(!object.Equal(left, right))
+	case left.Type() != right.Type():
+		return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
+	case operator == "<" || operator == "<=" || operator == ">" || operator == ">=":
+		return evalOrderingExpression(operator, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalInfixStringExpression(operator, left, right)
 	}
-	return newError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
-}
-
-func newError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+	return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 }
 
-func evalInfixBooleanExpression(operator string, left object.Object, right object.Object) object.Object {
-	leftVal := left.(*object.Boolean).Value
-	rightVal := right.(*object.Boolean).Value
+// evalOrderingExpression orders strings and arrays with object.Compare.
+func evalOrderingExpression(operator string, left object.Object, right object.Object) object.Object {
+	c, ok := object.Compare(left, right)
+	if !ok {
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
 	switch operator {
-	case "==":
-		return &object.Boolean{Value: leftVal == rightVal}
-	case "!=":
-		return &object.Boolean{Value: leftVal != rightVal}
+	case "<":
+		return nativeBooleanToBooleanOjbect(c < 0)
+	case "<=":
+		return nativeBooleanToBooleanOjbect(c <= 0)
+	case ">":
+		return nativeBooleanToBooleanOjbect(c > 0)
 	default:
-		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+		return nativeBooleanToBooleanOjbect(c >= 0)
 	}
 }
 
+// step counts one step of the evaluation against the limits of e.
+func (e *evaluator) step() *object.Error {
+	if e.meter != nil {
+		if err := e.meter.Step(); err != nil {
+			return limitError(err)
+		}
+	}
+	return nil
+}
+
+// limitError stops the evaluation for the LimitError err.
+func limitError(err error) *object.Error {
+	return &object.Error{Message: err.Error(), Limit: err.(object.LimitError)}
+}
+
+// allocated counts the new object obj against the allocation limit.
+func (e *evaluator) allocated(obj object.Object) object.Object {
+	if e.meter != nil {
+		if err := e.meter.Allocate(); err != nil {
+			return limitError(err)
+		}
+	}
+	return obj
+}
+
+func newError(format string, a ...interface{}) *object.Error {
+	return &object.Error{Message: fmt.Sprintf(format, a...)}
+}
+
 func evalInfixStringExpression(operator string, left object.Object, right object.Object) object.Object {
 	leftVal := left.(*object.String).Value
 	rightVal := right.(*object.String).Value
@@ -234,30 +566,78 @@ func evalInfixIntegerExpression(operator string, left object.Object, right objec
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
 	case "<":
-		return &object.Boolean{Value: leftVal < rightVal}
+		return nativeBooleanToBooleanOjbect(leftVal < rightVal)
+	case "<=":
+		return nativeBooleanToBooleanOjbect(leftVal <= rightVal)
+	case ">":
+		return nativeBooleanToBooleanOjbect(leftVal > rightVal)
+	case ">=":
+		return nativeBooleanToBooleanOjbect(leftVal >= rightVal)
+	case "==":
+		return nativeBooleanToBooleanOjbect(leftVal == rightVal)
+	case "!=":
+		return nativeBooleanToBooleanOjbect(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// evalInfixFloatExpression handles float operands, and mixed integer and
+// float operands where the integer is converted to a float first.
+func evalInfixFloatExpression(operator string, left object.Object, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "<":
+		return nativeBooleanToBooleanOjbect(leftVal < rightVal)
 	case "<=":
-		return &object.Boolean{Value: leftVal <= rightVal}
+		return nativeBooleanToBooleanOjbect(leftVal <= rightVal)
 	case ">":
-		return &object.Boolean{Value: leftVal > rightVal}
+		return nativeBooleanToBooleanOjbect(leftVal > rightVal)
 	case ">=":
-		return &object.Boolean{Value: leftVal >= rightVal}
+		return nativeBooleanToBooleanOjbect(leftVal >= rightVal)
 	case "==":
-		return &object.Boolean{Value: leftVal == rightVal}
+		return nativeBooleanToBooleanOjbect(leftVal == rightVal)
 	case "!=":
-		return &object.Boolean{Value: leftVal != rightVal}
+		return nativeBooleanToBooleanOjbect(leftVal != rightVal)
 	default:
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 	}
 }
 
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	if i, ok := obj.(*object.Integer); ok {
+		return float64(i.Value)
+	}
+	return obj.(*object.Float).Value
+}
+
 func evalMinusOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
 }
 
 func evalBangOperatorEspression(right object.Object) object.Object {
@@ -290,22 +670,135 @@ func evalIdentifier(identifier string, env *object.Environment) object.Object {
 	return newError("identifier not found: %s", identifier)
 }
 
-func applyFunction(function object.Object, args []object.Object, env *object.Environment) object.Object {
+func (e *evaluator) applyFunction(function object.Object, args []object.Object, env *object.Environment) object.Object {
 	switch fn := function.(type) {
 	case *object.Function:
-		extendedEnv := extendEnvironment(args, fn)
-		evaluated := Eval(fn.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		if e.meter != nil {
+			if err := e.meter.Enter(); err != nil {
+				return limitError(err)
+			}
+			defer e.meter.Leave()
+		}
+		// a trampoline: the tail calls of fn come back here to be made,
+		// so that they do not nest
+		for {
+			evaluated := unwrapReturnValue(e.evalTail(fn.Body, extendEnvironment(args, fn)))
+			call, ok := evaluated.(*tailCall)
+			if !ok {
+				if evaluated == BREAK || evaluated == CONTINUE {
+					return newError("%s outside of loop", evaluated.Inspect())
+				}
+				return evaluated
+			}
+			next, ok := call.function.(*object.Function)
+			if !ok {
+				return e.applyFunction(call.function, call.args, env)
+			}
+			fn, args = next, call.args
+		}
 	case *object.Builtin:
-		if result := fn.Fn(args...); result != nil {
-			return result
+		result, err := fn.Call(args...)
+		if err != nil {
+			return err
 		}
-		return NULL
+		if result == nil {
+			return NULL
+		}
+		if fn.Allocates {
+			return e.allocated(result)
+		}
+		return result
 	default:
 		return newError("not a function: %s\n", fn.Type())
 	}
 }
 
+// tailCall is a call in tail position that evalTail leaves to
+// applyFunction.
+type tailCall struct {
+	function object.Object
+	args     []object.Object
+}
+
+func (tc *tailCall) Type() object.ObjectType { return "TAIL_CALL" }
+func (tc *tailCall) Inspect() string         { return "tail call" }
+
+// evalTail evaluates node, the body of a function or the value of a return
+// statement, like Eval, except that it returns the calls in tail position as
+// a *tailCall instead of making them. Return statements leave their tail
+// call in the *object.ReturnValue, and the loops, try expressions and the
+// main program make it in place, see makeTailCall. The tail positions are
+// the ones of compiler.findTailCalls.
+func (e *evaluator) evalTail(node ast.Node, env *object.Environment) object.Object {
+	switch node.(type) {
+	case *ast.BlockStatement, *ast.ExpressionStatement,
+		*ast.IfExpression, *ast.CallExpression:
+	default:
+		return e.eval(node, env)
+	}
+	if err := e.step(); err != nil {
+		return err
+	}
+
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		if len(node.Statements) == 0 {
+			return nil
+		}
+		last := len(node.Statements) - 1
+		for _, statement := range node.Statements[:last] {
+			result := e.eval(statement, env)
+			if isControlFlow(result) {
+				return result
+			}
+		}
+		return e.evalTail(node.Statements[last], env)
+	case *ast.ExpressionStatement:
+		return e.evalTail(node.Expression, env)
+	case *ast.IfExpression:
+		condition := e.eval(node.Condition, env)
+		if isReturnOrError(condition) {
+			return condition
+		}
+		if isTruthy(condition) {
+			return e.evalTail(node.Consequence, env)
+		}
+		if node.Alternative != nil {
+			return e.evalTail(node.Alternative, env)
+		}
+		return NULL
+	default:
+		call := node.(*ast.CallExpression)
+		function := e.eval(call.Function, env)
+		if isReturnOrError(function) {
+			return function
+		}
+		args := e.evalExpressions(call.Arguments, env)
+		if len(args) == 1 && isReturnOrError(args[0]) {
+			return args[0]
+		}
+		return &tailCall{function: function, args: args}
+	}
+}
+
+// makeTailCall makes the tail call that a return statement left in obj,
+// where returns do not end a function body.
+func (e *evaluator) makeTailCall(obj object.Object, env *object.Environment) object.Object {
+	rv, ok := obj.(*object.ReturnValue)
+	if !ok {
+		return obj
+	}
+	call, ok := rv.Value.(*tailCall)
+	if !ok {
+		return obj
+	}
+	result := e.applyFunction(call.function, call.args, env)
+	if isError(result) {
+		return result
+	}
+	return &object.ReturnValue{Value: result}
+}
+
 func extendEnvironment(args []object.Object, fn *object.Function) *object.Environment {
 	extEnv := object.NewEnvironment(fn.Environment)
 	for i, p := range fn.Parameters {
@@ -315,7 +808,7 @@ func extendEnvironment(args []object.Object, fn *object.Function) *object.Enviro
 }
 
 func unwrapReturnValue(obj object.Object) object.Object {
-	if returnValue, ok := obj.(object.ReturnValue); ok {
+	if returnValue, ok := obj.(*object.ReturnValue); ok {
 		return returnValue.Value
 	}
 	return obj
@@ -325,6 +818,8 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
 	default:
@@ -334,14 +829,42 @@ func evalIndexExpression(left, index object.Object) object.Object {
 
 func evalArrayIndexExpression(array, index object.Object) object.Object {
 	arrayObject := array.(*object.Array)
-	idx := index.(*object.Integer).Value
-	max := int64(len(arrayObject.Items) - 1)
+	idx, ok := object.ResolveIndex(index.(*object.Integer).Value, len(arrayObject.Items))
+	if !ok {
+		return NULL
+	}
+	return arrayObject.Items[idx]
+}
 
-	if idx < 0 || idx > max {
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	value := str.(*object.String).Value
+	idx, ok := object.ResolveIndex(index.(*object.Integer).Value, len(value))
+	if !ok {
 		return NULL
 	}
+	return &object.String{Value: value[idx : idx+1]}
+}
 
-	return arrayObject.Items[idx]
+func (e *evaluator) evalSliceExpression(node *ast.SliceExpression, env *object.Environment) object.Object {
+	left := e.eval(node.Left, env)
+	if isReturnOrError(left) {
+		return left
+	}
+	bounds := []object.Object{NULL, NULL}
+	for i, bound := range []ast.Expression{node.Start, node.End} {
+		if bound == nil {
+			continue
+		}
+		bounds[i] = e.eval(bound, env)
+		if isReturnOrError(bounds[i]) {
+			return bounds[i]
+		}
+	}
+	result, err := object.Slice(left, bounds[0], bounds[1])
+	if err != nil {
+		return newError("%s", err)
+	}
+	return e.allocated(result)
 }
 
 func evalHashIndexExpression(hash object.Object, key object.Object) object.Object {
@@ -350,30 +873,30 @@ func evalHashIndexExpression(hash object.Object, key object.Object) object.Objec
 	if !ok {
 		return newError("unusable as hash key: %s", key.Type())
 	}
-	pair, ok := hashObject.Pairs[hashableKey.HashKey()]
+	value, ok := hashObject.Get(hashableKey)
 	if !ok {
 		return NULL
 	}
-	return pair.Value
+	return value
 }
 
-func evalHashLiteral(hl *ast.HashLiteral, env *object.Environment) object.Object {
-	pairs := make(map[object.HashKey]object.HashPair)
-	for k, v := range hl.Pairs {
-		key := Eval(k, env)
-		if isError(key) {
+func (e *evaluator) evalHashLiteral(hl *ast.HashLiteral, env *object.Environment) object.Object {
+	hash := &object.Hash{}
+	for _, k := range hl.Keys {
+		key := e.eval(k, env)
+		if isReturnOrError(key) {
 			return key
 		}
 		hashableKey, ok := key.(object.Hashable)
 		if !ok {
 			return newError("key for hash does is not hashable")
 		}
-		value := Eval(v, env)
-		if isError(value) {
+		value := e.eval(hl.Pairs[k], env)
+		if isReturnOrError(value) {
 			return value
 		}
-		pairs[hashableKey.HashKey()] = object.HashPair{Key: key, Value: value}
+		hash.Set(hashableKey, value)
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return e.allocated(hash)
 }
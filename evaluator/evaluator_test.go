@@ -1,6 +1,10 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"demeulder.us/monkey/lexer"
 	"demeulder.us/monkey/object"
 	"demeulder.us/monkey/parser"
@@ -35,6 +39,79 @@ func TestEvalIntegerExperssion(t *testing.T) {
 	}
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.5", 3.5},
+		{"-2.5", -2.5},
+		{"1e3", 1000},
+		{"0.5 + 0.25", 0.75},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2},
+		{"7 / 2.0", 3.5},
+		{"10 - 2.5 * 2", 5},
+		{"float(3) / 2", 1.5},
+		{`float("2.25")`, 2.25},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestMixedNumberComparison(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 < 1.5", true},
+		{"2.0 == 2", true},
+		{"2 != 2.5", true},
+		{"3.5 >= 4", false},
+		{"0.1 + 0.2 > 0.3", true},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestNumberConversions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"int(3.9)", 3},
+		{"int(-3.9)", -3},
+		{"int(7)", 7},
+		{`int("42")`, 42},
+		{`int("4.2")`, `int("4.2"): cannot convert "4.2" to INTEGER`},
+		{`float("x")`, `float("x"): cannot convert "x" to FLOAT`},
+		{"int(true)", "int(true): argument to `int` not supported, got BOOLEAN"},
+		{"int(1e300)", "int(1e+300): cannot convert 1e+300 to INTEGER"},
+		{"int(-1e19)", "int(-1e+19): cannot convert -1e+19 to INTEGER"},
+		{"int(9.3e18)", "int(9.3e+18): cannot convert 9.3e+18 to INTEGER"},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestEvalBooleanExperssion(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -62,6 +139,31 @@ func TestEvalBooleanExperssion(t *testing.T) {
 		{"true != true", false},
 		{"true == false", false},
 		{"true != false", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
+		{`"a" < "b"`, true},
+		{`"abc" >= "abd"`, false},
+		{`"b" > "abc"`, true},
+		{"[1, 2] == [1, 2]", true},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[1, [2, 3]] == [1, [2, 3]]", true},
+		{"[1, 2] != [2, 1]", true},
+		{"[1, 2] < [1, 3]", true},
+		{"[1, 2] < [1]", false},
+		{"[] <= []", true},
+		{`{"a": [1]} == {"a": [1]}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} == {"b": 1}`, false},
+		{"1 == 1.0", true},
+		{`1 == "1"`, false},
+		{`"1" != 1`, true},
+		{"[1] == {}", false},
+		{"true == 1", false},
+		{"if (false) { 1 } == if (false) { 2 }", true},
+		{"if (false) { 1 } == 0", false},
+		{"!(1 == 2)", true},
+		{`!("a" == "b")`, true},
 	}
 	for _, tt := range tests {
 		evaluated := testEval(tt.input)
@@ -92,6 +194,20 @@ func testIntegerObject(t *testing.T, actual object.Object, expected int64) bool
 	return true
 }
 
+func testFloatObject(t *testing.T, actual object.Object, expected float64) bool {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		t.Errorf("Object is not a float. got=%T", actual)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("Object is the wrong value, expected %g, got %g", expected, result.Value)
+		return false
+	}
+
+	return true
+}
+
 func testBooleanObject(t *testing.T, actual object.Object, expected bool) bool {
 	result, ok := actual.(*object.Boolean)
 	if !ok {
@@ -120,6 +236,31 @@ func testStringObject(t *testing.T, actual object.Object, expected string) bool
 	return true
 }
 
+func TestLogicalExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || true", true},
+		{"true || false", true},
+		{"1 && 2", true},
+		{"if (false) { 1 } || 2 > 1", true},
+		{"1 < 2 && 2 < 3 || false", true},
+		// the right operand would fail if it were evaluated
+		{`false && 1 + "a"`, false},
+		{`true || 1 + "a"`, true},
+		{`false && missing`, false},
+	}
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
 func TestBangOperator(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -241,6 +382,22 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			`"a" < 1`,
+			"type mismatch: STRING < INTEGER",
+		},
+		{
+			"true > false",
+			"unknown operator: BOOLEAN > BOOLEAN",
+		},
+		{
+			`[1] < ["a"]`,
+			"unknown operator: ARRAY < ARRAY",
+		},
+		{
+			"let x = 0; 1 / x",
+			"division by zero",
+		},
 	}
 
 	for _, tt := range tests {
@@ -260,6 +417,161 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestForLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 0; for (let i = 0; i < 10; i += 1) { x = x + i; }; x", 45},
+		{"let x = 1; for (; x < 100;) { x *= 2 }; x", 128},
+		{"let x = 0; for (let i = 0; i < 0; i += 1) { x = 99 }; x", 0},
+		{"for (let i = 0; i < 3; i += 1) { i }", nil},
+		{`
+		let total = 0;
+		for (let i = 0; i < 4; i += 1) {
+			for (let j = 0; j < 3; j += 1) {
+				total += i * j;
+			}
+		}
+		total`, 18},
+		{`
+		let find = fn(limit) {
+			for (let i = 0; true; i += 1) {
+				if (i * i > limit) { return i; }
+			}
+		};
+		find(50) + 1`, 9},
+		{"for (let i = 0; i < 3; i += 1) { i }; i", "identifier not found: i"},
+		{"for (let i = 0; i < 3; i += 1) { i + true }", "type mismatch: INTEGER + BOOLEAN"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 0; while (x < 10) { x += 1 }; x", 10},
+		{"let x = 0; while (false) { x = 99 }; x", 0},
+		{"while (false) { 1 }", nil},
+		{"let x = 0; while (true) { x += 1; if (x == 7) { break; } }; x", 7},
+		{`
+		let odd = 0;
+		let i = 0;
+		while (i < 10) {
+			i += 1;
+			if (i / 2 * 2 == i) { continue; }
+			odd += i;
+		}
+		odd`, 25},
+		{`
+		let total = 0;
+		for (let i = 0; i < 5; i += 1) {
+			if (i == 1) { continue; }
+			if (i == 4) { break; }
+			let j = 0;
+			while (true) {
+				j += 1;
+				if (j > i) { break; }
+				total += j;
+			}
+		}
+		total`, 9},
+		{"let f = fn() { let i = 0; while (true) { i += 1; if (i > 3) { return i * 10; } } }; f()", 40},
+		{"break;", "break outside of loop"},
+		{"while (true) { let f = fn() { continue; }; f(); }", "continue outside of loop"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = 1; a = 2; a", 2},
+		{"let a = 1; a = a + 5", 6},
+		{"let a = 1; let b = 2; a = b = 3; a + b", 6},
+		{"let a = 10; a += 5; a -= 3; a *= 2; a /= 4; a", 6},
+		{"let a = 1; let f = fn() { a = 5 }; f(); a", 5},
+		{"let f = fn() { let a = 1; a += 1; a }; f()", 2},
+		{"b = 1", "assignment to undeclared variable b"},
+		{"len = 1", "cannot assign to len"},
+		{"let len = 1; len = 2; len", 2},
+		{"let a = 1; a += true", "type mismatch: INTEGER + BOOLEAN"},
+		{"let a = true; a &= false; a", false},
+		{"let a = false; a |= 1; a", true},
+		{"let n = 0; let a = false; a &= fn() { n = 1; true }(); n", 0},
+		{"let a = 1; let a = a + 1; a", 2},
+		{"let a = 1; ++a", 2},
+		{"let a = 1; a++", 1},
+		{"let a = 1; a++; a", 2},
+		{"let a = 1; --a", 0},
+		{"let a = 1; a--; a", 0},
+		{"let a = 1; let b = a++ + a; b", 3},
+		{"let s = 0; for (let i = 0; i < 5; i++) { s += i }; s", 10},
+		{"b++", "assignment to undeclared variable b"},
+		{"len++", "cannot assign to len"},
+		{`let s = "a"; s++`, "unknown operator: ++STRING"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -341,6 +653,9 @@ func TestStrings(t *testing.T) {
 	}{
 		{`"hello world"`, "hello world"},
 		{`"hello" + " " + "world!"`, "hello world!"},
+		{`"tab\there\n"`, "tab\there\n"},
+		{`"\"quoted\" \\ \u{263A}"`, "\"quoted\" \\ \u263A"},
+		{"`raw\\n\nstring` + \"!\"", "raw\\n\nstring!"},
 	}
 	for _, tt := range tests {
 		testStringObject(t, testEval(tt.input), tt.expected)
@@ -356,8 +671,8 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, true, 0},
 		{`len("four")`, true, 4},
 		{`len("hello world")`, true, 11},
-		{`len(1)`, false, "argument to `len` not supported, got INTEGER"},
-		{`len("one", "two")`, false, "wrong number of arguments. got=2, want=1"},
+		{`len(1)`, false, "len(1): argument to `len` not supported, got INTEGER"},
+		{`len("one", "two")`, false, "len(\"one\", \"two\"): wrong number of arguments. got=2, want=1"},
 		{`len([1, 2, 23])`, true, 3},
 		{`len([])`, true, 0},
 		{`len([1, len("hello"), 23])`, true, 3},
@@ -368,6 +683,10 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`first("hello")`, true, "h"},
 		{`rest([1,2,3])`, true, []int{2, 3}},
 		{`push([1,2,3], 4)`, true, []int{1, 2, 3, 4}},
+		{`push(1, 1)`, false, "push(1, 1): argument to `push` must be ARRAY, got INTEGER"},
+		{`rest("a long string argument")`, false, "rest(\"a long string ar...): argument to `rest` must be ARRAY, got STRING"},
+		{`let x = len(1); x`, false, "len(1): argument to `len` not supported, got INTEGER"},
+		{`[len(1), 2]`, false, "len(1): argument to `len` not supported, got INTEGER"},
 	}
 
 	for _, tt := range tests {
@@ -475,6 +794,14 @@ func TestArrayIndexExpressions(t *testing.T) {
 		},
 		{
 			"[1, 2, 3][-1]",
+			3,
+		},
+		{
+			"[1, 2, 3][-3]",
+			1,
+		},
+		{
+			"[1, 2, 3][-4]",
 			nil,
 		},
 	}
@@ -516,12 +843,16 @@ func TestHashLiterals(t *testing.T) {
 		FALSE.HashKey():                            6,
 	}
 
-	if len(result.Pairs) != len(expected) {
-		t.Fatalf("Hash has wrong num of pairs. got=%d", len(result.Pairs))
+	if result.Len() != len(expected) {
+		t.Fatalf("Hash has wrong num of pairs. got=%d", result.Len())
 	}
 
+	pairs := map[object.HashKey]object.HashPair{}
+	for _, pair := range result.Pairs() {
+		pairs[pair.Key.(object.Hashable).HashKey()] = pair
+	}
 	for expectedKey, expectedValue := range expected {
-		pair, ok := result.Pairs[expectedKey]
+		pair, ok := pairs[expectedKey]
 		if !ok {
 			t.Errorf("no pair for given key in Pairs")
 		}
@@ -530,6 +861,160 @@ func TestHashLiterals(t *testing.T) {
 	}
 }
 
+func TestHashOrder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`keys({"b": 1, "a": 2, 3: 3})`, "[b, a, 3]"},
+		{`values({"b": 1, "a": 2, 3: 3})`, "[1, 2, 3]"},
+		{`items({"b": 1, "a": 2})`, "[[b, 1], [a, 2]]"},
+		{`keys({})`, "[]"},
+		{`let h = {"x": 1, "y": 2}; h["x"] = 3; h`, "{x: 3, y: 2}"},
+		{`let h = {"x": 1, "y": 2}; delete(h, "x"); h["x"] = 1; h`, "{y: 2, x: 1}"},
+		{`let h = {}; for (let i = 5; i > 0; i--) { h[i] = i * i }; h`, "{5: 25, 4: 16, 3: 9, 2: 4, 1: 1}"},
+		{`let h = {1: "a", 0: "z"}; [h[1.0], h[-0.0], h[0.0]]`, "[a, z, z]"},
+		{`let h = {2.0: "a"}; h[2] = "b"; h`, "{2.0: b}"},
+		{`keys(1)`, "keys(1): argument to `keys` must be HASH, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		got := evaluated.Inspect()
+		if errObj, ok := evaluated.(*object.Error); ok {
+			got = errObj.Message
+		}
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let r = 0; try { throw 5 } catch (e) { r = e }; r`, "5"},
+		{`let r = ""; try { len(1) } catch (e) { r = e["type"] + ": " + e["message"] }; r`, "TypeError: len(1): argument to `len` not supported, got INTEGER"},
+		{`let r = ""; try { len(1, 2) } catch (e) { r = e["type"] }; r`, "ArgumentError"},
+		{`let r = ""; try { int("x") } catch (e) { r = e["type"] }; r`, "ValueError"},
+		{`let r = ""; try { [1][5] = 2 } catch (e) { r = e["type"] }; r`, "RuntimeError"},
+		{`let f = fn(n) { if (n == 0) { throw "deep" }; f(n - 1) }; let r = ""; try { f(10) } catch (e) { r = e }; r + "!"`, "deep!"},
+		{`let log = []; let f = fn() { try { append(log, 1); return 2 } finally { append(log, 3) } }; append(log, f()); log`, "[1, 3, 2]"},
+		{`let log = []; try { try { throw "x" } finally { append(log, "f") } } catch (e) { append(log, e) }; log`, "[f, x]"},
+		{`let n = 0; for (let i = 0; i < 5; i++) { try { if (i == 2) { break } } finally { n++ } }; n`, "3"},
+		{`let n = 0; let i = 0; while (i < 5) { i++; try { if (i > 2) { continue }; n = n + 10 } finally { n++ } }; n`, "25"},
+		{`let r = ""; try { try { len(1) } catch (e) { throw e } } catch (e) { r = e["type"] }; r`, "TypeError"},
+		{`let log = []; try { try { throw 1 } catch (e) { throw e + 1 } finally { append(log, "f") } } catch (e) { append(log, e) }; log`, "[f, 2]"},
+		{`let f = fn() { try { throw 1 } catch (e) { return e + 1 } }; [1, 2, f(), try { throw 1 } catch (e) { 3 }]`, "[1, 2, 2, null]"},
+		{`let fs = []; try { throw 7 } catch (e) { append(fs, fn() { e }) }; fs[0]()`, "7"},
+		{`let f = fn() { try { return 1 } finally { return 2 } }; f()`, "2"},
+		{`let f = fn() { try { throw 1 } finally { return 2 } }; f()`, "2"},
+		{`let log = []; try { try { append(log, 1) } finally { append(log, 2) } } finally { append(log, 3) }; log`, "[1, 2, 3]"},
+		{`let log = []; try { try { try { throw "x" } finally { append(log, 1) } } finally { append(log, 2) } } catch (e) { append(log, e) }; log`, "[1, 2, x]"},
+		{`let log = []; let f = fn() { try { try { return 1 } finally { append(log, "a") } } finally { append(log, "b") } }; append(log, f()); log`, "[a, b, 1]"},
+		{`let log = []; try { try { throw "x" } finally { try { append(log, 1) } finally { append(log, 2) } } } catch (e) { append(log, e) }; log`, "[1, 2, x]"},
+		{`let n = 0; while (true) { try { try { break } finally { n++ } } finally { n = n * 10 } }; n`, "10"},
+		{`let r = 0; for (let i = 0; i < 3; i++) { try { throw i } catch (e) { r = r + e } }; r`, "3"},
+		{`let r = 0; let f = fn() { try { throw 1 } catch (e) { r = e } }; f(); try { f(); throw 2 } catch (e) { r = r + e }; r`, "3"},
+		{`let e = 1; try { throw 2 } catch (e) { e }; e`, "1"},
+		{`try { 1 } catch (e) { 2 }`, "null"},
+		{`let r = ""; try { 1 / 0 } catch (e) { r = e["type"] + ": " + e["message"] }; r`, "RuntimeError: division by zero"},
+		{`let f = fn(n) { 10 / n }; let r = ""; try { f(0) } catch (e) { r = e["message"] }; r`, "division by zero"},
+		{`let r = 0; try { 1.0 / 0 } catch (e) { r = 1 }; r`, "0"},
+		{`throw "boom"`, "uncaught exception: boom"},
+		{`try { 1 } catch (e) { 2 }; throw 3`, "uncaught exception: 3"},
+		{`throw {"message": "custom", "type": "MyError"}`, "custom"},
+		{`try { len(1) } finally { 1 }`, "len(1): argument to `len` not supported, got INTEGER"},
+		{`try { throw 1 } catch (e) { throw e + 1 }`, "uncaught exception: 2"},
+		{`let r = ""; try { 1 + "a" } catch (e) { r = e["message"] }; r`, "type mismatch: INTEGER + STRING"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if evaluated == nil {
+			t.Fatalf("no result for %q", tt.input)
+		}
+		got := evaluated.Inspect()
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestIndexAssignment(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let a = [1, 2, 3]; a[0] = 5; a[0] + a[1]", 7},
+		{"let a = [1, 2, 3]; a[2] = a[0] + a[1]", 3},
+		{"let a = [[0, 0], [0, 0]]; a[1][0] = 7; a[1][0]", 7},
+		{"let a = [1]; let b = a; b[0] = 9; a[0]", 9},
+		{`let h = {}; h["x"] = 1; h["x"]`, 1},
+		{"let f = fn(a) { a[0] = 2 }; let a = [1]; f(a); a[0]", 2},
+		{"let a = []; for (let i = 0; i < 5; i++) { append(a, i) }; len(a)", 5},
+		{`let h = {"a": 1}; delete(h, "a")`, 1},
+		{`let h = {"a": 1}; delete(h, "a"); h["a"]`, nil},
+		{"let a = [1, 2, 3]; a[3] = 1", "index out of range: 3 (length 3)"},
+		{`let a = [1]; a["x"] = 1`, "array index must be INTEGER, got STRING"},
+		{"let h = {}; h[[1]] = 1", "unusable as hash key: ARRAY"},
+		{`let s = "abc"; s[0] = "x"`, "index assignment not supported: STRING"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		default:
+			testNullObject(t, evaluated)
+		}
+	}
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3, 4][1:3]", "[2, 3]"},
+		{"[1, 2, 3, 4][:2]", "[1, 2]"},
+		{"[1, 2, 3, 4][2:]", "[3, 4]"},
+		{"[1, 2, 3, 4][-2:]", "[3, 4]"},
+		{"[1, 2, 3, 4][:-1]", "[1, 2, 3]"},
+		{"[1, 2, 3, 4][3:1]", "[]"},
+		{"[1, 2, 3, 4][-10:10]", "[1, 2, 3, 4]"},
+		{`"monkey"[1:3]`, "on"},
+		{`"monkey"[-3:]`, "key"},
+		{`"monkey"[0]`, "m"},
+		{`"monkey"[-1]`, "y"},
+		{`[1, 2]["a":]`, "error: slice index must be INTEGER, got STRING"},
+		{"{}[1:]", "error: slice operator not supported: HASH"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		got := evaluated.Inspect()
+		if errObj, ok := evaluated.(*object.Error); ok {
+			got = "error: " + errObj.Message
+		}
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
 func TestHashIndexExpressions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -575,3 +1060,141 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		input  string
+		limits object.Limits
+		target interface{} // a pointer to the expected error type
+	}{
+		{`while (true) {}`, object.Limits{MaxSteps: 1000}, new(*object.StepLimitError)},
+		{`let f = fn(n) { 1 + f(n + 1) }; f(0)`, object.Limits{MaxCallDepth: 100}, new(*object.CallDepthError)},
+		{`while (true) { [1] }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`let s = ""; while (true) { s = s + "a" }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`let a = [1]; while (true) { rest(a) }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`let h = {1: 2}; while (true) { items(h) }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`while (true) {}`, object.Limits{Timeout: 10 * time.Millisecond}, new(*object.DeadlineError)},
+		{`try { while (true) {} } catch (e) {} finally { 1 }`, object.Limits{MaxSteps: 1000}, new(*object.StepLimitError)},
+		{`let f = fn() { try { f() } catch (e) { 1 } }; f()`, object.Limits{MaxCallDepth: 50}, new(*object.CallDepthError)},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		_, err := EvalContext(context.Background(), program, object.NewEnvironment(nil), tt.limits)
+		if !errors.As(err, tt.target) {
+			t.Errorf("wrong error for %q. want=%T, got=%v", tt.input, tt.target, err)
+		}
+	}
+
+	program := parser.New(lexer.New(`let f = fn(n) { if (n == 0) { return [] }; f(n - 1) }; f(10)`)).ParseProgram()
+	limits := object.Limits{MaxSteps: 1000, MaxCallDepth: 11, MaxAllocations: 2, Timeout: time.Minute}
+	result, err := EvalContext(context.Background(), program, object.NewEnvironment(nil), limits)
+	if err != nil {
+		t.Fatalf("evaluation within limits failed: %s", err)
+	}
+	if result.Inspect() != "[]" {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+
+	// first, last, append and delete return values that already exist
+	program = parser.New(lexer.New(`let a = [[1], [2]]; let h = {"k": [3]}; let n = 0; while (n < 1000) { first(a); last(a); append(a[0]); delete(h, "x"); n++ }; len(first(a))`)).ParseProgram()
+	result, err = EvalContext(context.Background(), program, object.NewEnvironment(nil), object.Limits{MaxAllocations: 10})
+	if err != nil {
+		t.Fatalf("evaluation within limits failed: %s", err)
+	}
+	if result.Inspect() != "1" {
+		t.Errorf("wrong result. got=%s", result.Inspect())
+	}
+}
+
+// TestTailCalls runs deep tail recursion within a small call depth.
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + 1) } }; count(100000, 0)`, "100000"},
+		{`let f = fn(n) { if (n == 0) { return "done" }; return f(n - 1) }; f(50000)`, "done"},
+		{`let sum = fn(arr, acc) { if (len(arr) == 0) { return acc }; sum(rest(arr), acc + first(arr)) }; let a = []; let i = 0; while (i < 2000) { a = push(a, i); i++ }; sum(a, 0)`, "1999000"},
+		{`let odd = fn(n) { n }; let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; if (even(10001)) { "even" } else { "odd" }`, "odd"},
+		{`let f = fn(a) { len(a) }; f([1, 2])`, "2"},
+		{`let f = fn(n, fs) { if (n == 0) { fs } else { f(n - 1, push(fs, fn() { n })) } }; let fs = f(3, []); fs[0]() * 100 + fs[1]() * 10 + fs[2]()`, "321"},
+		{`let r = ""; let g = fn() { throw "x" }; let f = fn() { try { g() } catch (e) { r = "caught" }; r }; f()`, "caught"},
+		{`let f = fn(n) { if (n > 0) { return f(n - 1) }; 9 }; f(100000)`, "9"},
+		{`let f = fn(n) { let x = if (n > 0) { return f(n - 1) } else { 9 }; x }; f(100000)`, "9"},
+		{`let g = fn() { 5 }; let f = fn() { while (true) { return g() } }; f()`, "5"},
+		{`let g = fn() { throw "x" }; let f = fn() { try { return g() } catch (e) { return "caught" } }; f()`, "caught"},
+		{`let g = fn() { 7 }; let f = fn() { try { return g() } finally { 1 } }; f()`, "7"},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		limits := object.Limits{MaxCallDepth: 5}
+		result, err := EvalContext(context.Background(), program, object.NewEnvironment(nil), limits)
+		if err != nil {
+			t.Fatalf("evaluation of %q failed: %s", tt.input, err)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong result for %q. want=%s, got=%s", tt.input, tt.expected, result.Inspect())
+		}
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	program := parser.New(lexer.New(`while (true) {}`)).ParseProgram()
+	env := object.NewEnvironment(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := EvalContext(ctx, program, env, object.Limits{})
+	if !errors.As(err, new(*object.CanceledError)) || !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error for a canceled context. got=%v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = EvalContext(ctx, program, env, object.Limits{})
+	if !errors.As(err, new(*object.DeadlineError)) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong error for a context deadline. got=%v", err)
+	}
+
+	// the limits of a run do not stay with the environment
+	_, err = EvalContext(context.Background(), parser.New(lexer.New(`let f = fn(n) { n }`)).ParseProgram(), env, object.Limits{MaxSteps: 20})
+	if err != nil {
+		t.Fatalf("evaluation failed: %s", err)
+	}
+	result := Eval(parser.New(lexer.New(`let n = 0; while (n < 100) { n = f(n + 1) }; n`)).ParseProgram(), env)
+	if result.Inspect() != "100" {
+		t.Errorf("wrong result after a limited run. got=%s", result.Inspect())
+	}
+}
+
+// TestEvalContextShared runs a limited and an unlimited evaluation at the
+// same time in environments with a shared outer environment.
+func TestEvalContextShared(t *testing.T) {
+	shared := object.NewEnvironment(nil)
+	Eval(parser.New(lexer.New(`let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }`)).ParseProgram(), shared)
+	program := parser.New(lexer.New(`f(2000)`)).ParseProgram()
+
+	errs := make(chan error, 2)
+	for _, limits := range []object.Limits{{MaxSteps: 100}, {}} {
+		go func(limits object.Limits) {
+			_, err := EvalContext(context.Background(), program, object.NewEnvironment(shared), limits)
+			errs <- err
+		}(limits)
+	}
+	var limited, unlimited int
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; {
+		case err == nil:
+			unlimited++
+		case errors.As(err, new(*object.StepLimitError)):
+			limited++
+		default:
+			t.Errorf("wrong error. got=%v", err)
+		}
+	}
+	if limited != 1 || unlimited != 1 {
+		t.Errorf("wrong runs. want 1 limited and 1 unlimited, got %d and %d", limited, unlimited)
+	}
+}
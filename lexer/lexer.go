@@ -1,25 +1,66 @@
 package lexer
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
 	"demeulder.us/monkey/token"
 )
 
+// DefaultFilename is used in positions when the input has no file name.
+const DefaultFilename = "<input>"
+
 type Lexer struct {
 	input        string
+	filename     string
 	position     int  // current position in input (points to current char)
 	readPosition int  // current reading position in input (after current char)
 	ch           byte // current char under consideration
+	line         int  // line of the current char, starting at 1
+	column       int  // column of the current char, starting at 1
+
+	emitComments bool
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithFilename(input, DefaultFilename)
+}
+
+func NewWithFilename(input string, filename string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
 
+func (l *Lexer) Filename() string { return l.filename }
+
+// EmitComments makes NextToken return comments as COMMENT tokens instead of
+// skipping them.
+func (l *Lexer) EmitComments(emit bool) { l.emitComments = emit }
+
 func (l *Lexer) NextToken() token.Token {
+	for {
+		l.skipWhiteSpace()
+		pos := l.currentPosition()
+		var tok token.Token
+		if l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*') {
+			tok = l.readComment()
+			if tok.Type == token.COMMENT && !l.emitComments {
+				continue
+			}
+		} else {
+			tok = l.nextToken()
+		}
+		tok.Pos = pos
+		return tok
+	}
+}
+
+func (l *Lexer) nextToken() token.Token {
 	var tok token.Token
-	l.skipWhiteSpace()
 	switch l.ch {
 	case '=':
 		tok = l.twoCharToken()
@@ -60,8 +101,19 @@ func (l *Lexer) NextToken() token.Token {
 	case ':':
 		tok = newToken(token.COLON, l.ch)
 	case '"':
-		tok.Literal = l.readString()
-		tok.Type = token.STRING
+		str, err := l.readString()
+		if err != nil {
+			tok = token.Token{Type: token.ILLEGAL, Literal: err.Error()}
+		} else {
+			tok = token.Token{Type: token.STRING, Literal: str}
+		}
+	case '`':
+		str, ok := l.readRawString()
+		if !ok {
+			tok = token.Token{Type: token.ILLEGAL, Literal: "unterminated raw string"}
+		} else {
+			tok = token.Token{Type: token.STRING, Literal: str}
+		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
@@ -71,11 +123,12 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.LookupIdent(tok.Literal)
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Literal = l.readNumber()
-			tok.Type = token.INT
-			return tok
+			return l.readNumber()
 		} else {
-			tok = newToken(token.ILLEGAL, l.ch)
+			tok = token.Token{
+				Type:    token.ILLEGAL,
+				Literal: fmt.Sprintf("unexpected character %q", l.ch),
+			}
 		}
 
 	}
@@ -87,7 +140,16 @@ func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
 
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{Offset: l.position, Line: l.line, Column: l.column}
+}
+
 func (l *Lexer) readChar() {
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -183,21 +245,146 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[position:l.position]
 }
 
-func (l *Lexer) readNumber() string {
+// readNumber reads an integer, or a float when the digits are followed by a
+// fraction (3.14) and/or an exponent (1e-9).
+func (l *Lexer) readNumber() token.Token {
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+	l.readDigits()
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+	if l.ch == 'e' || l.ch == 'E' {
+		next := l.peekChar()
+		if (next == '+' || next == '-') && l.readPosition+1 < len(l.input) {
+			next = l.input[l.readPosition+1]
+			if isDigit(next) {
+				l.readChar()
+			}
+		}
+		if isDigit(next) {
+			tokenType = token.FLOAT
+			l.readChar()
+			l.readDigits()
+		}
+	}
+	return token.Token{Type: tokenType, Literal: l.input[position:l.position]}
+}
+
+func (l *Lexer) readDigits() {
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
 }
 
-func (l *Lexer) readString() string {
+// readString reads a double quoted string and decodes its escape sequences.
+// On an invalid escape it still reads up to the closing quote so lexing can
+// resume after the string.
+func (l *Lexer) readString() (string, error) {
+	var out strings.Builder
+	var err error
 	l.readChar() // first double quote
+	for l.ch != '"' {
+		switch l.ch {
+		case 0:
+			return "", errors.New("unterminated string")
+		case '\\':
+			l.readChar()
+			if escErr := l.readEscape(&out); escErr != nil && err == nil {
+				err = escErr
+			}
+		default:
+			out.WriteByte(l.ch)
+		}
+		l.readChar()
+	}
+	return out.String(), err
+}
+
+// readEscape decodes the escape sequence whose first char after the
+// backslash is l.ch, leaving l.ch on the last char of the sequence.
+func (l *Lexer) readEscape(out *strings.Builder) error {
+	switch l.ch {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case '"':
+		out.WriteByte('"')
+	case '\\':
+		out.WriteByte('\\')
+	case 'u':
+		return l.readUnicodeEscape(out)
+	case 0:
+		// reported as an unterminated string by readString
+	default:
+		return fmt.Errorf("invalid escape sequence \"\\%c\" in string", l.ch)
+	}
+	return nil
+}
+
+// readUnicodeEscape decodes \u{XXXX}, with 1 to 6 hex digits.
+func (l *Lexer) readUnicodeEscape(out *strings.Builder) error {
+	if l.peekChar() != '{' {
+		return errors.New("invalid unicode escape in string, expected \\u{...}")
+	}
+	l.readChar() // '{'
+	start := l.position + 1
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+	}
+	digits := l.input[start : l.position+1]
+	if l.peekChar() != '}' {
+		return errors.New("invalid unicode escape in string, expected \\u{...}")
+	}
+	l.readChar() // '}'
+	value, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || len(digits) > 6 || !utf8.ValidRune(rune(value)) {
+		return fmt.Errorf("invalid unicode code point \"\\u{%s}\" in string", digits)
+	}
+	out.WriteRune(rune(value))
+	return nil
+}
+
+// readRawString reads a backtick quoted string verbatim. It reports false if
+// the input ends before the closing backtick.
+func (l *Lexer) readRawString() (string, bool) {
+	l.readChar() // opening backtick
 	position := l.position
-	for l.ch != '"' && l.ch != 0 {
+	for l.ch != '`' {
+		if l.ch == 0 {
+			return "", false
+		}
 		l.readChar()
 	}
-	return l.input[position:l.position]
+	return l.input[position:l.position], true
+}
+
+// readComment reads a // line comment up to (not including) the newline, or
+// a /* block */ comment including its delimiters.
+func (l *Lexer) readComment() token.Token {
+	position := l.position
+	if l.peekChar() == '/' {
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+		return token.Token{Type: token.COMMENT, Literal: l.input[position:l.position]}
+	}
+	l.readChar() // '/'
+	l.readChar() // '*'
+	for !(l.ch == '*' && l.peekChar() == '/') {
+		if l.ch == 0 {
+			return token.Token{Type: token.ILLEGAL, Literal: "unterminated block comment"}
+		}
+		l.readChar()
+	}
+	l.readChar() // '*'
+	l.readChar() // '/'
+	return token.Token{Type: token.COMMENT, Literal: l.input[position:l.position]}
 }
 
 func isLetter(ch byte) bool {
@@ -208,6 +395,10 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
+}
+
 func (l *Lexer) skipWhiteSpace() {
 	for l.ch == ' ' || l.ch == '\t' || l.ch == '\r' || l.ch == '\n' {
 		l.readChar()
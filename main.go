@@ -4,11 +4,49 @@ import (
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
 
 	"demeulder.us/monkey/repl"
 )
 
+const usage = `usage:
+	monkey                              start the REPL
+	monkey <file>                       evaluate programs/<file>
+	monkey build <file.monkey> [<out>]  compile a program to <out>, file.mbc by default
+	monkey run <file>                   run a .mbc file or a program on the VM
+	monkey disasm <file>                list the bytecode of a .mbc file or a program
+`
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			if len(os.Args) < 3 || len(os.Args) > 4 {
+				fail(fmt.Errorf("%s", usage))
+			}
+			src := os.Args[2]
+			out := strings.TrimSuffix(src, filepath.Ext(src)) + ".mbc"
+			if len(os.Args) == 4 {
+				out = os.Args[3]
+			}
+			fail(repl.BuildFile(src, out))
+			return
+		case "run":
+			if len(os.Args) != 3 {
+				fail(fmt.Errorf("%s", usage))
+			}
+			fail(repl.RunFile(os.Args[2], os.Stdout))
+			return
+		case "disasm":
+			if len(os.Args) != 3 {
+				fail(fmt.Errorf("%s", usage))
+			}
+			fail(repl.DisassembleFile(os.Args[2], os.Stdout))
+			return
+		}
+	}
+
 	user, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -24,3 +62,11 @@ func main() {
 	}
 
 }
+
+// fail exits with err, if there is one.
+func fail(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -1,103 +1,116 @@
 package object
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
 
 var Builtins = []struct {
 	Name    string
 	Builtin *Builtin
 }{
-	{"len", &Builtin{Fn: monkeyLen}},
-	{"puts", &Builtin{Fn: monkeyPuts}},
-	{"first", &Builtin{Fn: monkeyFirst}},
-	{"last", &Builtin{Fn: monkeyLast}},
-	{"rest", &Builtin{Fn: monkeyRest}},
-	{"push", &Builtin{Fn: monkeyPush}},
+	{"len", &Builtin{Name: "len", Fn: monkeyLen}},
+	{"puts", &Builtin{Name: "puts", Fn: monkeyPuts}},
+	{"first", &Builtin{Name: "first", Fn: monkeyFirst}},
+	{"last", &Builtin{Name: "last", Fn: monkeyLast}},
+	{"rest", &Builtin{Name: "rest", Fn: monkeyRest, Allocates: true}},
+	{"push", &Builtin{Name: "push", Fn: monkeyPush, Allocates: true}},
+	{"int", &Builtin{Name: "int", Fn: monkeyInt}},
+	{"float", &Builtin{Name: "float", Fn: monkeyFloat}},
+	{"append", &Builtin{Name: "append", Fn: monkeyAppend}},
+	{"delete", &Builtin{Name: "delete", Fn: monkeyDelete}},
+	{"keys", &Builtin{Name: "keys", Fn: monkeyKeys, Allocates: true}},
+	{"values", &Builtin{Name: "values", Fn: monkeyValues, Allocates: true}},
+	{"items", &Builtin{Name: "items", Fn: monkeyItems, Allocates: true}},
 }
 
-func monkeyLen(args ...Object) Object {
+func monkeyLen(args ...Object) (Object, error) {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1",
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1",
 			len(args))
 	}
 	switch arg := args[0].(type) {
 	case *Array:
-		return &Integer{Value: int64(len(arg.Items))}
+		return &Integer{Value: int64(len(arg.Items))}, nil
 	case *String:
-		return &Integer{Value: int64(len(arg.Value))}
+		return &Integer{Value: int64(len(arg.Value))}, nil
 	default:
-		return newError("argument to `len` not supported, got %s",
+		return nil, newError(TYPE_ERROR, "argument to `len` not supported, got %s",
 			args[0].Type())
 	}
 }
 
-func monkeyFirst(args ...Object) Object {
+func monkeyFirst(args ...Object) (Object, error) {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1",
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1",
 			len(args))
 	}
 	switch arg := args[0].(type) {
 	case *Array:
 		if len(arg.Items) == 0 {
-			return nil
+			return nil, nil
 		}
-		return arg.Items[0]
+		return arg.Items[0], nil
 	case *String:
 		if len(arg.Value) == 0 {
-			return nil
+			return nil, nil
 		}
-		return &String{Value: string(arg.Value[0])}
+		return &String{Value: string(arg.Value[0])}, nil
 	default:
-		return newError("argument to `first` must be ARRAY, got %s",
+		return nil, newError(TYPE_ERROR, "argument to `first` must be ARRAY, got %s",
 			args[0].Type())
 	}
 }
 
-func monkeyLast(args ...Object) Object {
+func monkeyLast(args ...Object) (Object, error) {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1",
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1",
 			len(args))
 	}
 	switch arg := args[0].(type) {
 	case *Array:
 		if len(arg.Items) == 0 {
-			return nil
+			return nil, nil
 		}
-		return arg.Items[len(arg.Items)-1]
+		return arg.Items[len(arg.Items)-1], nil
 	case *String:
 		if len(arg.Value) == 0 {
-			return nil
+			return nil, nil
 		}
-		return &String{Value: string(arg.Value[len(arg.Value)-1])}
+		return &String{Value: string(arg.Value[len(arg.Value)-1])}, nil
 	default:
-		return newError("argument to `last` must be ARRAY, got %s",
+		return nil, newError(TYPE_ERROR, "argument to `last` must be ARRAY, got %s",
 			args[0].Type())
 	}
 }
 
-func monkeyRest(args ...Object) Object {
+func monkeyRest(args ...Object) (Object, error) {
 	if len(args) != 1 {
-		return newError("wrong number of arguments. got=%d, want=1",
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1",
 			len(args))
 	}
 	switch arg := args[0].(type) {
 	case *Array:
 		length := len(arg.Items)
 		if length == 0 {
-			return nil
+			return nil, nil
 		}
 		rest := make([]Object, length-1)
 		sl := arg.Items[1:length]
 		copy(rest, sl)
-		return &Array{Items: rest}
+		return &Array{Items: rest}, nil
 	default:
-		return newError("argument to `rest` must be ARRAY, got %s",
+		return nil, newError(TYPE_ERROR, "argument to `rest` must be ARRAY, got %s",
 			args[0].Type())
 	}
 }
 
-func monkeyPush(args ...Object) Object {
+func monkeyPush(args ...Object) (Object, error) {
 	if len(args) != 2 {
-		return newError("wrong number of arguments. got=%d, want=2",
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=2",
 			len(args))
 	}
 	switch arg := args[0].(type) {
@@ -108,18 +121,174 @@ func monkeyPush(args ...Object) Object {
 			rest = append(rest, o)
 		}
 		rest = append(rest, args[1])
-		return &Array{Items: rest}
+		return &Array{Items: rest}, nil
 	default:
-		return newError("argument to `push` must be ARRAY, got %s",
+		return nil, newError(TYPE_ERROR, "argument to `push` must be ARRAY, got %s",
 			args[0].Type())
 	}
 }
 
-func monkeyPuts(args ...Object) Object {
+// monkeyAppend adds the values to the end of the array in place, unlike
+// push, and returns the array.
+func monkeyAppend(args ...Object) (Object, error) {
+	if len(args) < 1 {
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want at least 1",
+			len(args))
+	}
+	switch arg := args[0].(type) {
+	case *Array:
+		arg.Items = append(arg.Items, args[1:]...)
+		return arg, nil
+	default:
+		return nil, newError(TYPE_ERROR, "argument to `append` must be ARRAY, got %s",
+			args[0].Type())
+	}
+}
+
+// monkeyDelete removes a key from a hash and returns its value, or null
+// when the key was not there.
+func monkeyDelete(args ...Object) (Object, error) {
+	if len(args) != 2 {
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=2",
+			len(args))
+	}
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return nil, newError(TYPE_ERROR, "argument to `delete` must be HASH, got %s",
+			args[0].Type())
+	}
+	key, ok := args[1].(Hashable)
+	if !ok {
+		return nil, newError(TYPE_ERROR, "unusable as hash key: %s", args[1].Type())
+	}
+	value, ok := hash.Delete(key)
+	if !ok {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// monkeyKeys, monkeyValues and monkeyItems return the contents of a hash
+// in insertion order. items gives [key, value] arrays.
+func monkeyKeys(args ...Object) (Object, error) {
+	return hashContents("keys", args, func(p HashPair) Object { return p.Key })
+}
+
+func monkeyValues(args ...Object) (Object, error) {
+	return hashContents("values", args, func(p HashPair) Object { return p.Value })
+}
+
+func monkeyItems(args ...Object) (Object, error) {
+	return hashContents("items", args, func(p HashPair) Object {
+		return &Array{Items: []Object{p.Key, p.Value}}
+	})
+}
+
+func hashContents(name string, args []Object, item func(HashPair) Object) (Object, error) {
+	if len(args) != 1 {
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+	hash, ok := args[0].(*Hash)
+	if !ok {
+		return nil, newError(TYPE_ERROR, "argument to `%s` must be HASH, got %s",
+			name, args[0].Type())
+	}
+	items := []Object{}
+	for _, p := range hash.Pairs() {
+		items = append(items, item(p))
+	}
+	return &Array{Items: items}, nil
+}
+
+func monkeyInt(args ...Object) (Object, error) {
+	if len(args) != 1 {
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+	switch arg := args[0].(type) {
+	case *Integer:
+		return arg, nil
+	case *Float:
+		// Both bounds are ±2**63; infinities fall outside them.
+		if math.IsNaN(arg.Value) || arg.Value >= 9.223372036854775807e18 || arg.Value < -9.223372036854775808e18 {
+			return nil, newError(VALUE_ERROR, "cannot convert %s to INTEGER", arg.Inspect())
+		}
+		return &Integer{Value: int64(arg.Value)}, nil
+	case *String:
+		value, err := strconv.ParseInt(arg.Value, 0, 64)
+		if err != nil {
+			return nil, newError(VALUE_ERROR, "cannot convert %q to INTEGER", arg.Value)
+		}
+		return &Integer{Value: value}, nil
+	default:
+		return nil, newError(TYPE_ERROR, "argument to `int` not supported, got %s",
+			args[0].Type())
+	}
+}
+
+func monkeyFloat(args ...Object) (Object, error) {
+	if len(args) != 1 {
+		return nil, newError(ARGUMENT_ERROR, "wrong number of arguments. got=%d, want=1",
+			len(args))
+	}
+	switch arg := args[0].(type) {
+	case *Integer:
+		return &Float{Value: float64(arg.Value)}, nil
+	case *Float:
+		return arg, nil
+	case *String:
+		value, err := strconv.ParseFloat(arg.Value, 64)
+		if err != nil {
+			return nil, newError(VALUE_ERROR, "cannot convert %q to FLOAT", arg.Value)
+		}
+		return &Float{Value: value}, nil
+	default:
+		return nil, newError(TYPE_ERROR, "argument to `float` not supported, got %s",
+			args[0].Type())
+	}
+}
+
+func monkeyPuts(args ...Object) (Object, error) {
 	for _, arg := range args {
 		fmt.Println(arg.Inspect())
 	}
-	return nil
+	return nil, nil
+}
+
+// Call runs the builtin. A failure is returned as an *Error of the same
+// kind whose message starts with the call, as in `len(1): ...`.
+func (b *Builtin) Call(args ...Object) (Object, *Error) {
+	result, err := b.Fn(args...)
+	if err == nil {
+		return result, nil
+	}
+	kind := RUNTIME_ERROR
+	var failure *Error
+	if errors.As(err, &failure) && failure.Kind != "" {
+		kind = failure.Kind
+	}
+	return nil, &Error{Message: fmt.Sprintf("%s: %s", describeCall(b.Name, args), err), Kind: kind}
+}
+
+// describeCall shows a call for an error message, shortening long
+// arguments.
+func describeCall(name string, args []Object) string {
+	shown := make([]string, len(args))
+	for i, arg := range args {
+		s := arg.Inspect()
+		switch arg := arg.(type) {
+		case *String:
+			s = strconv.Quote(arg.Value)
+		case *Boolean:
+			s = strconv.FormatBool(arg.Value)
+		}
+		if len(s) > 20 {
+			s = s[:17] + "..."
+		}
+		shown[i] = s
+	}
+	return name + "(" + strings.Join(shown, ", ") + ")"
 }
 
 func GetBuiltinByName(name string) *Builtin {
@@ -131,6 +300,6 @@ func GetBuiltinByName(name string) *Builtin {
 	return nil
 }
 
-func newError(format string, a ...interface{}) *Error {
-	return &Error{Message: fmt.Sprintf(format, a...)}
+func newError(kind string, format string, a ...interface{}) *Error {
+	return &Error{Message: fmt.Sprintf(format, a...), Kind: kind}
 }
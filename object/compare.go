@@ -0,0 +1,145 @@
+package object
+
+import "strings"
+
+// Equal reports whether a and b are equal. Arrays and hashes are compared
+// element by element. Values of different types are never equal, except
+// integers and floats, which are compared as numbers. Functions and other
+// values without structure are only equal to themselves.
+func Equal(a, b Object) bool {
+	return equal(a, b, map[[2]Object]bool{})
+}
+
+// Compare orders a and b, returning -1, 0 or 1. Numbers are ordered by
+// value, strings byte by byte and arrays lexicographically by their
+// elements. ok is false when the values cannot be ordered.
+func Compare(a, b Object) (result int, ok bool) {
+	return compare(a, b, map[[2]Object]bool{})
+}
+
+// equal and compare keep the pairs of arrays and hashes that are being
+// compared in seen, so that a structure that contains itself does not
+// recurse forever.
+func equal(a, b Object, seen map[[2]Object]bool) bool {
+	if isNumber(a) && isNumber(b) {
+		c, _ := compare(a, b, seen)
+		return c == 0 && !isNaN(a) && !isNaN(b)
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch a := a.(type) {
+	case *Boolean:
+		return a.Value == b.(*Boolean).Value
+	case *String:
+		return a.Value == b.(*String).Value
+	case *Null:
+		return true
+	case *Array:
+		b := b.(*Array)
+		if a == b || seen[[2]Object{a, b}] {
+			return true
+		}
+		if len(a.Items) != len(b.Items) {
+			return false
+		}
+		seen[[2]Object{a, b}] = true
+		for i := range a.Items {
+			if !equal(a.Items[i], b.Items[i], seen) {
+				return false
+			}
+		}
+		return true
+	case *Hash:
+		b := b.(*Hash)
+		if a == b || seen[[2]Object{a, b}] {
+			return true
+		}
+		if a.Len() != b.Len() {
+			return false
+		}
+		seen[[2]Object{a, b}] = true
+		for _, pair := range a.Pairs() {
+			other, ok := b.Get(pair.Key.(Hashable))
+			if !ok || !equal(pair.Value, other, seen) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func compare(a, b Object, seen map[[2]Object]bool) (int, bool) {
+	if isNumber(a) && isNumber(b) {
+		ai, aInt := a.(*Integer)
+		bi, bInt := b.(*Integer)
+		if aInt && bInt {
+			return compareInt(ai.Value, bi.Value), true
+		}
+		return compareFloat(toFloat(a), toFloat(b)), true
+	}
+	if a.Type() != b.Type() {
+		return 0, false
+	}
+
+	switch a := a.(type) {
+	case *String:
+		return strings.Compare(a.Value, b.(*String).Value), true
+	case *Array:
+		b := b.(*Array)
+		if a == b || seen[[2]Object{a, b}] {
+			return 0, true
+		}
+		seen[[2]Object{a, b}] = true
+		for i := 0; i < len(a.Items) && i < len(b.Items); i++ {
+			c, ok := compare(a.Items[i], b.Items[i], seen)
+			if !ok || c != 0 {
+				return c, ok
+			}
+		}
+		return compareInt(int64(len(a.Items)), int64(len(b.Items))), true
+	default:
+		return 0, false
+	}
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isNumber(obj Object) bool {
+	return obj.Type() == INTEGER_OBJ || obj.Type() == FLOAT_OBJ
+}
+
+func isNaN(obj Object) bool {
+	f, ok := obj.(*Float)
+	return ok && f.Value != f.Value
+}
+
+func toFloat(obj Object) float64 {
+	if i, ok := obj.(*Integer); ok {
+		return float64(i.Value)
+	}
+	return obj.(*Float).Value
+}
@@ -1,5 +1,7 @@
 package object
 
+// Environment holds the bindings of a scope. Evaluations that share an
+// environment share its bindings, so they must not run concurrently.
 type Environment struct {
 	store map[string]Object
 	outer *Environment
@@ -25,3 +27,15 @@ func (e *Environment) Get(identifier string) (Object, bool) {
 	}
 	return nil, false
 }
+
+// Assign updates the binding of identifier in the innermost environment that
+// defines it. It reports false if no environment does.
+func (e *Environment) Assign(identifier string, object Object) (Object, bool) {
+	for env := e; env != nil; env = env.outer {
+		if _, ok := env.store[identifier]; ok {
+			env.store[identifier] = object
+			return object, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,147 @@
+package object
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Limits bound the work of one run of a program. A zero field means no
+// limit.
+type Limits struct {
+	// MaxSteps bounds the instructions the VM executes, or the nodes the
+	// evaluator evaluates.
+	MaxSteps int64
+	// MaxCallDepth bounds the number of function calls in progress.
+	MaxCallDepth int
+	// MaxAllocations bounds the arrays, hashes, strings and functions the
+	// program creates.
+	MaxAllocations int64
+	// Timeout bounds the wall-clock time of the run, on top of the deadline
+	// of its context.
+	Timeout time.Duration
+}
+
+// LimitError is implemented by the errors that stop a run when it hits a
+// limit or its context is done. Try expressions do not catch them.
+type LimitError interface {
+	error
+	limitError()
+}
+
+type StepLimitError struct {
+	Limit int64
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("step limit of %d exceeded", e.Limit)
+}
+
+type CallDepthError struct {
+	Limit int
+}
+
+func (e *CallDepthError) Error() string {
+	return fmt.Sprintf("call depth limit of %d exceeded", e.Limit)
+}
+
+type AllocationLimitError struct {
+	Limit int64
+}
+
+func (e *AllocationLimitError) Error() string {
+	return fmt.Sprintf("allocation limit of %d exceeded", e.Limit)
+}
+
+// DeadlineError is returned when the timeout or the deadline of the
+// context passes.
+type DeadlineError struct{}
+
+func (e *DeadlineError) Error() string { return "deadline exceeded" }
+func (e *DeadlineError) Unwrap() error { return context.DeadlineExceeded }
+
+// CanceledError is returned when the context is canceled.
+type CanceledError struct{}
+
+func (e *CanceledError) Error() string { return "execution canceled" }
+func (e *CanceledError) Unwrap() error { return context.Canceled }
+
+func (e *StepLimitError) limitError()       {}
+func (e *CallDepthError) limitError()       {}
+func (e *AllocationLimitError) limitError() {}
+func (e *DeadlineError) limitError()        {}
+func (e *CanceledError) limitError()        {}
+
+// checkInterval is the number of steps between two looks at the context.
+const checkInterval = 1024
+
+// Meter counts the work of a run against its Limits.
+type Meter struct {
+	limits      Limits
+	ctx         context.Context
+	steps       int64
+	allocations int64
+	depth       int
+}
+
+// NewMeter returns a meter for a run that stops when ctx is done. It
+// returns nil when there is nothing to check, so that callers can skip
+// counting altogether.
+func NewMeter(ctx context.Context, limits Limits) *Meter {
+	if limits == (Limits{}) && ctx.Done() == nil {
+		return nil
+	}
+	return &Meter{limits: limits, ctx: ctx}
+}
+
+// Step counts one step and looks at the context every checkInterval steps.
+func (m *Meter) Step() error {
+	m.steps++
+	if m.limits.MaxSteps > 0 && m.steps > m.limits.MaxSteps {
+		return &StepLimitError{Limit: m.limits.MaxSteps}
+	}
+	if m.steps%checkInterval == 0 {
+		return m.Done()
+	}
+	return nil
+}
+
+// Done returns the error for a done context, or nil.
+func (m *Meter) Done() error {
+	switch m.ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return &DeadlineError{}
+	default:
+		return &CanceledError{}
+	}
+}
+
+// Allocate counts one new array, hash, string or function.
+func (m *Meter) Allocate() error {
+	m.allocations++
+	if m.limits.MaxAllocations > 0 && m.allocations > m.limits.MaxAllocations {
+		return &AllocationLimitError{Limit: m.limits.MaxAllocations}
+	}
+	return nil
+}
+
+// CallDepth checks the depth of a call about to start, 1 for a call from
+// the top level.
+func (m *Meter) CallDepth(depth int) error {
+	if m.limits.MaxCallDepth > 0 && depth > m.limits.MaxCallDepth {
+		return &CallDepthError{Limit: m.limits.MaxCallDepth}
+	}
+	return nil
+}
+
+// Enter and Leave track the call depth for callers that do not know it.
+func (m *Meter) Enter() error {
+	m.depth++
+	return m.CallDepth(m.depth)
+}
+
+func (m *Meter) Leave() {
+	m.depth--
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
+	"strconv"
 	"strings"
 
 	"demeulder.us/monkey/ast"
@@ -14,9 +16,12 @@ type ObjectType string
 
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
+	BREAK_OBJ             = "BREAK"
+	CONTINUE_OBJ          = "CONTINUE"
 	ERROR_OBJ             = "ERROR"
 	FUNCTION_OBJ          = "FUNCTION"
 	STRING_OBJ            = "STRING"
@@ -25,6 +30,7 @@ const (
 	HASH_OBJ              = "HASH"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
 	CLOSURE_OBJ           = "CLOSURE"
+	CELL_OBJ              = "CELL"
 )
 
 type Object interface {
@@ -38,6 +44,7 @@ type HashKey struct {
 }
 
 type Hashable interface {
+	Object
 	HashKey() HashKey
 }
 
@@ -48,7 +55,33 @@ type Integer struct {
 func (i Integer) Type() ObjectType { return INTEGER_OBJ }
 func (i Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i Integer) HashKey() HashKey {
-	return HashKey{Type: INTEGER_OBJ, Value: uint64(i.Value)}
+	return numberHashKey(float64(i.Value))
+}
+
+type Float struct {
+	Value float64
+}
+
+func (f Float) Type() ObjectType { return FLOAT_OBJ }
+func (f Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+func (f Float) HashKey() HashKey {
+	return numberHashKey(f.Value)
+}
+
+// numberHashKey returns the hash key of a number, after the conversion to
+// float64 that == does, so that the numbers that are == share a key: 1 and
+// 1.0, 0 and -0.0. A number that is an integer has the key of that integer.
+func numberHashKey(f float64) HashKey {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		return HashKey{Type: INTEGER_OBJ, Value: uint64(int64(f))}
+	}
+	return HashKey{Type: FLOAT_OBJ, Value: math.Float64bits(f)}
 }
 
 type Boolean struct {
@@ -89,13 +122,73 @@ type ReturnValue struct {
 func (rv ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// Break and Continue signal a break or continue statement to the enclosing
+// loop in the evaluator.
+type Break struct{}
+
+func (b Break) Type() ObjectType { return BREAK_OBJ }
+func (b Break) Inspect() string  { return "break" }
+
+type Continue struct{}
+
+func (c Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c Continue) Inspect() string  { return "continue" }
+
+// The types of errors, as seen in the "type" of a caught error.
+const (
+	RUNTIME_ERROR  = "RuntimeError"
+	TYPE_ERROR     = "TypeError"
+	ARGUMENT_ERROR = "ArgumentError"
+	VALUE_ERROR    = "ValueError"
+)
+
+// Error is a failure or a thrown value on its way to a catch clause.
 type Error struct {
 	Message string
+	Kind    string // RUNTIME_ERROR if empty
+	// Thrown is the value of a throw statement, nil for failures.
+	Thrown Object
+	// Limit is set when a limit stopped the run. Such an error is not
+	// caught.
+	Limit LimitError
 }
 
 func (e Error) Type() ObjectType { return ERROR_OBJ }
 func (e Error) Inspect() string  { return e.Message }
 
+func (e *Error) Error() string { return e.Message }
+
+// Caught returns the value a catch clause binds: the thrown value, or a
+// hash with the "message" and "type" of a failure.
+func (e *Error) Caught() Object {
+	if e.Thrown != nil {
+		return e.Thrown
+	}
+	kind := e.Kind
+	if kind == "" {
+		kind = RUNTIME_ERROR
+	}
+	caught := &Hash{}
+	caught.Set(&String{Value: "message"}, &String{Value: e.Message})
+	caught.Set(&String{Value: "type"}, &String{Value: kind})
+	return caught
+}
+
+// Throw returns the error for throw value. Rethrowing a caught failure
+// keeps its message and type.
+func Throw(value Object) *Error {
+	err := &Error{Message: "uncaught exception: " + value.Inspect(), Thrown: value}
+	if hash, ok := value.(*Hash); ok {
+		if message, ok := hash.Get(&String{Value: "message"}); ok && message.Type() == STRING_OBJ {
+			err.Message = message.Inspect()
+		}
+		if kind, ok := hash.Get(&String{Value: "type"}); ok && kind.Type() == STRING_OBJ {
+			err.Kind = kind.Inspect()
+		}
+	}
+	return err
+}
+
 type Function struct {
 	Parameters  []*ast.Identifier
 	Body        *ast.BlockStatement
@@ -121,10 +214,17 @@ func (f Function) Inspect() string {
 	return out.String()
 }
 
-type BuiltinFunction func(args ...Object) Object
+// BuiltinFunction returns a nil Object for null. A failure is returned as
+// an error, usually an *Error that gives its kind.
+type BuiltinFunction func(args ...Object) (Object, error)
 
 type Builtin struct {
-	Fn BuiltinFunction
+	Name string
+	Fn   BuiltinFunction
+	// Allocates is set when Fn returns a new array, hash or string, which
+	// counts against the allocation limit. first and last, which return an
+	// element or a one-character string, do not count.
+	Allocates bool
 }
 
 func (f Builtin) Type() ObjectType { return BUILTIN_OBJ }
@@ -153,15 +253,20 @@ type HashPair struct {
 	Value Object
 }
 
+// Hash keeps its pairs in insertion order. Keys are found by their HashKey
+// and then compared with Equal, so keys whose hashes collide stay apart.
+// The zero Hash is empty and ready to use.
 type Hash struct {
-	Pairs map[HashKey]HashPair
+	pairs   []HashPair        // in insertion order, deleted pairs have a nil Key
+	index   map[HashKey][]int // positions in pairs by hash key
+	deleted int
 }
 
 func (h Hash) Type() ObjectType { return HASH_OBJ }
 func (h Hash) Inspect() string {
 	var out bytes.Buffer
 	pairs := []string{}
-	for _, v := range h.Pairs {
+	for _, v := range h.Pairs() {
 		pairs = append(pairs, fmt.Sprintf("%s: %s", v.Key.Inspect(), v.Value.Inspect()))
 	}
 	out.WriteString("{")
@@ -170,15 +275,118 @@ func (h Hash) Inspect() string {
 	return out.String()
 }
 
+// Len returns the number of pairs in the hash.
+func (h *Hash) Len() int {
+	return len(h.pairs) - h.deleted
+}
+
+// Pairs returns the pairs of the hash in insertion order.
+func (h *Hash) Pairs() []HashPair {
+	pairs := make([]HashPair, 0, h.Len())
+	for _, p := range h.pairs {
+		if p.Key != nil {
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+// find returns the position of key in h.pairs, or -1.
+func (h *Hash) find(key Hashable) int {
+	for _, pos := range h.index[key.HashKey()] {
+		if Equal(h.pairs[pos].Key, key) {
+			return pos
+		}
+	}
+	return -1
+}
+
+func (h *Hash) Get(key Hashable) (Object, bool) {
+	pos := h.find(key)
+	if pos < 0 {
+		return nil, false
+	}
+	return h.pairs[pos].Value, true
+}
+
+// Set adds a pair at the end of the hash, or replaces the value of an
+// existing key in place.
+func (h *Hash) Set(key Hashable, value Object) {
+	if pos := h.find(key); pos >= 0 {
+		h.pairs[pos].Value = value
+		return
+	}
+	if h.index == nil {
+		h.index = map[HashKey][]int{}
+	}
+	hk := key.HashKey()
+	h.index[hk] = append(h.index[hk], len(h.pairs))
+	h.pairs = append(h.pairs, HashPair{Key: key, Value: value})
+}
+
+// Delete removes key from the hash and returns the value it had.
+func (h *Hash) Delete(key Hashable) (Object, bool) {
+	pos := h.find(key)
+	if pos < 0 {
+		return nil, false
+	}
+	value := h.pairs[pos].Value
+	h.pairs[pos] = HashPair{}
+	h.deleted++
+
+	hk := key.HashKey()
+	bucket := h.index[hk]
+	for i, p := range bucket {
+		if p == pos {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(h.index, hk)
+	} else {
+		h.index[hk] = bucket
+	}
+
+	if h.deleted > len(h.pairs)/2 {
+		h.compact()
+	}
+	return value, true
+}
+
+// compact drops deleted pairs and rebuilds the index.
+func (h *Hash) compact() {
+	pairs := h.Pairs()
+	h.pairs = h.pairs[:0]
+	h.index = map[HashKey][]int{}
+	h.deleted = 0
+	for _, p := range pairs {
+		hk := p.Key.(Hashable).HashKey()
+		h.index[hk] = append(h.index[hk], len(h.pairs))
+		h.pairs = append(h.pairs, p)
+	}
+}
+
 type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	Name          string
+	Positions     code.PositionTable
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
 func (cf *CompiledFunction) Inspect() string  { return fmt.Sprintf("CompiledFunction[%p]", cf) }
 
+// Cell holds a local variable that is captured by a closure, so that the
+// function and all of its closures share the variable.
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string  { return c.Value.Inspect() }
+
 type Closure struct {
 	Fn   *CompiledFunction
 	Free []Object
@@ -186,3 +394,98 @@ type Closure struct {
 
 func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
 func (c *Closure) Inspect() string  { return fmt.Sprintf("Clsoure[%p]", c) }
+
+// ResolveIndex turns index into a position in a sequence of the given
+// length. Negative indexes count from the end, so -1 is the last element.
+// ok is false when the index is out of range.
+func ResolveIndex(index int64, length int) (int, bool) {
+	if index < 0 {
+		index += int64(length)
+	}
+	if index < 0 || index >= int64(length) {
+		return 0, false
+	}
+	return int(index), true
+}
+
+// Slice implements left[start:end] for arrays and strings. Omitted bounds
+// are nil or NULL. Like in Python, negative bounds count from the end and
+// bounds outside the sequence are clamped, so slicing never fails on range.
+func Slice(left, start, end Object) (Object, error) {
+	var length int
+	switch left := left.(type) {
+	case *Array:
+		length = len(left.Items)
+	case *String:
+		length = len(left.Value)
+	default:
+		return nil, fmt.Errorf("slice operator not supported: %s", left.Type())
+	}
+
+	from, err := sliceBound(start, 0, length)
+	if err != nil {
+		return nil, err
+	}
+	to, err := sliceBound(end, length, length)
+	if err != nil {
+		return nil, err
+	}
+	if to < from {
+		to = from
+	}
+
+	if s, ok := left.(*String); ok {
+		return &String{Value: s.Value[from:to]}, nil
+	}
+	items := make([]Object, to-from)
+	copy(items, left.(*Array).Items[from:to])
+	return &Array{Items: items}, nil
+}
+
+func sliceBound(bound Object, omitted, length int) (int, error) {
+	if bound == nil || bound.Type() == NULL_OBJ {
+		return omitted, nil
+	}
+	i, ok := bound.(*Integer)
+	if !ok {
+		return 0, fmt.Errorf("slice index must be INTEGER, got %s", bound.Type())
+	}
+	b := i.Value
+	if b < 0 {
+		b += int64(length)
+	}
+	if b < 0 {
+		return 0, nil
+	}
+	if b > int64(length) {
+		return length, nil
+	}
+	return int(b), nil
+}
+
+// SetIndex implements left[index] = value for arrays and hashes. Both are
+// changed in place.
+func SetIndex(left, index, value Object) error {
+	switch left := left.(type) {
+	case *Array:
+		i, ok := index.(*Integer)
+		if !ok {
+			return fmt.Errorf("array index must be INTEGER, got %s", index.Type())
+		}
+		idx, ok := ResolveIndex(i.Value, len(left.Items))
+		if !ok {
+			return fmt.Errorf("index out of range: %d (length %d)", i.Value, len(left.Items))
+		}
+		left.Items[idx] = value
+		return nil
+	case *Hash:
+		key, ok := index.(Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+		left.Set(key, value)
+		return nil
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+}
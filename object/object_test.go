@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
@@ -21,3 +24,191 @@ func TestStringHashKey(t *testing.T) {
 	}
 
 }
+
+func TestNumberHashKey(t *testing.T) {
+	tests := []struct {
+		a, b Hashable
+	}{
+		{&Integer{Value: 1}, &Float{Value: 1}},
+		{&Integer{Value: 0}, &Float{Value: math.Copysign(0, -1)}},
+		{&Float{Value: 0}, &Float{Value: math.Copysign(0, -1)}},
+		{&Integer{Value: -7}, &Float{Value: -7}},
+		{&Integer{Value: 1<<53 + 1}, &Float{Value: 1 << 53}},
+		{&Integer{Value: math.MaxInt64}, &Float{Value: math.MaxInt64}},
+		{&Float{Value: math.Inf(1)}, &Float{Value: math.Inf(1)}},
+	}
+	for _, tt := range tests {
+		if !Equal(tt.a, tt.b) {
+			t.Fatalf("%s == %s is false", tt.a.Inspect(), tt.b.Inspect())
+		}
+		if tt.a.HashKey() != tt.b.HashKey() {
+			t.Errorf("%s and %s are == but have different hash keys", tt.a.Inspect(), tt.b.Inspect())
+		}
+	}
+
+	if (&Float{Value: 1.5}).HashKey() == (&Integer{Value: 1}).HashKey() {
+		t.Errorf("1.5 and 1 have the same hash key")
+	}
+
+	h := &Hash{}
+	h.Set(&Integer{Value: 2}, &String{Value: "two"})
+	h.Set(&Float{Value: 2}, &String{Value: "2.0"})
+	if h.Len() != 1 {
+		t.Errorf("2 and 2.0 are different keys. got %d pairs", h.Len())
+	}
+	if v, ok := h.Get(&Float{Value: 2}); !ok || v.Inspect() != "2.0" {
+		t.Errorf("wrong value for 2.0. got=%v", v)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	one := &Integer{Value: 1}
+	str := func(s string) *String { return &String{Value: s} }
+	arr := func(items ...Object) *Array { return &Array{Items: items} }
+	hash := func(key *String, value Object) *Hash {
+		h := &Hash{}
+		h.Set(key, value)
+		return h
+	}
+	self := arr(one)
+	self.Items = append(self.Items, self)
+	other := arr(one)
+	other.Items = append(other.Items, other)
+
+	tests := []struct {
+		a, b     Object
+		expected bool
+	}{
+		{one, &Integer{Value: 1}, true},
+		{one, &Float{Value: 1}, true},
+		{&Float{Value: math.NaN()}, &Float{Value: math.NaN()}, false},
+		{str("a"), str("a"), true},
+		{str("a"), str("b"), false},
+		{str("1"), one, false},
+		{&Null{}, &Null{}, true},
+		{&Null{}, &Boolean{Value: false}, false},
+		{arr(one, str("a")), arr(&Integer{Value: 1}, str("a")), true},
+		{arr(one), arr(one, one), false},
+		{arr(arr(one)), arr(arr(&Float{Value: 1})), true},
+		{hash(str("k"), arr(one)), hash(str("k"), arr(one)), true},
+		{hash(str("k"), one), hash(str("j"), one), false},
+		{hash(str("k"), one), arr(one), false},
+		{self, other, true},
+	}
+
+	for i, tt := range tests {
+		if Equal(tt.a, tt.b) != tt.expected {
+			t.Errorf("tests[%d]: Equal wrong. want=%t", i, tt.expected)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	arr := func(items ...int64) *Array {
+		a := &Array{}
+		for _, i := range items {
+			a.Items = append(a.Items, &Integer{Value: i})
+		}
+		return a
+	}
+
+	tests := []struct {
+		a, b     Object
+		expected int
+		ok       bool
+	}{
+		{&Integer{Value: 1}, &Integer{Value: 2}, -1, true},
+		{&Float{Value: 2.5}, &Integer{Value: 2}, 1, true},
+		{&String{Value: "abc"}, &String{Value: "abd"}, -1, true},
+		{&String{Value: "b"}, &String{Value: "abc"}, 1, true},
+		{&String{Value: "ab"}, &String{Value: "ab"}, 0, true},
+		{arr(1, 2), arr(1, 3), -1, true},
+		{arr(1, 2), arr(1), 1, true},
+		{arr(), arr(), 0, true},
+		{&String{Value: "a"}, &Integer{Value: 1}, 0, false},
+		{&Boolean{Value: true}, &Boolean{Value: false}, 0, false},
+		{&Array{Items: []Object{&String{Value: "a"}}}, arr(1), 0, false},
+	}
+
+	for i, tt := range tests {
+		result, ok := Compare(tt.a, tt.b)
+		if result != tt.expected || ok != tt.ok {
+			t.Errorf("tests[%d]: Compare(%s, %s) wrong. want=(%d, %t), got=(%d, %t)",
+				i, tt.a.Inspect(), tt.b.Inspect(), tt.expected, tt.ok, result, ok)
+		}
+	}
+}
+
+// collidingKey is a string key whose hash always collides.
+type collidingKey struct{ *String }
+
+func (k collidingKey) HashKey() HashKey { return HashKey{Type: STRING_OBJ, Value: 42} }
+
+func TestHashCollisions(t *testing.T) {
+	a := collidingKey{&String{Value: "a"}}
+	b := collidingKey{&String{Value: "b"}}
+	h := &Hash{}
+	h.Set(a, &Integer{Value: 1})
+	h.Set(b, &Integer{Value: 2})
+
+	if h.Len() != 2 {
+		t.Fatalf("colliding keys overwrote each other. len=%d", h.Len())
+	}
+	for key, want := range map[collidingKey]int64{a: 1, b: 2} {
+		value, ok := h.Get(key)
+		if !ok || value.(*Integer).Value != want {
+			t.Errorf("wrong value for %s. want=%d, got=%v", key.Value, want, value)
+		}
+	}
+
+	h.Delete(a)
+	if _, ok := h.Get(a); ok {
+		t.Errorf("deleted key still present")
+	}
+	if value, ok := h.Get(b); !ok || value.(*Integer).Value != 2 {
+		t.Errorf("deleting a colliding key lost the other one. got=%v", value)
+	}
+}
+
+func TestHashOrder(t *testing.T) {
+	h := &Hash{}
+	for i := 0; i < 10; i++ {
+		h.Set(&Integer{Value: int64(9 - i)}, &Integer{Value: int64(i)})
+	}
+	for i := 0; i < 8; i++ {
+		h.Delete(&Integer{Value: int64(i)})
+	}
+	h.Set(&Integer{Value: 9}, &String{Value: "nine"})
+	h.Set(&Integer{Value: 0}, &String{Value: "zero"})
+
+	if h.Inspect() != "{9: nine, 8: 1, 0: zero}" {
+		t.Errorf("wrong order. got=%s", h.Inspect())
+	}
+	if h.Len() != 3 || len(h.pairs) >= 10 {
+		t.Errorf("deleted pairs were not compacted. len=%d, pairs=%d", h.Len(), len(h.pairs))
+	}
+}
+
+func TestThrowAndCatch(t *testing.T) {
+	failure := &Error{Message: "bad argument", Kind: TYPE_ERROR}
+	caught := failure.Caught()
+	if caught.Inspect() != "{message: bad argument, type: TypeError}" {
+		t.Errorf("wrong caught value. got=%s", caught.Inspect())
+	}
+
+	rethrown := Throw(caught)
+	if rethrown.Message != "bad argument" || rethrown.Kind != TYPE_ERROR {
+		t.Errorf("rethrow lost message or type. got=%q %q", rethrown.Message, rethrown.Kind)
+	}
+	if rethrown.Caught() != caught {
+		t.Errorf("rethrow did not keep the thrown value")
+	}
+
+	thrown := Throw(&Integer{Value: 1})
+	if thrown.Message != "uncaught exception: 1" || thrown.Caught().Inspect() != "1" {
+		t.Errorf("wrong thrown error. got=%q", thrown.Message)
+	}
+	if (&Error{Message: "x"}).Caught().Inspect() != "{message: x, type: RuntimeError}" {
+		t.Errorf("failure without kind is not a RuntimeError")
+	}
+}
@@ -18,28 +18,43 @@ type (
 const (
 	_ int = iota
 	LOWEST
+	ASSIGNMENT  // = += -= *= /= &= |=
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
 	EQUALS      // == AND !=
 	LESSGREATER // < > <= >=
 	SUM         // +
 	PRODUCT
 	PREFIX
 	CALL
-	INDEX // array[index]
+	INDEX   // array[index]
+	POSTFIX // x++ x--
 )
 
 var precedences = map[token.TokenType]int{
-	token.EQ:       EQUALS,
-	token.NOT_EQ:   EQUALS,
-	token.LT:       LESSGREATER,
-	token.GT:       LESSGREATER,
-	token.LT_EQ:    LESSGREATER,
-	token.GT_EQ:    LESSGREATER,
-	token.PLUS:     SUM,
-	token.MINUS:    SUM,
-	token.SLASH:    PRODUCT,
-	token.ASTERISK: PRODUCT,
-	token.LPAREN:   CALL,
-	token.LBRACKET: INDEX,
+	token.ASSIGN:      ASSIGNMENT,
+	token.ASSIGNPLUS:  ASSIGNMENT,
+	token.ASSIGNMINUS: ASSIGNMENT,
+	token.ASSIGNTIMES: ASSIGNMENT,
+	token.ASSIGNSLASH: ASSIGNMENT,
+	token.ASSIGNAND:   ASSIGNMENT,
+	token.ASSIGNOR:    ASSIGNMENT,
+	token.OR:          LOGICAL_OR,
+	token.AND:         LOGICAL_AND,
+	token.EQ:          EQUALS,
+	token.NOT_EQ:      EQUALS,
+	token.LT:          LESSGREATER,
+	token.GT:          LESSGREATER,
+	token.LT_EQ:       LESSGREATER,
+	token.GT_EQ:       LESSGREATER,
+	token.PLUS:        SUM,
+	token.MINUS:       SUM,
+	token.SLASH:       PRODUCT,
+	token.ASTERISK:    PRODUCT,
+	token.LPAREN:      CALL,
+	token.LBRACKET:    INDEX,
+	token.PLUSPLUS:    POSTFIX,
+	token.MINUSMINUS:  POSTFIX,
 }
 
 type Parser struct {
@@ -64,6 +79,7 @@ func New(l *lexer.Lexer) *Parser {
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBooleanExpression)
@@ -71,12 +87,15 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
-	p.registerPrefix(token.PLUSPLUS, p.parsePrefixExpression)
-	p.registerPrefix(token.MINUSMINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.PLUSPLUS, p.parseIncrementExpression)
+	p.registerPrefix(token.MINUSMINUS, p.parseIncrementExpression)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
 	p.registerPrefix(token.FOR, p.parseForLoop)
+	p.registerPrefix(token.WHILE, p.parseWhileLoop)
+	p.registerPrefix(token.TRY, p.parseTryExpression)
+	p.registerPrefix(token.ILLEGAL, p.parseIllegal)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -89,6 +108,17 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.ASSIGN, p.parseAssignExpression)
+	p.registerInfix(token.ASSIGNPLUS, p.parseAssignExpression)
+	p.registerInfix(token.ASSIGNMINUS, p.parseAssignExpression)
+	p.registerInfix(token.ASSIGNTIMES, p.parseAssignExpression)
+	p.registerInfix(token.ASSIGNSLASH, p.parseAssignExpression)
+	p.registerInfix(token.ASSIGNAND, p.parseAssignExpression)
+	p.registerInfix(token.ASSIGNOR, p.parseAssignExpression)
+	p.registerInfix(token.PLUSPLUS, p.parsePostfixIncrementExpression)
+	p.registerInfix(token.MINUSMINUS, p.parsePostfixIncrementExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
 
@@ -103,6 +133,9 @@ func (p *Parser) Errors() []string { return p.errors }
 func (p *Parser) nextToken() {
 	p.currToken = p.peekToken
 	p.peekToken = p.lexer.NextToken()
+	for p.peekToken.Type == token.COMMENT {
+		p.peekToken = p.lexer.NextToken()
+	}
 	// fmt.Printf("CurrentToken %+v", p.currToken)
 }
 
@@ -119,7 +152,16 @@ func (p *Parser) currTokenIs(t token.TokenType) bool { return p.currToken.Type =
 func (p *Parser) peekTokenIs(t token.TokenType) bool { return p.peekToken.Type == t }
 
 func (p *Parser) peekError(t token.TokenType) {
-	msg := fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type)
+	if p.peekTokenIs(token.ILLEGAL) {
+		p.errorf(p.peekToken.Pos, "%s", p.peekToken.Literal)
+		return
+	}
+	p.errorf(p.peekToken.Pos, "expected next token to be %s, got %s instead", t, p.peekToken.Type)
+}
+
+// errorf records a parser error prefixed with the file:line:col of pos.
+func (p *Parser) errorf(pos token.Position, format string, a ...interface{}) {
+	msg := fmt.Sprintf("%s:%s: %s", p.lexer.Filename(), pos, fmt.Sprintf(format, a...))
 	p.errors = append(p.errors, msg)
 }
 
@@ -142,12 +184,32 @@ func (p *Parser) parseStatement() ast.Statement {
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.THROW:
+		return p.parseThrowStatement()
+	case token.BREAK:
+		s := &ast.BreakStatement{Token: p.currToken}
+		p.skipSemicolons()
+		return s
+	case token.CONTINUE:
+		s := &ast.ContinueStatement{Token: p.currToken}
+		p.skipSemicolons()
+		return s
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
 func (p *Parser) parseLetStatement() *ast.LetStatement {
+	s := p.parseLetBinding()
+	for p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return s
+}
+
+// parseLetBinding parses let <name> = <expression> without consuming the
+// semicolons that may follow it.
+func (p *Parser) parseLetBinding() *ast.LetStatement {
 	s := &ast.LetStatement{Token: p.currToken}
 	if !p.expectPeek(token.IDENT) {
 		return nil
@@ -161,11 +223,13 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	if fl, ok := s.Value.(*ast.FunctionLiteral); ok {
 		fl.Name = s.Name.Value
 	}
+	return s
+}
+
+func (p *Parser) skipSemicolons() {
 	for p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
-
-	return s
 }
 
 func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
@@ -178,6 +242,14 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return s
 }
 
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	s := &ast.ThrowStatement{Token: p.currToken}
+	p.nextToken()
+	s.Value = p.parseExpression(LOWEST)
+	p.skipSemicolons()
+	return s
+}
+
 func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 	s := &ast.ExpressionStatement{Token: p.currToken}
 
@@ -190,8 +262,7 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 }
 
 func (p *Parser) noPrefixParseFnFound(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errors = append(p.errors, msg)
+	p.errorf(p.currToken.Pos, "no prefix parse function for %s found", t)
 }
 
 func (p *Parser) parseExpression(predence int) ast.Expression {
@@ -215,6 +286,12 @@ func (p *Parser) parseExpression(predence int) ast.Expression {
 	return leftExpr
 }
 
+// parseIllegal reports the lexer error carried by an ILLEGAL token.
+func (p *Parser) parseIllegal() ast.Expression {
+	p.errorf(p.currToken.Pos, "%s", p.currToken.Literal)
+	return nil
+}
+
 func (p *Parser) parseIdentifier() ast.Expression {
 	return &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal}
 }
@@ -223,8 +300,18 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	lit := &ast.IntegerLiteral{Token: p.currToken}
 	value, err := strconv.ParseInt(p.currToken.Literal, 0, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.currToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.errorf(p.currToken.Pos, "could not parse %q as integer", p.currToken.Literal)
+		return nil
+	}
+	lit.Value = value
+	return lit
+}
+
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	lit := &ast.FloatLiteral{Token: p.currToken}
+	value, err := strconv.ParseFloat(p.currToken.Literal, 64)
+	if err != nil {
+		p.errorf(p.currToken.Pos, "could not parse %q as float", p.currToken.Literal)
 		return nil
 	}
 	lit.Value = value
@@ -263,6 +350,70 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	return ie
 }
 
+func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
+	if target, ok := left.(*ast.IndexExpression); ok {
+		return p.parseIndexAssignExpression(target)
+	}
+	name, ok := left.(*ast.Identifier)
+	if !ok {
+		if left != nil {
+			p.errorf(p.currToken.Pos, "cannot assign to %s", left.String())
+		}
+		return nil
+	}
+	ae := &ast.AssignExpression{
+		Token:    p.currToken,
+		Name:     name,
+		Operator: p.currToken.Literal,
+	}
+	p.nextToken()
+	// parse the right side with a lower precedence so that a = b = c groups
+	// as a = (b = c)
+	ae.Value = p.parseExpression(LOWEST)
+	return ae
+}
+
+func (p *Parser) parseIndexAssignExpression(target *ast.IndexExpression) ast.Expression {
+	if p.currToken.Type != token.ASSIGN {
+		p.errorf(p.currToken.Pos, "cannot use %s on %s", p.currToken.Literal, target.String())
+		return nil
+	}
+	ia := &ast.IndexAssignExpression{Token: p.currToken, Target: target}
+	p.nextToken()
+	ia.Value = p.parseExpression(LOWEST)
+	return ia
+}
+
+func (p *Parser) parseIncrementExpression() ast.Expression {
+	ie := &ast.IncrementExpression{
+		Token:    p.currToken,
+		Operator: p.currToken.Literal,
+	}
+	p.nextToken()
+	value := p.parseExpression(PREFIX)
+	if _, ok := value.(*ast.Identifier); !ok {
+		if value != nil {
+			p.errorf(ie.Token.Pos, "cannot apply %s to %s", ie.Operator, value.String())
+		}
+		return nil
+	}
+	ie.Value = value
+	return ie
+}
+
+func (p *Parser) parsePostfixIncrementExpression(left ast.Expression) ast.Expression {
+	if _, ok := left.(*ast.Identifier); !ok {
+		p.errorf(p.currToken.Pos, "cannot apply %s to %s", p.currToken.Literal, left.String())
+		return nil
+	}
+	return &ast.IncrementExpression{
+		Token:    p.currToken,
+		Value:    left,
+		Operator: p.currToken.Literal,
+		Postfix:  true,
+	}
+}
+
 func (p *Parser) parseGroupedExpression() ast.Expression {
 	p.nextToken()
 	e := p.parseExpression(LOWEST)
@@ -310,22 +461,46 @@ func (p *Parser) parseIfExpression() ast.Expression {
 	return expr
 }
 
-// not ready
 func (p *Parser) parseForLoop() ast.Expression {
 	expr := &ast.ForLoop{Token: p.currToken}
 	if !p.expectPeek(token.LPAREN) {
 		return nil
 	}
 	p.nextToken()
-	expr.Initialization = p.parseLetStatement()
-	// if !p.expectPeek(token.SEMICOLON) {
-	// 	return nil
-	// }
-	expr.Test = p.parseExpression(LOWEST)
-	// if !p.expectPeek(token.SEMICOLON) {
-	// 	return nil
-	// }
-	expr.Update = p.parseLetStatement()
+	if !p.currTokenIs(token.SEMICOLON) {
+		expr.Initialization = p.parseForClause()
+		if expr.Initialization == nil || !p.expectPeek(token.SEMICOLON) {
+			return nil
+		}
+	}
+	p.nextToken()
+	if !p.currTokenIs(token.SEMICOLON) {
+		expr.Test = p.parseExpression(LOWEST)
+		if !p.expectPeek(token.SEMICOLON) {
+			return nil
+		}
+	}
+	p.nextToken()
+	if !p.currTokenIs(token.RPAREN) {
+		expr.Update = p.parseForClause()
+		if expr.Update == nil || !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expr.Block = p.parseBlockStatement()
+	return expr
+}
+
+func (p *Parser) parseWhileLoop() ast.Expression {
+	expr := &ast.WhileLoop{Token: p.currToken}
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.nextToken()
+	expr.Condition = p.parseExpression(LOWEST)
 	if !p.expectPeek(token.RPAREN) {
 		return nil
 	}
@@ -336,6 +511,54 @@ func (p *Parser) parseForLoop() ast.Expression {
 	return expr
 }
 
+func (p *Parser) parseTryExpression() ast.Expression {
+	expr := &ast.TryExpression{Token: p.currToken}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	expr.Block = p.parseBlockStatement()
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+		if !p.expectPeek(token.LPAREN) || !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		expr.Parameter = &ast.Identifier{Token: p.currToken, Value: p.currToken.Literal}
+		if !p.expectPeek(token.RPAREN) || !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expr.Catch = p.parseBlockStatement()
+	}
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		expr.Finally = p.parseBlockStatement()
+	}
+	if expr.Catch == nil && expr.Finally == nil {
+		p.errorf(expr.Token.Pos, "try without catch or finally")
+		return nil
+	}
+	return expr
+}
+
+// parseForClause parses the initialization or update clause of a for loop:
+// a let binding or an expression, without a trailing semicolon.
+func (p *Parser) parseForClause() ast.Statement {
+	if p.currTokenIs(token.LET) {
+		if s := p.parseLetBinding(); s != nil {
+			return s
+		}
+		return nil
+	}
+	s := &ast.ExpressionStatement{Token: p.currToken}
+	s.Expression = p.parseExpression(LOWEST)
+	if s.Expression == nil {
+		return nil
+	}
+	return s
+}
+
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	bs := &ast.BlockStatement{Token: p.currToken}
 	bs.Statements = []ast.Statement{}
@@ -351,7 +574,7 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 }
 
 func (p *Parser) parseFunctionLiteral() ast.Expression {
-	fn := &ast.FunctionLiteral{}
+	fn := &ast.FunctionLiteral{Token: p.currToken}
 	if !p.expectPeek(token.LPAREN) {
 		return nil
 	}
@@ -417,13 +640,34 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 }
 
 func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
-	ie := &ast.IndexExpression{Token: p.currToken, Left: left}
-	p.nextToken()
-	ie.Index = p.parseExpression(LOWEST)
+	tok := p.currToken
+	var index ast.Expression
+	if !p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		index = p.parseExpression(LOWEST)
+	}
+	if p.peekTokenIs(token.COLON) {
+		p.nextToken()
+		return p.parseSliceExpression(tok, left, index)
+	}
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
-	return ie
+	return &ast.IndexExpression{Token: tok, Left: left, Index: index}
+}
+
+// parseSliceExpression parses the rest of left[start:end] after the colon.
+// Either bound may be left out.
+func (p *Parser) parseSliceExpression(tok token.Token, left, start ast.Expression) ast.Expression {
+	se := &ast.SliceExpression{Token: tok, Left: left, Start: start}
+	if !p.peekTokenIs(token.RBRACKET) {
+		p.nextToken()
+		se.End = p.parseExpression(LOWEST)
+	}
+	if !p.expectPeek(token.RBRACKET) {
+		return nil
+	}
+	return se
 }
 
 func (p *Parser) parseHashLiteral() ast.Expression {
@@ -438,6 +682,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 		p.nextToken()
 		value := p.parseExpression(LOWEST)
 		hash.Pairs[key] = value
+		hash.Keys = append(hash.Keys, key)
 		if !p.peekTokenIs(token.RBRACE) && !p.expectPeek(token.COMMA) {
 			return nil
 		}
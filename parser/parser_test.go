@@ -167,6 +167,34 @@ func TestIntegerLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	input := "3.25;"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program has not enough statements. got=%d", len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+
+	literal, ok := stmt.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+	}
+	if literal.Value != 3.25 {
+		t.Errorf("literal.Value not %f. got=%f", 3.25, literal.Value)
+	}
+	if literal.TokenLiteral() != "3.25" {
+		t.Errorf("literal.TokenLiteral not %s. got=%s", "3.25", literal.TokenLiteral())
+	}
+}
+
 func TestParsingPrefixExpressions(t *testing.T) {
 	prefixTests := []struct {
 		input    string
@@ -177,7 +205,6 @@ func TestParsingPrefixExpressions(t *testing.T) {
 		{"-15;", "-", 15},
 		{"!true;", "!", true},
 		{"!false;", "!", false},
-		{"--i", "--", "i"},
 	}
 
 	for _, tt := range prefixTests {
@@ -335,6 +362,8 @@ func TestParsingInfixExpressions(t *testing.T) {
 		{"true == true;", true, "==", true},
 		{"true != false;", true, "!=", false},
 		{"false == false;", false, "==", false},
+		{"true && false;", true, "&&", false},
+		{"false || true;", false, "||", true},
 	}
 
 	for _, tt := range infixTests {
@@ -369,6 +398,18 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"-a * b",
 			"((-a) * b)",
 		},
+		{
+			"a || b && c",
+			"(a || (b && c))",
+		},
+		{
+			"a && b || c && d",
+			"((a && b) || (c && d))",
+		},
+		{
+			"a < b && b == c || !d",
+			"(((a < b) && (b == c)) || (!d))",
+		},
 		{
 			"!-a",
 			"(!(-a))",
@@ -519,10 +560,8 @@ func TestIfExpression(t *testing.T) {
 	}
 }
 
-// not ready
 func TestForLoopExpression(t *testing.T) {
-	t.Skip()
-	input := `for (let i = 0; i < 10; i = i + 1; ) { x = x + i; }`
+	input := `for (let i = 0; i < 10; i += 1) { x = x + i; }`
 	l := lexer.New(input)
 	p := New(l)
 	program := p.ParseProgram()
@@ -544,16 +583,196 @@ func TestForLoopExpression(t *testing.T) {
 	if !testLetStatement(t, exp.Initialization, "i") {
 		return
 	}
-	if !testInfixExpression(t, exp.Test, "i", "<", "10") {
+	if !testInfixExpression(t, exp.Test, "i", "<", 10) {
 		return
 	}
-	if !testLetStatement(t, exp.Update, "i") {
+	update, ok := exp.Update.(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("exp.Update is not ast.ExpressionStatement. got=%T", exp.Update)
+	}
+	if !testAssignExpression(t, update.Expression, "i", "+=", 1) {
 		return
 	}
 	if len(exp.Block.Statements) != 1 {
 		t.Errorf("consequence is not 1 statements. got=%d\n", len(exp.Block.Statements))
 	}
+	if exp.String() != "for(let i = 0; (i < 10); i += 1){x = (x + i)}" {
+		t.Errorf("exp.String() wrong. got=%q", exp.String())
+	}
+}
+
+func TestForLoopEmptyClauses(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"for (;;) { x }", "for(; ; ){x}"},
+		{"for (; i < 3;) { x }", "for(; (i < 3); ){x}"},
+		{"for (i = 0; ; i = i + 1) { x }", "for(i = 0; ; i = (i + 1)){x}"},
+	}
 
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestWhileLoopExpression(t *testing.T) {
+	input := `while (x < 10) { if (x == 5) { break; } x += 1; continue; }`
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain %d statements. got=%d\n", 1, len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+	}
+	exp, ok := stmt.Expression.(*ast.WhileLoop)
+	if !ok {
+		t.Fatalf("stmt.Expression is not ast.WhileLoop. got=%T", stmt.Expression)
+	}
+	if !testInfixExpression(t, exp.Condition, "x", "<", 10) {
+		return
+	}
+	if len(exp.Block.Statements) != 3 {
+		t.Fatalf("block is not 3 statements. got=%d\n", len(exp.Block.Statements))
+	}
+	if _, ok := exp.Block.Statements[2].(*ast.ContinueStatement); !ok {
+		t.Errorf("exp.Block.Statements[2] is not ast.ContinueStatement. got=%T", exp.Block.Statements[2])
+	}
+	if exp.String() != "while((x < 10)){if (x == 5) break;x += 1continue;}" {
+		t.Errorf("exp.String() wrong. got=%q", exp.String())
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		name     string
+		operator string
+		value    interface{}
+	}{
+		{"x = 5;", "x", "=", 5},
+		{"x += 1;", "x", "+=", 1},
+		{"x -= y;", "x", "-=", "y"},
+		{"x *= 2;", "x", "*=", 2},
+		{"x /= 2;", "x", "/=", 2},
+		{"x &= true;", "x", "&=", true},
+		{"x |= y;", "x", "|=", "y"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d", len(program.Statements))
+		}
+		stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+		if !ok {
+			t.Fatalf("program.Statements[0] is not ast.ExpressionStatement. got=%T", program.Statements[0])
+		}
+		testAssignExpression(t, stmt.Expression, tt.name, tt.operator, tt.value)
+	}
+
+	l := lexer.New("a = b = 1 + 2")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	if program.String() != "a = b = (1 + 2)" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+
+	l = lexer.New("1 + 2 = 3")
+	p = New(l)
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || p.Errors()[0] != "<input>:1:7: cannot assign to (1 + 2)" {
+		t.Errorf("wrong parser errors. got=%q", p.Errors())
+	}
+}
+
+func TestIncrementExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		operator string
+		postfix  bool
+		expected string
+	}{
+		{"++i", "++", false, "++i"},
+		{"--i", "--", false, "--i"},
+		{"i++", "++", true, "i++"},
+		{"i--;", "--", true, "i--"},
+		{"-i++", "++", true, "(-i++)"},
+		{"x = i++ + 1", "++", true, "x = (i++ + 1)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		if program.String() != tt.expected {
+			t.Errorf("program.String() wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	l := lexer.New("i++")
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	ie, ok := stmt.Expression.(*ast.IncrementExpression)
+	if !ok {
+		t.Fatalf("exp is not ast.IncrementExpression. got=%T", stmt.Expression)
+	}
+	if ie.Operator != "++" || !ie.Postfix {
+		t.Errorf("wrong increment expression. operator=%q, postfix=%t", ie.Operator, ie.Postfix)
+	}
+	testIdentifier(t, ie.Value, "i")
+
+	errorTests := []struct {
+		input    string
+		expected string
+	}{
+		{"5++", "<input>:1:2: cannot apply ++ to 5"},
+		{"--(a + b)", "<input>:1:1: cannot apply -- to (a + b)"},
+	}
+	for _, tt := range errorTests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		if len(p.Errors()) == 0 || p.Errors()[0] != tt.expected {
+			t.Errorf("wrong parser errors for %q. got=%q", tt.input, p.Errors())
+		}
+	}
+}
+
+func testAssignExpression(t *testing.T, exp ast.Expression, name string, operator string, value interface{}) bool {
+	ae, ok := exp.(*ast.AssignExpression)
+	if !ok {
+		t.Errorf("exp is not ast.AssignExpression. got=%T(%s)", exp, exp)
+		return false
+	}
+	if !testIdentifier(t, ae.Name, name) {
+		return false
+	}
+	if ae.Operator != operator {
+		t.Errorf("exp.Operator is not '%s'. got=%q", operator, ae.Operator)
+		return false
+	}
+	return testLiteralExpression(t, ae.Value, value)
 }
 
 func TestIfElseExpression(t *testing.T) {
@@ -837,6 +1056,109 @@ func TestParsingIndexExpressions(t *testing.T) {
 
 }
 
+func TestParsingSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"arr[1:2]", "(arr[1:2])"},
+		{"arr[:2]", "(arr[:2])"},
+		{"arr[1:]", "(arr[1:])"},
+		{"arr[:]", "(arr[:])"},
+		{"arr[-1:a + 1][0]", "((arr[(-1):(a + 1)])[0])"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		if program.String() != tt.expected {
+			t.Errorf("program.String() wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+		if tt.input == "arr[1:]" {
+			se, ok := stmt.Expression.(*ast.SliceExpression)
+			if !ok {
+				t.Fatalf("exp not ast.SliceExpression. got=%T", stmt.Expression)
+			}
+			testIdentifier(t, se.Left, "arr")
+			testIntegerLiteral(t, se.Start, 1)
+			if se.End != nil {
+				t.Errorf("se.End is not nil. got=%s", se.End)
+			}
+		}
+	}
+}
+
+func TestParsingIndexAssignExpressions(t *testing.T) {
+	input := "arr[1] = x = 2"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	ia, ok := stmt.Expression.(*ast.IndexAssignExpression)
+	if !ok {
+		t.Fatalf("exp not ast.IndexAssignExpression. got=%T", stmt.Expression)
+	}
+	testIdentifier(t, ia.Target.Left, "arr")
+	testIntegerLiteral(t, ia.Target.Index, 1)
+	testAssignExpression(t, ia.Value, "x", "=", 2)
+	if program.String() != "arr[1] = x = 2" {
+		t.Errorf("program.String() wrong. got=%q", program.String())
+	}
+
+	p = New(lexer.New("arr[1] += 2"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || p.Errors()[0] != "<input>:1:8: cannot use += on (arr[1])" {
+		t.Errorf("wrong parser errors. got=%q", p.Errors())
+	}
+}
+
+func TestTryExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		catch    bool
+		finally  bool
+		expected string
+	}{
+		{"try { x } catch (e) { e }", true, false, "try{x}catch(e){e}"},
+		{"try { x } finally { y }", false, true, "try{x}finally{y}"},
+		{"try { throw x; } catch (e) { throw e } finally { y }", true, true, "try{throw x;}catch(e){throw e;}finally{y}"},
+	}
+
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		te, ok := stmt.Expression.(*ast.TryExpression)
+		if !ok {
+			t.Fatalf("exp not ast.TryExpression. got=%T", stmt.Expression)
+		}
+		if (te.Catch != nil) != tt.catch || (te.Finally != nil) != tt.finally {
+			t.Errorf("wrong clauses for %q. catch=%v, finally=%v", tt.input, te.Catch != nil, te.Finally != nil)
+		}
+		if tt.catch {
+			testIdentifier(t, te.Parameter, "e")
+		}
+		if program.String() != tt.expected {
+			t.Errorf("program.String() wrong. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+
+	p := New(lexer.New("try { x }"))
+	p.ParseProgram()
+	if len(p.Errors()) == 0 || p.Errors()[0] != "<input>:1:1: try without catch or finally" {
+		t.Errorf("wrong parser errors. got=%q", p.Errors())
+	}
+}
+
 func TestParsingHashLiteralsStringKeys(t *testing.T) {
 	input := `{"one": 1, "two": 2, "three": 3}`
 
@@ -969,3 +1291,86 @@ func TestFunctionLiteralWithName(t *testing.T) {
 			function.Name)
 	}
 }
+
+func TestParserErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x 5;", "test.monkey:1:7: expected next token to be =, got INT instead"},
+		{"let x = 1;\nlet y = add(1, 2;", "test.monkey:2:17: expected next token to be ), got ; instead"},
+		{"let x = 1;\n  )", "test.monkey:2:3: no prefix parse function for ) found"},
+		{"let x = 1; /* oops", "test.monkey:1:12: unterminated block comment"},
+		{"let x = @;", "test.monkey:1:9: unexpected character '@'"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewWithFilename(tt.input, "test.monkey")
+		p := New(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Fatalf("expected parser errors for %q, got none", tt.input)
+		}
+		if p.Errors()[0] != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, p.Errors()[0])
+		}
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	input := "let add = fn(a, b) {\n  a + b;\n};\nadd(1, 2);"
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	let := program.Statements[0].(*ast.LetStatement)
+	fn := let.Value.(*ast.FunctionLiteral)
+	body := fn.Body.Statements[0].(*ast.ExpressionStatement)
+	infix := body.Expression.(*ast.InfixExpression)
+	call := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.CallExpression)
+
+	tests := []struct {
+		node     ast.Node
+		expected string
+	}{
+		{program, "1:1"},
+		{let, "1:1"},
+		{let.Name, "1:5"},
+		{fn, "1:11"},
+		{fn.Parameters[1], "1:17"},
+		{body, "2:3"},
+		{infix, "2:5"},
+		{call, "4:4"},
+		{call.Arguments[0], "4:5"},
+	}
+
+	for i, tt := range tests {
+		if tt.node.Pos().String() != tt.expected {
+			t.Errorf("tests[%d] - %s: wrong position. want=%s, got=%s",
+				i, tt.node.String(), tt.expected, tt.node.Pos())
+		}
+	}
+}
+
+func TestParsingWithComments(t *testing.T) {
+	input := `// a comment
+let x = /* inline */ 5; // trailing
+x;`
+
+	l := lexer.New(input)
+	l.EmitComments(true)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("program.Statements does not contain 2 statements. got=%d", len(program.Statements))
+	}
+	if !testLetStatement(t, program.Statements[0], "x") {
+		return
+	}
+	testLiteralExpression(t, program.Statements[0].(*ast.LetStatement).Value, 5)
+}
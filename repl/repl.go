@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"demeulder.us/monkey/compiler"
 	"demeulder.us/monkey/evaluator"
@@ -20,7 +21,7 @@ func Start(in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 	// environment := object.NewEnvironment(nil)
 	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalsSize)
+	var globals []object.Object
 	symbolTable := compiler.NewSymbolTable()
 	for i, v := range object.Builtins {
 		symbolTable.DefineBuiltin(i, v.Name)
@@ -59,6 +60,7 @@ func Start(in io.Reader, out io.Writer) {
 
 		machine := vm.NewWithGlobalsStore(comp.Bytecode(), globals)
 		err = machine.Run()
+		globals = machine.Globals()
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
 			continue
@@ -78,7 +80,7 @@ func InterpretFile(fname string) {
 		io.WriteString(os.Stderr, err.Error())
 	}
 
-	l := lexer.New(string(b))
+	l := lexer.NewWithFilename(string(b), fname)
 	p := parser.New(l)
 	program := p.ParseProgram()
 
@@ -95,6 +97,77 @@ func InterpretFile(fname string) {
 	}
 }
 
+// BuildFile compiles the Monkey program in the file src and writes its
+// bytecode to the file out, in the .mbc format.
+func BuildFile(src, out string) error {
+	bc, _, err := loadFile(src)
+	if err != nil {
+		return err
+	}
+	data, err := bc.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out, data, 0644)
+}
+
+// RunFile runs a .mbc file, or compiles and runs a Monkey program, on the VM
+// and writes the value of the last expression statement to out.
+func RunFile(fname string, out io.Writer) error {
+	bc, _, err := loadFile(fname)
+	if err != nil {
+		return err
+	}
+	machine := vm.New(bc)
+	err = machine.Run()
+	if err != nil {
+		return err
+	}
+	if result := machine.LastPoppedStackElement(); result != nil {
+		fmt.Fprintf(out, "%s\n", result.Inspect())
+	}
+	return nil
+}
+
+// DisassembleFile writes a listing of the bytecode of a .mbc file, or of a
+// Monkey program, to out.
+func DisassembleFile(fname string, out io.Writer) error {
+	bc, source, err := loadFile(fname)
+	if err != nil {
+		return err
+	}
+	return bc.Disassemble(out, source)
+}
+
+// loadFile returns the bytecode of a .mbc file, or compiles the Monkey
+// program in fname and returns its bytecode and source.
+func loadFile(fname string) (*compiler.Bytecode, string, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, "", err
+	}
+	if strings.HasSuffix(fname, ".mbc") {
+		bc := &compiler.Bytecode{}
+		err = bc.UnmarshalBinary(b)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %s", fname, err)
+		}
+		return bc, "", nil
+	}
+
+	p := parser.New(lexer.NewWithFilename(string(b), fname))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, "", fmt.Errorf("parse errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+	}
+	comp := compiler.New()
+	err = comp.Compile(program)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %s", fname, err)
+	}
+	return comp.Bytecode(), string(b), nil
+}
+
 func printParserErrors(out io.Writer, errors []string) {
 	for _, e := range errors {
 		io.WriteString(out, fmt.Sprintf("\t%s\n", e))
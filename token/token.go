@@ -1,17 +1,40 @@
 package token
 
+import "fmt"
+
 type TokenType string
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Pos     Position
+}
+
+// Position is the location of a token in the source input. Line and Column
+// start at 1, Column counts bytes. Offset is the 0-based byte offset.
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+// IsValid reports whether the position was set by the lexer.
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 const (
 	ILLEGAL     = "ILLEGAL"
 	EOF         = "EOF"
+	COMMENT     = "COMMENT"
 	IDENT       = "IDENT"
 	INT         = "INT"
+	FLOAT       = "FLOAT"
 	ASSIGN      = "="
 	PLUS        = "+"
 	MINUS       = "-"
@@ -52,17 +75,31 @@ const (
 	ASSIGNAND   = "&="
 	ASSIGNOR    = "|="
 	FOR         = "FOR"
+	WHILE       = "WHILE"
+	BREAK       = "BREAK"
+	CONTINUE    = "CONTINUE"
+	TRY         = "TRY"
+	CATCH       = "CATCH"
+	FINALLY     = "FINALLY"
+	THROW       = "THROW"
 )
 
 var keywords = map[string]TokenType{
-	"let":    LET,
-	"fn":     FUNCTION,
-	"true":   TRUE,
-	"false":  FALSE,
-	"return": RETURN,
-	"if":     IF,
-	"else":   ELSE,
-	"for":    FOR,
+	"let":      LET,
+	"fn":       FUNCTION,
+	"true":     TRUE,
+	"false":    FALSE,
+	"return":   RETURN,
+	"if":       IF,
+	"else":     ELSE,
+	"for":      FOR,
+	"while":    WHILE,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"try":      TRY,
+	"catch":    CATCH,
+	"finally":  FINALLY,
+	"throw":    THROW,
 }
 
 func LookupIdent(s string) TokenType {
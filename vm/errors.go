@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+
+	"demeulder.us/monkey/token"
+)
+
+// RuntimeError wraps an error raised while running bytecode with the source
+// position of the failing instruction and the Monkey call stack at that point.
+type RuntimeError struct {
+	Err   error
+	Pos   token.Position
+	Trace []TraceEntry // innermost call first
+}
+
+// TraceEntry is one frame of a RuntimeError's call stack.
+type TraceEntry struct {
+	Function string
+	Pos      token.Position
+}
+
+// maxTraceLines bounds the lines of the call stack that Error shows: it
+// keeps the innermost and the outermost ones.
+const maxTraceLines = 20
+
+// Error shows the call stack with each run of identical entries, as deep
+// recursion leaves, on one line.
+func (e *RuntimeError) Error() string {
+	var lines []string
+	for i := 0; i < len(e.Trace); {
+		j := i + 1
+		for j < len(e.Trace) && e.Trace[j] == e.Trace[i] {
+			j++
+		}
+		lines = append(lines, fmt.Sprintf("\n\tat %s (%s)", e.Trace[i].Function, e.Trace[i].Pos))
+		if j-i > 1 {
+			lines = append(lines, fmt.Sprintf("\n\t... repeated %d more times", j-i-1))
+		}
+		i = j
+	}
+	if len(lines) > maxTraceLines {
+		omitted := fmt.Sprintf("\n\t... %d more lines", len(lines)-maxTraceLines)
+		lines = append(append(lines[:maxTraceLines/2:maxTraceLines/2], omitted), lines[len(lines)-maxTraceLines/2:]...)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "%s: %s", e.Pos, e.Err)
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+	return out.String()
+}
+
+func (e *RuntimeError) Unwrap() error { return e.Err }
+
+// StackOverflowError is returned when a run needs more stack slots or
+// frames than the VM has.
+type StackOverflowError struct {
+	Depth    int // the number of calls in progress, 0 at the top level
+	Function string
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("stack overflow at depth %d in function %s", e.Depth, e.Function)
+}
+
+// runtimeError annotates err with the position and call stack of the
+// instruction each active frame is executing.
+func (vm *VirtualMachine) runtimeError(err error) *RuntimeError {
+	trace := make([]TraceEntry, 0, vm.framesIndex)
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		trace = append(trace, TraceEntry{
+			Function: frameName(frame, i),
+			Pos:      frame.Position(),
+		})
+	}
+	return &RuntimeError{Err: err, Pos: trace[0].Pos, Trace: trace}
+}
+
+func frameName(f *Frame, index int) string {
+	switch {
+	case index == 0:
+		return "<main>"
+	case f.cl.Fn.Name == "":
+		return "<anonymous>"
+	default:
+		return f.cl.Fn.Name
+	}
+}
@@ -3,6 +3,7 @@ package vm
 import (
 	"demeulder.us/monkey/code"
 	"demeulder.us/monkey/object"
+	"demeulder.us/monkey/token"
 )
 
 type Frame struct {
@@ -18,3 +19,8 @@ func NewFrame(c *object.Closure, basePointer int) *Frame {
 func (f *Frame) Instructions() code.Instructions {
 	return f.cl.Fn.Instructions
 }
+
+// Position returns the source position of the instruction at ip.
+func (f *Frame) Position() token.Position {
+	return f.cl.Fn.Positions.Lookup(f.ip)
+}
@@ -1,6 +1,8 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 
 	"demeulder.us/monkey/code"
@@ -8,9 +10,17 @@ import (
 	"demeulder.us/monkey/object"
 )
 
-const StackSize = 2048
+// The default caps of a VM. The stack, frames and globals start small and
+// grow on demand up to these sizes.
+const StackSize = 1 << 20
 const GlobalsSize = 65536
-const MaxFrames = 1025
+const MaxFrames = 1 << 16
+
+// The sizes a VM starts with.
+const (
+	initialStackSize = 64
+	initialFrames    = 8
+)
 
 var True = &object.Boolean{Value: true}
 var False = &object.Boolean{Value: false}
@@ -25,45 +35,155 @@ type VirtualMachine struct {
 	stack   []object.Object
 	sp      int // always point to the next element in the stack, top of the stack is stack[sp-1]
 	globals []object.Object
+
+	config Config // the caps of the stack, frames and globals
+
+	handlers []handler // the installed try handlers, innermost last
+
+	// Limits bound every run of the VM.
+	Limits object.Limits
+	meter  *object.Meter // nil when the run has nothing to check
+}
+
+// handler is installed by OpTry. An error unwinds the frames and the stack
+// back to where it was installed and continues at catch, with the caught
+// value on the stack.
+type handler struct {
+	framesIndex int
+	sp          int
+	catch       int
+}
+
+// Config caps the memory of a VM. Zero fields take the defaults StackSize,
+// MaxFrames and GlobalsSize.
+type Config struct {
+	MaxStack   int // the number of stack slots
+	MaxFrames  int // the number of frames, including the top level
+	MaxGlobals int // the number of global slots
 }
 
 func New(bc *compiler.Bytecode) *VirtualMachine {
-	mainFn := &object.CompiledFunction{Instructions: bc.Instructions}
+	return NewWithConfig(bc, Config{})
+}
+
+func NewWithConfig(bc *compiler.Bytecode, config Config) *VirtualMachine {
+	if config.MaxStack <= 0 {
+		config.MaxStack = StackSize
+	}
+	if config.MaxFrames <= 0 {
+		config.MaxFrames = MaxFrames
+	}
+	if config.MaxGlobals <= 0 {
+		config.MaxGlobals = GlobalsSize
+	}
+	mainFn := &object.CompiledFunction{Instructions: bc.Instructions, Positions: bc.Positions}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
-	frames := make([]*Frame, MaxFrames)
+	frames := make([]*Frame, 1, initialFrames)
 	frames[0] = mainFrame
 	return &VirtualMachine{
 		constants: bc.Constants,
 
-		stack: make([]object.Object, StackSize),
+		stack: make([]object.Object, growSize(0, initialStackSize, config.MaxStack)),
 		sp:    0,
 
-		globals: make([]object.Object, GlobalsSize),
+		config: config,
 
 		frames:      frames,
 		framesIndex: 1,
 	}
 }
 
+// NewWithGlobalsStore returns a VM that starts with the globals s. The VM
+// may outgrow s; Globals returns the current store.
 func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VirtualMachine {
 	vm := New(bytecode)
 	vm.globals = s
 	return vm
 }
 
+// Globals returns the global slots, to carry them over to another VM.
+func (vm *VirtualMachine) Globals() []object.Object {
+	return vm.globals
+}
+
+// Run executes the bytecode. Errors that no try expression catches are
+// returned as *RuntimeError.
 func (vm *VirtualMachine) Run() error {
+	return vm.RunContext(context.Background())
+}
 
+// RunContext executes the bytecode like Run, within vm.Limits and until ctx
+// is done. When a limit is hit the *RuntimeError wraps one of the
+// LimitError types of package object.
+func (vm *VirtualMachine) RunContext(ctx context.Context) error {
+	if vm.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vm.Limits.Timeout)
+		defer cancel()
+	}
+	vm.meter = object.NewMeter(ctx, vm.Limits)
+	defer func() { vm.meter = nil }()
+	if vm.meter != nil {
+		if err := vm.meter.Done(); err != nil {
+			return vm.runtimeError(err)
+		}
+	}
+
+	for {
+		err := vm.run()
+		if err == nil {
+			return nil
+		}
+		if !vm.catch(err) {
+			return vm.runtimeError(err)
+		}
+	}
+}
+
+// catch hands err to the innermost handler and reports whether there was
+// one.
+func (vm *VirtualMachine) catch(err error) bool {
+	var limit object.LimitError
+	if len(vm.handlers) == 0 || errors.As(err, &limit) {
+		return false
+	}
+	h := vm.handlers[len(vm.handlers)-1]
+	vm.handlers = vm.handlers[:len(vm.handlers)-1]
+	vm.framesIndex = h.framesIndex
+	vm.sp = h.sp
+	vm.currentFrame().ip = h.catch - 1
+
+	var thrown *object.Error
+	if !errors.As(err, &thrown) {
+		thrown = &object.Error{Message: err.Error()}
+	}
+	return vm.push(thrown.Caught()) == nil
+}
+
+func (vm *VirtualMachine) run() error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
 		vm.currentFrame().ip++
+		if vm.meter != nil {
+			if err := vm.meter.Step(); err != nil {
+				return err
+			}
+		}
 
 		ip = vm.currentFrame().ip
 		ins = vm.currentFrame().Instructions()
 		op = code.Opcode(ins[ip])
+		// the operands after the OpWide prefix are twice as wide
+		wide := op == code.OpWide
+		if wide {
+			ip++
+			vm.currentFrame().ip = ip
+			op = code.Opcode(ins[ip])
+		}
 
 		switch op {
 		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
@@ -87,8 +207,7 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 		case code.OpConstant:
-			constindex := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+			constindex := vm.readUint16(ins, ip, wide)
 			err := vm.push(vm.constants[constindex])
 			if err != nil {
 				return err
@@ -106,11 +225,10 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 		case code.OpJump:
-			pos := int(code.ReadUint16(ins[ip+1:]))
+			pos := vm.readUint16(ins, ip, wide)
 			vm.currentFrame().ip = pos - 1
 		case code.OpJumpNotTruthy:
-			pos := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			pos := vm.readUint16(ins, ip, wide)
 			conditionValue := vm.pop()
 			if !isTruthy(conditionValue) {
 				vm.currentFrame().ip = pos - 1
@@ -121,47 +239,51 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 		case code.OpSetGlobal:
-			idx := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
+			idx := vm.readUint16(ins, ip, wide)
+			if idx >= len(vm.globals) {
+				err := vm.growGlobals(idx + 1)
+				if err != nil {
+					return err
+				}
+			}
 			vm.globals[idx] = vm.pop()
 		case code.OpGetGlobal:
-			idx := code.ReadUint16(ins[ip+1:])
-			vm.currentFrame().ip += 2
-			err := vm.push(vm.globals[idx])
+			idx := vm.readUint16(ins, ip, wide)
+			var global object.Object
+			if idx < len(vm.globals) {
+				global = vm.globals[idx]
+			}
+			err := vm.push(global)
 			if err != nil {
 				return err
 			}
 		case code.OpSetLocal:
-			idx := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+			idx := vm.readUint8(ins, ip, wide)
 			frame := vm.currentFrame()
-			vm.stack[frame.BasePointer+int(idx)] = vm.pop()
+			vm.stack[frame.BasePointer+idx] = vm.pop()
 		case code.OpGetLocal:
-			idx := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
+			idx := vm.readUint8(ins, ip, wide)
 			frame := vm.currentFrame()
-			err := vm.push(vm.stack[frame.BasePointer+int(idx)])
+			err := vm.push(vm.stack[frame.BasePointer+idx])
 			if err != nil {
 				return err
 			}
 		case code.OpArray:
-			len := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			len := vm.readUint16(ins, ip, wide)
 			arr := vm.buildArray(vm.sp-len, vm.sp)
 			vm.sp = vm.sp - len
-			err := vm.push(arr)
+			err := vm.pushAllocated(arr)
 			if err != nil {
 				return err
 			}
 		case code.OpHash:
-			numElements := int(code.ReadUint16(ins[ip+1:]))
-			vm.currentFrame().ip += 2
+			numElements := vm.readUint16(ins, ip, wide)
 			hash, err := vm.buildHash(vm.sp-numElements, vm.sp)
 			if err != nil {
 				return err
 			}
 			vm.sp = vm.sp - numElements
-			err = vm.push(hash)
+			err = vm.pushAllocated(hash)
 			if err != nil {
 				return err
 			}
@@ -172,15 +294,49 @@ func (vm *VirtualMachine) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSlice:
+			end := vm.pop()
+			start := vm.pop()
+			left := vm.pop()
+			result, err := object.Slice(left, start, end)
+			if err != nil {
+				return err
+			}
+			err = vm.pushAllocated(result)
+			if err != nil {
+				return err
+			}
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+			err := object.SetIndex(left, index, value)
+			if err != nil {
+				return err
+			}
+			err = vm.push(value)
+			if err != nil {
+				return err
+			}
 		case code.OpCall:
-			numArgs := int(code.ReadUint8(ins[ip+1:]))
-			vm.currentFrame().ip += 1
+			numArgs := vm.readUint8(ins, ip, wide)
 			err := vm.exectuteCall(numArgs)
 			if err != nil {
 				return err
 			}
+		case code.OpTailCall:
+			numArgs := vm.readUint8(ins, ip, wide)
+			err := vm.executeTailCall(numArgs)
+			if err != nil {
+				return err
+			}
 		case code.OpReturnValue:
 			returnValue := vm.pop()
+			if vm.framesIndex == 1 {
+				// a return statement of the main program ends it, and
+				// its value is the last popped
+				return nil
+			}
 			frame := vm.popFrame()
 			vm.sp = frame.BasePointer - 1
 			err := vm.push(returnValue)
@@ -188,6 +344,13 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 		case code.OpReturn:
+			if vm.framesIndex == 1 {
+				if err := vm.push(Null); err != nil {
+					return err
+				}
+				vm.pop()
+				return nil
+			}
 			frame := vm.popFrame()
 			vm.sp = frame.BasePointer - 1
 			err := vm.push(Null)
@@ -195,29 +358,72 @@ func (vm *VirtualMachine) Run() error {
 				return err
 			}
 		case code.OpGetBuiltin:
-			builtinIndex := int(code.ReadUint8(ins[ip+1:]))
-			vm.currentFrame().ip += 1
+			builtinIndex := vm.readUint8(ins, ip, wide)
 			definition := object.Builtins[builtinIndex]
 			err := vm.push(definition.Builtin)
 			if err != nil {
 				return err
 			}
 		case code.OpClosure:
-			constIndex := code.ReadUint16((ins[ip+1:]))
-			numFree := code.ReadUint8(ins[ip+3:])
-			vm.currentFrame().ip += 3
-			err := vm.pushClosure(int(constIndex), int(numFree))
+			constIndex := vm.readUint16(ins, ip, wide)
+			numFree := vm.readUint8(ins, vm.currentFrame().ip, wide)
+			err := vm.pushClosure(constIndex, numFree)
 			if err != nil {
 				return err
 			}
 		case code.OpGetFree:
-			idx := code.ReadUint8(ins[ip+1:])
-			vm.currentFrame().ip += 1
-			currentClosure := vm.currentFrame().cl
-			err := vm.push(currentClosure.Free[idx])
+			idx := vm.readUint8(ins, ip, wide)
+			free := vm.currentFrame().cl.Free[idx]
+			if cell, ok := free.(*object.Cell); ok {
+				free = cell.Value
+			}
+			err := vm.push(free)
+			if err != nil {
+				return err
+			}
+		case code.OpSetFree:
+			idx := vm.readUint8(ins, ip, wide)
+			cell, ok := vm.currentFrame().cl.Free[idx].(*object.Cell)
+			if !ok {
+				return fmt.Errorf("free variable %d is not assignable", idx)
+			}
+			cell.Value = vm.pop()
+		case code.OpCaptureFree:
+			idx := vm.readUint8(ins, ip, wide)
+			err := vm.push(vm.currentFrame().cl.Free[idx])
+			if err != nil {
+				return err
+			}
+		case code.OpBoxLocal:
+			idx := vm.readUint8(ins, ip, wide)
+			slot := vm.currentFrame().BasePointer + idx
+			vm.stack[slot] = &object.Cell{Value: vm.stack[slot]}
+		case code.OpGetLocalCell:
+			idx := vm.readUint8(ins, ip, wide)
+			cell, ok := vm.stack[vm.currentFrame().BasePointer+idx].(*object.Cell)
+			if !ok {
+				return fmt.Errorf("local %d is not captured", idx)
+			}
+			err := vm.push(cell.Value)
 			if err != nil {
 				return err
 			}
+		case code.OpSetLocalCell:
+			idx := vm.readUint8(ins, ip, wide)
+			slot := vm.currentFrame().BasePointer + idx
+			// the first definition creates the cell, redefinitions share it
+			if cell, ok := vm.stack[slot].(*object.Cell); ok {
+				cell.Value = vm.pop()
+			} else {
+				vm.stack[slot] = &object.Cell{Value: vm.pop()}
+			}
+		case code.OpTry:
+			catch := vm.readUint16(ins, ip, wide)
+			vm.handlers = append(vm.handlers, handler{framesIndex: vm.framesIndex, sp: vm.sp, catch: catch})
+		case code.OpEndTry:
+			vm.handlers = vm.handlers[:len(vm.handlers)-1]
+		case code.OpThrow:
+			return object.Throw(vm.pop())
 		case code.OpCurrentClosure:
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure)
@@ -229,6 +435,13 @@ func (vm *VirtualMachine) Run() error {
 	return nil
 }
 
+func nativeBoolToBooleanObject(value bool) *object.Boolean {
+	if value {
+		return True
+	}
+	return False
+}
+
 func isTruthy(obj object.Object) bool {
 	switch obj := obj.(type) {
 	case *object.Boolean:
@@ -252,13 +465,60 @@ func (vm *VirtualMachine) exectuteCall(numArgs int) error {
 	}
 }
 
+// executeTailCall makes a call in tail position. A closure replaces the
+// function of the current frame, so that tail calls run in constant space.
+// Other callees are called like OpCall does, and the instructions after
+// OpTailCall return their result.
+func (vm *VirtualMachine) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok {
+		return vm.exectuteCall(numArgs)
+	}
+	if cl.Fn.NumParameters != numArgs {
+		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
+	}
+	frame := vm.currentFrame()
+	if frame.BasePointer+cl.Fn.NumLocals > len(vm.stack) {
+		if !vm.growStack(frame.BasePointer + cl.Fn.NumLocals) {
+			return &StackOverflowError{Depth: vm.framesIndex - 1, Function: frameName(frame, vm.framesIndex-1)}
+		}
+	}
+	// move the callee and its arguments over those of the current call
+	copy(vm.stack[frame.BasePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+	frame.cl = cl
+	frame.ip = -1
+	vm.sp = frame.BasePointer + cl.Fn.NumLocals
+	for i := frame.BasePointer + numArgs; i < vm.sp; i++ {
+		vm.stack[i] = nil
+	}
+	return nil
+}
+
 func (vm *VirtualMachine) callFunction(cl *object.Closure, numArgs int) error {
 	if cl.Fn.NumParameters != numArgs {
 		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", cl.Fn.NumParameters, numArgs)
 	}
+	if vm.meter != nil {
+		if err := vm.meter.CallDepth(vm.framesIndex); err != nil {
+			return err
+		}
+	}
 	frame := NewFrame(cl, vm.sp-numArgs)
-	vm.pushFrame(frame)
+	if frame.BasePointer+cl.Fn.NumLocals > len(vm.stack) {
+		if !vm.growStack(frame.BasePointer + cl.Fn.NumLocals) {
+			return &StackOverflowError{Depth: vm.framesIndex, Function: frameName(frame, vm.framesIndex)}
+		}
+	}
+	err := vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
 	vm.sp = frame.BasePointer + cl.Fn.NumLocals
+	// clear what earlier calls left in the local slots, so that
+	// OpSetLocalCell never mistakes an old cell for one of this call
+	for i := frame.BasePointer + numArgs; i < vm.sp; i++ {
+		vm.stack[i] = nil
+	}
 	return nil
 }
 
@@ -274,19 +534,23 @@ func (vm *VirtualMachine) pushClosure(constIndex int, numFree int) error {
 	}
 	vm.sp = vm.sp - numFree
 	closure := &object.Closure{Fn: function, Free: free}
-	return vm.push(closure)
+	return vm.pushAllocated(closure)
 }
 
 func (vm *VirtualMachine) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
-	result := builtin.Fn(args...)
+	result, err := builtin.Call(args...)
+	if err != nil {
+		return err
+	}
 	vm.sp = vm.sp - numArgs - 1
-	if result != nil {
-		vm.push(result)
-	} else {
-		vm.push(Null)
+	if result == nil {
+		return vm.push(Null)
 	}
-	return nil
+	if builtin.Allocates {
+		return vm.pushAllocated(result)
+	}
+	return vm.push(result)
 }
 
 func (vm *VirtualMachine) executeBangExpression(op code.Opcode) error {
@@ -301,8 +565,11 @@ func (vm *VirtualMachine) executeBangExpression(op code.Opcode) error {
 
 func (vm *VirtualMachine) executeNegationExpression(op code.Opcode) error {
 	operand := vm.pop()
-	if operand.Type() == object.INTEGER_OBJ {
-		return vm.push(&object.Integer{Value: (-1) * operand.(*object.Integer).Value})
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return vm.push(&object.Integer{Value: (-1) * operand.Value})
+	case *object.Float:
+		return vm.push(&object.Float{Value: (-1) * operand.Value})
 	}
 	return fmt.Errorf("unsupported negation operation: -%s", operand.Type())
 }
@@ -315,6 +582,9 @@ func (vm *VirtualMachine) executeBinaryOperation(op code.Opcode) error {
 	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
 		return vm.executeBinaryIntegerOperation(left, right, op)
 	}
+	if isNumber(left) && isNumber(right) {
+		return vm.executeBinaryFloatOperation(left, right, op)
+	}
 	if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
 		return vm.executeBinaryStringOperation(left, right, op)
 	}
@@ -337,6 +607,9 @@ func (vm *VirtualMachine) executeBinaryIntegerOperation(left, right object.Objec
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return &object.Error{Message: "division by zero"}
+		}
 		result = leftValue / rightValue
 	default:
 		return fmt.Errorf("Error, unknown operator")
@@ -345,6 +618,38 @@ func (vm *VirtualMachine) executeBinaryIntegerOperation(left, right object.Objec
 	return vm.push(&object.Integer{Value: result})
 }
 
+// executeBinaryFloatOperation handles float operands, and mixed integer and
+// float operands where the integer is converted to a float first.
+func (vm *VirtualMachine) executeBinaryFloatOperation(left, right object.Object, op code.Opcode) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+	var result float64
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		result = leftValue / rightValue
+	default:
+		return fmt.Errorf("Error, unknown operator")
+	}
+	return vm.push(&object.Float{Value: result})
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	if i, ok := obj.(*object.Integer); ok {
+		return float64(i.Value)
+	}
+	return obj.(*object.Float).Value
+}
+
 func (vm *VirtualMachine) executeBinaryStringOperation(left, right object.Object, op code.Opcode) error {
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
@@ -356,7 +661,7 @@ func (vm *VirtualMachine) executeBinaryStringOperation(left, right object.Object
 		return fmt.Errorf("Error, unknown operator")
 	}
 	// fmt.Printf("%d %d %d = %d\n", leftValue, op, rightValue, result)
-	return vm.push(&object.String{Value: result})
+	return vm.pushAllocated(&object.String{Value: result})
 }
 
 func (vm *VirtualMachine) executeBinaryBooleanOperation(left, right object.Object, op code.Opcode) error {
@@ -371,11 +676,34 @@ func (vm *VirtualMachine) executeComparison(op code.Opcode) error {
 	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
 		return vm.executeBinaryIntegerComparison(left, right, op)
 	}
-	if leftType == object.BOOLEAN_OBJ && rightType == object.BOOLEAN_OBJ {
-		return vm.executeBinaryBooleanComparison(left, right, op)
+	if isNumber(left) && isNumber(right) {
+		return vm.executeBinaryFloatComparison(left, right, op)
+	}
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(object.Equal(left, right)))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(!object.Equal(left, right)))
 	}
 
-	return fmt.Errorf("unsupported types for binary operation: %s %s", leftType, rightType)
+	c, ok := object.Compare(left, right)
+	if !ok {
+		return fmt.Errorf("unsupported types for comparison: %s %s", leftType, rightType)
+	}
+	var result bool
+	switch op {
+	case code.OpGreater:
+		result = c > 0
+	case code.OpGreatorEqual:
+		result = c >= 0
+	case code.OpLess:
+		result = c < 0
+	case code.OpLessEqual:
+		result = c <= 0
+	default:
+		return fmt.Errorf("Error, unknown operator")
+	}
+	return vm.push(nativeBoolToBooleanObject(result))
 }
 
 func (vm *VirtualMachine) executeBinaryIntegerComparison(left, right object.Object, op code.Opcode) error {
@@ -399,20 +727,30 @@ func (vm *VirtualMachine) executeBinaryIntegerComparison(left, right object.Obje
 		return fmt.Errorf("Error, unknown operator")
 	}
 	// fmt.Printf("%d %d %d = %d\n", leftValue, op, rightValue, result)
-	return vm.push(&object.Boolean{Value: result})
+	return vm.push(nativeBoolToBooleanObject(result))
 }
 
-func (vm *VirtualMachine) executeBinaryBooleanComparison(left, right object.Object, op code.Opcode) error {
-	leftValue := left.(*object.Boolean).Value
-	rightValue := right.(*object.Boolean).Value
+func (vm *VirtualMachine) executeBinaryFloatComparison(left, right object.Object, op code.Opcode) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
 	var result bool
-	if op == code.OpEqual {
+	switch op {
+	case code.OpEqual:
 		result = leftValue == rightValue
-	} else {
-		result = !(leftValue == rightValue)
+	case code.OpNotEqual:
+		result = leftValue != rightValue
+	case code.OpGreater:
+		result = leftValue > rightValue
+	case code.OpGreatorEqual:
+		result = leftValue >= rightValue
+	case code.OpLess:
+		result = leftValue < rightValue
+	case code.OpLessEqual:
+		result = leftValue <= rightValue
+	default:
+		return fmt.Errorf("Error, unknown operator")
 	}
-	// return fmt.Errorf("Error, unknown operator")
-	return vm.push(&object.Boolean{Value: result})
+	return vm.push(nativeBoolToBooleanObject(result))
 }
 
 func (vm *VirtualMachine) buildArray(startIdx int, endIdx int) *object.Array {
@@ -424,18 +762,17 @@ func (vm *VirtualMachine) buildArray(startIdx int, endIdx int) *object.Array {
 }
 
 func (vm *VirtualMachine) buildHash(startIdx int, endIdx int) (*object.Hash, error) {
-	hash := make(map[object.HashKey]object.HashPair, endIdx-startIdx)
+	hash := &object.Hash{}
 	for i := startIdx; i < endIdx; i += 2 {
 		key := vm.stack[i]
 		value := vm.stack[i+1]
-		hashPair := object.HashPair{Key: key, Value: value}
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
 			return nil, fmt.Errorf("unusuable as a hash key: %s", key)
 		}
-		hash[hashKey.HashKey()] = hashPair
+		hash.Set(hashKey, value)
 	}
-	return &object.Hash{Pairs: hash}, nil
+	return hash, nil
 }
 
 func (vm *VirtualMachine) executeIndexExpression(left, index object.Object) error {
@@ -445,6 +782,11 @@ func (vm *VirtualMachine) executeIndexExpression(left, index object.Object) erro
 			return fmt.Errorf("array index must be integer")
 		}
 		return vm.executeArrayIndexExpression(left.(*object.Array), index.(*object.Integer))
+	case object.STRING_OBJ:
+		if index.Type() != object.INTEGER_OBJ {
+			return fmt.Errorf("string index must be integer")
+		}
+		return vm.executeStringIndexExpression(left.(*object.String), index.(*object.Integer))
 	case object.HASH_OBJ:
 		hashable, ok := index.(object.Hashable)
 		if !ok {
@@ -458,31 +800,49 @@ func (vm *VirtualMachine) executeIndexExpression(left, index object.Object) erro
 }
 
 func (vm *VirtualMachine) executeArrayIndexExpression(arr *object.Array, index *object.Integer) error {
-	i := index.Value
-	max := int64(len(arr.Items) - 1)
-	if i < 0 || i > max {
+	i, ok := object.ResolveIndex(index.Value, len(arr.Items))
+	if !ok {
 		return vm.push(Null)
 	}
 	return vm.push(arr.Items[i])
 }
 
+func (vm *VirtualMachine) executeStringIndexExpression(str *object.String, index *object.Integer) error {
+	i, ok := object.ResolveIndex(index.Value, len(str.Value))
+	if !ok {
+		return vm.push(Null)
+	}
+	return vm.pushAllocated(&object.String{Value: str.Value[i : i+1]})
+}
+
 func (vm *VirtualMachine) executeHashIndexExpression(hash *object.Hash, key object.Hashable) error {
-	pair, ok := hash.Pairs[key.HashKey()]
+	value, ok := hash.Get(key)
 	if !ok {
 		return vm.push(Null)
 	}
-	return vm.push(pair.Value)
+	return vm.push(value)
 }
 
 func (vm *VirtualMachine) push(obj object.Object) error {
-	if vm.sp > StackSize {
-		return fmt.Errorf("Stack overflow")
+	if vm.sp >= len(vm.stack) && !vm.growStack(vm.sp+1) {
+		return &StackOverflowError{Depth: vm.framesIndex - 1, Function: frameName(vm.currentFrame(), vm.framesIndex-1)}
 	}
 	vm.stack[vm.sp] = obj
 	vm.sp += 1
 	return nil
 }
 
+// pushAllocated pushes a new array, hash, string or closure, counting it
+// against the allocation limit.
+func (vm *VirtualMachine) pushAllocated(obj object.Object) error {
+	if vm.meter != nil {
+		if err := vm.meter.Allocate(); err != nil {
+			return err
+		}
+	}
+	return vm.push(obj)
+}
+
 func (vm *VirtualMachine) pop() object.Object {
 	rv := vm.stack[vm.sp-1]
 	vm.sp -= 1
@@ -500,13 +860,79 @@ func (vm *VirtualMachine) StackTop() object.Object {
 	return vm.stack[vm.sp-1]
 }
 
+// readUint8 reads the 1-byte operand after ip, 2 bytes after OpWide, and
+// moves the ip past it.
+func (vm *VirtualMachine) readUint8(ins code.Instructions, ip int, wide bool) int {
+	if wide {
+		vm.currentFrame().ip += 2
+		return int(code.ReadUint16(ins[ip+1:]))
+	}
+	vm.currentFrame().ip++
+	return int(ins[ip+1])
+}
+
+// readUint16 reads the 2-byte operand after ip, 4 bytes after OpWide, and
+// moves the ip past it.
+func (vm *VirtualMachine) readUint16(ins code.Instructions, ip int, wide bool) int {
+	if wide {
+		vm.currentFrame().ip += 4
+		return int(code.ReadUint32(ins[ip+1:]))
+	}
+	vm.currentFrame().ip += 2
+	return int(code.ReadUint16(ins[ip+1:]))
+}
+
 func (vm *VirtualMachine) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VirtualMachine) pushFrame(f *Frame) {
-	vm.frames[vm.framesIndex] = f
+func (vm *VirtualMachine) pushFrame(f *Frame) error {
+	switch {
+	case vm.framesIndex < len(vm.frames):
+		vm.frames[vm.framesIndex] = f
+	case len(vm.frames) < vm.config.MaxFrames:
+		vm.frames = append(vm.frames, f)
+	default:
+		return &StackOverflowError{Depth: vm.framesIndex, Function: frameName(f, vm.framesIndex)}
+	}
 	vm.framesIndex++
+	return nil
+}
+
+// growStack makes room for at least n stack slots, doubling the stack up
+// to its cap. It reports false when n is over the cap.
+func (vm *VirtualMachine) growStack(n int) bool {
+	if n > vm.config.MaxStack {
+		return false
+	}
+	stack := make([]object.Object, growSize(len(vm.stack), n, vm.config.MaxStack))
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return true
+}
+
+// growSize returns the new size for a slice of size that needs n elements:
+// twice the size or n if that is more, but at most limit.
+func growSize(size, n, limit int) int {
+	size *= 2
+	if size < n {
+		size = n
+	}
+	if size > limit {
+		size = limit
+	}
+	return size
+}
+
+// growGlobals makes room for at least n globals, like growStack.
+func (vm *VirtualMachine) growGlobals(n int) error {
+	if n > vm.config.MaxGlobals {
+		return fmt.Errorf("too many globals: %d, the limit is %d", n, vm.config.MaxGlobals)
+	}
+	globals := make([]object.Object, growSize(len(vm.globals), n, vm.config.MaxGlobals))
+	copy(globals, vm.globals)
+	vm.globals = globals
+	return nil
 }
 
 func (vm *VirtualMachine) popFrame() *Frame {
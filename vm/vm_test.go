@@ -1,11 +1,16 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"demeulder.us/monkey/ast"
 	"demeulder.us/monkey/compiler"
+	"demeulder.us/monkey/evaluator"
 	"demeulder.us/monkey/lexer"
 	"demeulder.us/monkey/object"
 	"demeulder.us/monkey/parser"
@@ -40,6 +45,125 @@ func TestIntegerArithmetic(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"3.5", 3.5},
+		{"-2.5", -2.5},
+		{"1e3", 1000.0},
+		{"0.5 + 0.25", 0.75},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"7 / 2.0", 3.5},
+		{"10 - 2.5 * 2", 5.0},
+		{"float(3) / 2", 1.5},
+		{"int(3.9)", 3},
+		{"1 < 1.5", true},
+		{"2.0 == 2", true},
+		{"3.5 >= 4", false},
+	}
+
+	runVmTests(t, tests)
+}
+
+// TestEnginesAgreeOnNumbers checks that the evaluator and the VM produce the
+// same result for numeric expressions.
+func TestEnginesAgreeOnNumbers(t *testing.T) {
+	inputs := []string{
+		"1 + 2 * 3",
+		"7 / 2",
+		"7 / 2.0",
+		"7.0 / 2",
+		"0.1 + 0.2",
+		"1e300 * 1e300",
+		"-1.5 * 2",
+		"3 - 0.5 < 2.5",
+		"2 == 2.0",
+		"1 != 1.0",
+		"float(1) / 3",
+		"int(10.0 / 4)",
+		"[1.5, 2, 2.5e-3]",
+	}
+
+	testEnginesAgree(t, inputs)
+}
+
+func TestEnginesAgreeOnClosures(t *testing.T) {
+	inputs := []string{
+		"let f = fn() { let n = 0; fn() { n += 1 } }(); f(); f(); f()",
+		"let x = 1; let f = fn() { x }; x = 2; f()",
+		"let g = fn() { let x = 1; let f = fn() { x }; x = 2; f() }; g()",
+		"let g = fn() { let x = 1; let f = fn() { x }; let x = 3; f() }; g()",
+		`let g = fn() {
+			let fs = [];
+			let i = 0;
+			while (i < 3) { let v = i; fs = push(fs, fn() { v }); i++ };
+			[fs[0](), fs[1](), fs[2]()]
+		}; g()`,
+		"let g = fn(a) { let inc = fn() { a++ }; inc(); inc(); a }; g(10)",
+	}
+
+	testEnginesAgree(t, inputs)
+}
+
+func TestEnginesAgreeOnEquality(t *testing.T) {
+	inputs := []string{
+		`"a" == "a"`,
+		`"a" < "b"`,
+		"[1, [2, 3]] == [1, [2, 3.0]]",
+		"[1, 2] > [1]",
+		`{"a": [1]} != {"a": [1]}`,
+		`1 == "1"`,
+		"[1] == {}",
+		"if (false) { 1 } == if (false) { 2 }",
+		"let a = [1]; append(a, a); let b = [1]; append(b, b); a == b",
+	}
+
+	testEnginesAgree(t, inputs)
+}
+
+// TestEnginesAgreeOnReturns checks returns inside expressions, which
+// return from the function, with and without a call as their value.
+func TestEnginesAgreeOnReturns(t *testing.T) {
+	inputs := []string{
+		"let g = fn() { [1, 2] }; let f = fn(c) { len(if (c) { return g() } else { [1] }) }; f(true)",
+		"let g = fn() { [1, 2] }; let f = fn(c) { len(if (c) { return g() } else { [1] }) }; f(false)",
+		"let g = fn() { 7 }; let f = fn(c) { let x = if (c) { return g() } else { 1 }; x + 1 }; f(true)",
+		"let g = fn() { 7 }; let f = fn(c) { 1 + if (c) { return g() } else { 1 } }; f(true)",
+		"let g = fn() { 7 }; let f = fn(c) { [if (c) { return g() } else { 1 }] }; f(true)",
+		"let f = fn(c) { {1: if (c) { return 5 } else { 1 }} }; f(true)",
+		"let f = fn(c) { return len(if (c) { return 5 } else { [] }) }; f(true)",
+		"let g = fn() { 7 }; 1 + if (true) { return g() } else { 1 }",
+	}
+
+	testEnginesAgree(t, inputs)
+}
+
+func testEnginesAgree(t *testing.T, inputs []string) {
+	t.Helper()
+	for _, input := range inputs {
+		program := parse(input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(roundTrip(t, comp.Bytecode()))
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		vmResult := vm.LastPoppedStackElement()
+
+		evalResult := evaluator.Eval(parse(input), object.NewEnvironment(nil))
+
+		if vmResult.Type() != evalResult.Type() || vmResult.Inspect() != evalResult.Inspect() {
+			t.Errorf("engines disagree on %q. vm=%s %s, evaluator=%s %s", input,
+				vmResult.Type(), vmResult.Inspect(), evalResult.Type(), evalResult.Inspect())
+		}
+	}
+}
+
 func TestBooleanExpresssions(t *testing.T) {
 	tests := []vmTestCase{
 		{"true", true},
@@ -69,8 +193,39 @@ func TestBooleanExpresssions(t *testing.T) {
 		{"!!false", false},
 		{"!!5", true},
 		{"!(if (false) { 5; })", true},
+		{`"a" == "a"`, true},
+		{`"a" != "a"`, false},
+		{`"a" == "b"`, false},
+		{`"a" < "b"`, true},
+		{`"abc" >= "abd"`, false},
+		{`"b" > "abc"`, true},
+		{"[1, 2] == [1, 2]", true},
+		{"[1, 2] == [1, 2, 3]", false},
+		{"[1, [2, 3]] == [1, [2, 3]]", true},
+		{"[1, 2] != [2, 1]", true},
+		{"[1, 2] < [1, 3]", true},
+		{"[1, 2] < [1]", false},
+		{"[] <= []", true},
+		{`{"a": [1]} == {"a": [1]}`, true},
+		{`{"a": 1} == {"a": 2}`, false},
+		{`{"a": 1} == {"b": 1}`, false},
+		{"1 == 1.0", true},
+		{`1 == "1"`, false},
+		{`"1" != 1`, true},
+		{"[1] == {}", false},
+		{"true == 1", false},
+		{"if (false) { 1 } == if (false) { 2 }", true},
+		{"if (false) { 1 } == 0", false},
+		{"!(1 == 2)", true},
+		{`!("a" == "b")`, true},
 	}
 	runVmTests(t, tests)
+
+	runVmErrorTests(t, []vmTestCase{
+		{`"a" < 1`, "unsupported types for comparison: STRING INTEGER"},
+		{"true > false", "unsupported types for comparison: BOOLEAN BOOLEAN"},
+		{`[1] < ["a"]`, "unsupported types for comparison: ARRAY ARRAY"},
+	})
 }
 
 func TestConditionals(t *testing.T) {
@@ -89,6 +244,27 @@ func TestConditionals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestLogicalExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || false", false},
+		{"false || true", true},
+		{"true || false", true},
+		{"1 && 2", true},
+		{"0 || false", true},
+		{"if (false) { 1 } || 2 > 1", true},
+		{"1 < 2 && 2 < 3 || false", true},
+		// the right operand would fail if it were evaluated
+		{`false && 1 + "a"`, false},
+		{`true || 1 + "a"`, true},
+		{`let f = fn() { 1 + "a" }; false && f()`, false},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	// t.Skip()
 	tests := []vmTestCase{
@@ -100,12 +276,147 @@ func TestGlobalLetStatements(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestForLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 0; for (let i = 0; i < 10; i += 1) { x = x + i; }; x", 45},
+		{"let x = 1; for (; x < 100;) { x *= 2 }; x", 128},
+		{"let x = 0; for (let i = 0; i < 0; i += 1) { x = 99 }; x", 0},
+		{"for (let i = 0; i < 3; i += 1) { i }", Null},
+		{`
+		let total = 0;
+		for (let i = 0; i < 4; i += 1) {
+			for (let j = 0; j < 3; j += 1) {
+				total += i * j;
+			}
+		}
+		total`, 18},
+		{`
+		let sum = fn(n) {
+			let total = 0;
+			for (let i = 1; i <= n; i += 1) {
+				for (let j = 1; j <= i; j += 1) {
+					total += j;
+				}
+			}
+			total
+		};
+		sum(5)`, 35},
+		{`
+		let find = fn(limit) {
+			for (let i = 0; true; i += 1) {
+				if (i * i > limit) { return i; }
+			}
+		};
+		find(50) + 1`, 9},
+		{`
+		let count = fn() {
+			let n = 0;
+			for (let i = 0; i < 3; i += 1) {
+				let inner = fn() { i * 10 };
+				n += inner();
+			}
+			n
+		};
+		count()`, 30},
+		{"let i = 100; for (let i = 0; i < 3; i += 1) { i }; i", 100},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestWhileLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 0; while (x < 10) { x += 1 }; x", 10},
+		{"let x = 0; while (false) { x = 99 }; x", 0},
+		{"while (false) { 1 }", Null},
+		{"let x = 0; while (true) { x += 1; if (x == 7) { break; } }; x", 7},
+		{`
+		let odd = 0;
+		let i = 0;
+		while (i < 10) {
+			i += 1;
+			if (i / 2 * 2 == i) { continue; }
+			odd += i;
+		}
+		odd`, 25},
+		{`
+		let total = 0;
+		for (let i = 0; i < 5; i += 1) {
+			if (i == 1) { continue; }
+			if (i == 4) { break; }
+			let j = 0;
+			while (true) {
+				j += 1;
+				if (j > i) { break; }
+				total += j;
+			}
+		}
+		total`, 9},
+		{"let f = fn() { let i = 0; while (true) { i += 1; if (i > 3) { return i * 10; } } }; f()", 40},
+		{`
+		let loops = fn(n) {
+			let count = 0;
+			for (let i = 0; i < n; i += 1) {
+				for (let j = 0; j < n; j += 1) {
+					if (j > i) { break; }
+					if (j == 1) { continue; }
+					count += 1;
+				}
+			}
+			count
+		};
+		loops(4)`, 7},
+		// deep iteration that would overflow the frames as recursion
+		{"let n = 0; while (n < 100000) { n += 1 }; n", 100000},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = 1; a = 2; a", 2},
+		{"let a = 1; a = a + 5", 6},
+		{"let a = 1; let b = 2; a = b = 3; a + b", 6},
+		{"let a = 10; a += 5; a -= 3; a *= 2; a /= 4; a", 6},
+		{"let a = 1; let f = fn() { a = 5 }; f(); a", 5},
+		{"let f = fn() { let a = 1; a += 1; a }; f()", 2},
+		{`let s = "a"; s += "b"; s`, "ab"},
+		{"let a = true; a &= false; a", false},
+		{"let a = false; a |= 1; a", true},
+		{"let n = 0; let a = false; a &= fn() { n = 1; true }(); n", 0},
+		{"let a = 1; let a = a + 1; a", 2},
+		{"let f = fn() { let a = 1; let a = a * 3; a }; f()", 3},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIncrementExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = 1; ++a", 2},
+		{"let a = 1; a++", 1},
+		{"let a = 1; a++; a", 2},
+		{"let a = 1; --a", 0},
+		{"let a = 1; a--; a", 0},
+		{"let a = 1; let b = a++ + a; b", 3},
+		{"let f = fn() { let a = 5; a++; ++a }; f()", 7},
+		{"let a = 1.5; a++; a", 2.5},
+		{"let s = 0; for (let i = 0; i < 5; i++) { s += i }; s", 10},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestStringStatements(t *testing.T) {
 	// t.Skip()
 	tests := []vmTestCase{
 		{`"hello";`, "hello"},
 		{`"mon" + "key";`, "monkey"},
 		{`"mon" + "key" + "banana";`, "monkeybanana"},
+		{`"tab\there\n"`, "tab\there\n"},
+		{`"\"quoted\" \\ \u{263A}"`, "\"quoted\" \\ \u263A"},
+		{"`raw\\n\nstring` + \"!\"", "raw\\n\nstring!"},
 	}
 	runVmTests(t, tests)
 }
@@ -153,7 +464,12 @@ func TestIndexExpressions(t *testing.T) {
 		{"[[1, 1, 1]][0][0]", 1},
 		{"[][0]", Null},
 		{"[1, 2, 3][99]", Null},
-		{"[1][-1]", Null},
+		{"[1][-1]", 1},
+		{"[1, 2, 3][-2]", 2},
+		{"[1, 2, 3][-4]", Null},
+		{`"abc"[0]`, "a"},
+		{`"abc"[-1]`, "c"},
+		{`"abc"[3]`, Null},
 		{"{1: 1, 2: 2}[1]", 1},
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
@@ -202,6 +518,14 @@ func TestCallingFunctionsWithoutArguments(t *testing.T) {
 			`,
 			expected: 99,
 		},
+		{
+			input:    `let g = fn() { 3 }; return g(); 4`,
+			expected: 3,
+		},
+		{
+			input:    `let x = 1; try { return x + 1 } finally { x = 5 }; 4`,
+			expected: 2,
+		},
 		{
 			input: `
 	let returnsOne = fn() { 1; };
@@ -381,6 +705,13 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 		},
 	}
 
+	runVmErrorTests(t, tests)
+}
+
+// runVmErrorTests expects each input to stop with a runtime error whose
+// message, without position and trace, is the expected string.
+func runVmErrorTests(t *testing.T, tests []vmTestCase) {
+	t.Helper()
 	for _, tt := range tests {
 		program := parse(tt.input)
 
@@ -390,63 +721,98 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 			t.Fatalf("compiler error: %s", err)
 		}
 
-		vm := New(comp.Bytecode())
+		vm := New(roundTrip(t, comp.Bytecode()))
 		err = vm.Run()
 		if err == nil {
-			t.Fatalf("expected VM error but resulted in none.")
+			t.Fatalf("expected VM error for %q but resulted in none.", tt.input)
 		}
 
-		if err.Error() != tt.expected {
-			t.Fatalf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		rtErr, ok := err.(*RuntimeError)
+		if !ok {
+			t.Fatalf("error is not *RuntimeError. got=%T (%+v)", err, err)
+		}
+		if rtErr.Err.Error() != tt.expected {
+			t.Errorf("wrong VM error for %q: want=%q, got=%q", tt.input, tt.expected, rtErr.Err)
 		}
 	}
 }
 
+func TestRuntimeErrorPositions(t *testing.T) {
+	input := `let one = fn() { 1 + "a" };
+let two = fn() {
+  one();
+  0
+};
+two();`
+
+	program := parse(input)
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(roundTrip(t, comp.Bytecode()))
+	err = vm.Run()
+	if err == nil {
+		t.Fatalf("expected VM error but resulted in none.")
+	}
+
+	expected := "1:20: unsupported types for binary operation: INTEGER STRING" +
+		"\n\tat one (1:20)" +
+		"\n\tat two (3:6)" +
+		"\n\tat <main> (6:4)"
+	if err.Error() != expected {
+		t.Fatalf("wrong VM error:\nwant=%q\ngot =%q", expected, err)
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
-		{
-			`len(1)`,
-			&object.Error{
-				Message: "argument to `len` not supported, got INTEGER",
-			},
-		},
-		{`len("one", "two")`,
-			&object.Error{
-				Message: "wrong number of arguments. got=2, want=1",
-			},
-		},
 		{`len([1, 2, 3])`, 3},
 		{`len([])`, 0},
 		{`puts("hello", "world!")`, Null},
 		{`first([1, 2, 3])`, 1},
 		{`first([])`, Null},
-		{`first(1)`,
-			&object.Error{
-				Message: "argument to `first` must be ARRAY, got INTEGER",
-			},
-		},
 		{`last([1, 2, 3])`, 3},
 		{`last([])`, Null},
-		{`last(1)`,
-			&object.Error{
-				Message: "argument to `last` must be ARRAY, got INTEGER",
-			},
-		},
 		{`rest([1, 2, 3])`, []int{2, 3}},
 		{`rest([])`, Null},
 		{`push([], 1)`, []int{1}},
-		{`push(1, 1)`,
-			&object.Error{
-				Message: "argument to `push` must be ARRAY, got INTEGER",
-			},
-		},
+		{`let a = [1]; append(a, 2, 3); a`, []int{1, 2, 3}},
+		{`append([])`, []int{}},
+		{`let h = {"a": 1, "b": 2}; delete(h, "a")`, 1},
+		{`let h = {"a": 1, "b": 2}; delete(h, "a"); h`, map[object.HashKey]int64{
+			(&object.String{Value: "b"}).HashKey(): 2,
+		}},
+		{`delete({}, "a")`, Null},
 	}
 	runVmTests(t, tests)
 }
 
+func TestBuiltinErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{`len(1)`, "len(1): argument to `len` not supported, got INTEGER"},
+		{`len("one", "two")`, "len(\"one\", \"two\"): wrong number of arguments. got=2, want=1"},
+		{`first(1)`, "first(1): argument to `first` must be ARRAY, got INTEGER"},
+		{`last(1)`, "last(1): argument to `last` must be ARRAY, got INTEGER"},
+		{`push(1, 1)`, "push(1, 1): argument to `push` must be ARRAY, got INTEGER"},
+		{`append(1, 1)`, "append(1, 1): argument to `append` must be ARRAY, got INTEGER"},
+		{`delete([], 1)`, "delete([], 1): argument to `delete` must be HASH, got ARRAY"},
+		{`rest("a long string argument")`, "rest(\"a long string ar...): argument to `rest` must be ARRAY, got STRING"},
+		{`int(true)`, "int(true): argument to `int` not supported, got BOOLEAN"},
+		{`int(1e300)`, "int(1e+300): cannot convert 1e+300 to INTEGER"},
+		{`int(-1e19)`, "int(-1e+19): cannot convert -1e+19 to INTEGER"},
+		{`int(9.3e18)`, "int(9.3e+18): cannot convert 9.3e+18 to INTEGER"},
+		{`let x = len(1); x`, "len(1): argument to `len` not supported, got INTEGER"},
+		{`[len(1), 2]`, "len(1): argument to `len` not supported, got INTEGER"},
+	}
+	runVmErrorTests(t, tests)
+}
+
 func TestClosures(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -599,22 +965,44 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 	for _, tt := range tests {
 		program := parse(tt.input)
 
-		comp := compiler.New()
-		err := comp.Compile(program)
-		if err != nil {
-			t.Fatalf("compiler error: %s", err)
-		}
+		// run the bytecode with and without optimizations, as compiled and
+		// as loaded from its encoding
+		for _, config := range []compiler.Config{{}, {DisableOptimizations: true}} {
+			comp := compiler.NewWithConfig(config)
+			err := comp.Compile(program)
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
 
-		vm := New(comp.Bytecode())
-		err = vm.Run()
-		if err != nil {
-			t.Fatalf("vm error: %s", err)
+			for _, bc := range []*compiler.Bytecode{comp.Bytecode(), roundTrip(t, comp.Bytecode())} {
+				vm := New(bc)
+				err = vm.Run()
+				if err != nil {
+					t.Fatalf("vm error: %s", err)
+				}
+
+				stackElem := vm.LastPoppedStackElement()
+
+				testExpectedObject(t, tt.expected, stackElem)
+			}
 		}
+	}
+}
 
-		stackElem := vm.LastPoppedStackElement()
+// roundTrip encodes bc and returns the bytecode decoded from the encoding.
+func roundTrip(t *testing.T, bc *compiler.Bytecode) *compiler.Bytecode {
+	t.Helper()
 
-		testExpectedObject(t, tt.expected, stackElem)
+	data, err := bc.MarshalBinary()
+	if err != nil {
+		t.Fatalf("encoding failed: %s", err)
+	}
+	loaded := &compiler.Bytecode{}
+	err = loaded.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("decoding failed: %s", err)
 	}
+	return loaded
 }
 
 func testExpectedObject(
@@ -632,12 +1020,24 @@ func testExpectedObject(
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
 
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
+
 	case bool:
 		err := testBooleanObject(expected, actual)
 		if err != nil {
 			t.Errorf("testBooleanObject failed: %s", err)
 		}
 
+	case string:
+		err := testStringObject(expected, actual)
+		if err != nil {
+			t.Errorf("testStringObject failed: %s", err)
+		}
+
 	case *object.Null:
 		if expected != Null {
 			t.Errorf("testNull failed: %s", expected)
@@ -667,11 +1067,15 @@ func testExpectedObject(
 			t.Errorf("object is not Hash, got=%T (%+v)", actual, actual)
 			return
 		}
-		if len(hash.Pairs) != len(expected) {
-			t.Errorf("hash has wrong number of pairs. want=%d, got=%d", len(expected), len(hash.Pairs))
+		if hash.Len() != len(expected) {
+			t.Errorf("hash has wrong number of pairs. want=%d, got=%d", len(expected), hash.Len())
+		}
+		pairs := map[object.HashKey]object.HashPair{}
+		for _, pair := range hash.Pairs() {
+			pairs[pair.Key.(object.Hashable).HashKey()] = pair
 		}
 		for expectedKey, expectedValue := range expected {
-			pair, ok := hash.Pairs[expectedKey]
+			pair, ok := pairs[expectedKey]
 			if !ok {
 				t.Errorf("no pair for given key in Pairs")
 			}
@@ -705,6 +1109,17 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+	return nil
+}
+
 func testBooleanObject(expected bool, actual object.Object) error {
 	result, ok := actual.(*object.Boolean)
 	if !ok {
@@ -716,8 +1131,560 @@ func testBooleanObject(expected bool, actual object.Object) error {
 	return nil
 }
 
+func testStringObject(expected string, actual object.Object) error {
+	result, ok := actual.(*object.String)
+	if !ok {
+		return fmt.Errorf("object is not String. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%q, want=%q", result.Value, expected)
+	}
+	return nil
+}
+
 func parse(input string) *ast.Program {
 	lexer := lexer.New(input)
 	parser := parser.New(lexer)
 	return parser.ParseProgram()
 }
+
+func TestMutableClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			`let newCounter = fn() { let count = 0; fn() { count += 1; count } };
+			let counter = newCounter();
+			counter(); counter(); counter()`,
+			3,
+		},
+		{
+			`let newCounter = fn() { let count = 0; fn() { count++ } };
+			let a = newCounter(); let b = newCounter();
+			a(); a(); b(); [a(), b()]`,
+			[]int{2, 1},
+		},
+		{
+			`let pair = fn() {
+				let value = 0;
+				[fn(v) { value = v }, fn() { value }]
+			};
+			let p = pair();
+			p[0](42);
+			p[1]()`,
+			42,
+		},
+		{
+			`let f = fn() { let x = 1; let g = fn() { x = x * 10 }; g(); g(); x };
+			f()`,
+			100,
+		},
+		{
+			`let outer = fn(a) {
+				let middle = fn() { fn() { a += 1 } };
+				let inner = middle();
+				inner(); inner();
+				a
+			};
+			outer(5)`,
+			7,
+		},
+		{
+			`let memo = fn(f) {
+				let cache = {};
+				let calls = 0;
+				let lookup = fn(n) { calls += 1; f(n) };
+				lookup(1); lookup(2);
+				calls
+			};
+			memo(fn(n) { n * n })`,
+			2,
+		},
+		{
+			// a cell left in a stack slot by an earlier call must not be
+			// shared with the next one
+			`let a = fn() { let x = 1; fn() { x } };
+			let keep = a();
+			let b = fn() { let y = 2; fn() { y = 3 } };
+			b()();
+			keep()`,
+			1,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIndexAssignment(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = [1, 2, 3]; a[0] = 5; a", []int{5, 2, 3}},
+		{"let a = [1, 2, 3]; a[2] = a[0] + a[1]", 3},
+		{"let a = [[0, 0], [0, 0]]; a[1][0] = 7; a[1]", []int{7, 0}},
+		{"let a = [1]; let b = a; b[0] = 9; a", []int{9}},
+		{"let h = {}; h[\"x\"] = 1; h[\"x\"]", 1},
+		{"let h = {1: 1}; h[1] = h[1] + 1; h", map[object.HashKey]int64{
+			(&object.Integer{Value: 1}).HashKey(): 2,
+		}},
+		{"let f = fn(a) { a[0] = 2 }; let a = [1]; f(a); a", []int{2}},
+		{"let a = [1, 2, 3]; a[-1] = 0; a", []int{1, 2, 0}},
+		{"let a = []; for (let i = 0; i < 5; i++) { append(a, i * i) }; a", []int{0, 1, 4, 9, 16}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIndexAssignmentErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{"let a = [1, 2, 3]; a[3] = 1", "index out of range: 3 (length 3)"},
+		{"let a = [1, 2, 3]; a[-4] = 1", "index out of range: -4 (length 3)"},
+		{`let a = [1]; a["x"] = 1`, "array index must be INTEGER, got STRING"},
+		{"let h = {}; h[[1]] = 1", "unusable as hash key: ARRAY"},
+		{`let s = "abc"; s[0] = "x"`, "index assignment not supported: STRING"},
+	}
+
+	runVmErrorTests(t, tests)
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3, 4][1:3]", []int{2, 3}},
+		{"[1, 2, 3, 4][:2]", []int{1, 2}},
+		{"[1, 2, 3, 4][2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][:]", []int{1, 2, 3, 4}},
+		{"[1, 2, 3, 4][-2:]", []int{3, 4}},
+		{"[1, 2, 3, 4][:-1]", []int{1, 2, 3}},
+		{"[1, 2, 3, 4][3:1]", []int{}},
+		{"[1, 2, 3, 4][-10:10]", []int{1, 2, 3, 4}},
+		{"let a = [1, 2]; let b = a[:]; b[0] = 5; a", []int{1, 2}},
+		{`"monkey"[1:3]`, "on"},
+		{`"monkey"[-3:]`, "key"},
+		{`"monkey"[:0]`, ""},
+		{"let i = 1; [1, 2, 3][i:i + 1]", []int{2}},
+	}
+
+	runVmTests(t, tests)
+
+	runVmErrorTests(t, []vmTestCase{
+		{`[1, 2]["a":]`, "slice index must be INTEGER, got STRING"},
+		{"{}[1:]", "slice operator not supported: HASH"},
+	})
+}
+
+func TestHashOrder(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`keys({"b": 1, "a": 2, 3: 3})`, "[b, a, 3]"},
+		{`values({"b": 1, "a": 2, 3: 3})`, "[1, 2, 3]"},
+		{`items({"b": 1, "a": 2})`, "[[b, 1], [a, 2]]"},
+		{`keys({})`, "[]"},
+		{`let h = {"x": 1, "y": 2}; h["x"] = 3; h`, "{x: 3, y: 2}"},
+		{`let h = {"x": 1, "y": 2}; delete(h, "x"); h["x"] = 1; h`, "{y: 2, x: 1}"},
+		{`let h = {}; for (let i = 5; i > 0; i--) { h[i] = i * i }; h`, "{5: 25, 4: 16, 3: 9, 2: 4, 1: 1}"},
+		{`let h = {1: "a", 0: "z"}; [h[1.0], h[-0.0], h[0.0]]`, "[a, z, z]"},
+		{`let h = {2.0: "a"}; h[2] = "b"; h`, "{2.0: b}"},
+		{`keys(1)`, "keys(1): argument to `keys` must be HASH, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(roundTrip(t, comp.Bytecode()))
+		var got string
+		if err := vm.Run(); err != nil {
+			got = err.(*RuntimeError).Err.Error()
+		} else {
+			got = vm.LastPoppedStackElement().Inspect()
+		}
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestTryCatch(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let r = 0; try { throw 5 } catch (e) { r = e }; r`, "5"},
+		{`let r = ""; try { len(1) } catch (e) { r = e["type"] + ": " + e["message"] }; r`, "TypeError: len(1): argument to `len` not supported, got INTEGER"},
+		{`let r = ""; try { len(1, 2) } catch (e) { r = e["type"] }; r`, "ArgumentError"},
+		{`let r = ""; try { int("x") } catch (e) { r = e["type"] }; r`, "ValueError"},
+		{`let r = ""; try { [1][5] = 2 } catch (e) { r = e["type"] }; r`, "RuntimeError"},
+		{`let f = fn(n) { if (n == 0) { throw "deep" }; f(n - 1) }; let r = ""; try { f(10) } catch (e) { r = e }; r + "!"`, "deep!"},
+		{`let log = []; let f = fn() { try { append(log, 1); return 2 } finally { append(log, 3) } }; append(log, f()); log`, "[1, 3, 2]"},
+		{`let log = []; try { try { throw "x" } finally { append(log, "f") } } catch (e) { append(log, e) }; log`, "[f, x]"},
+		{`let n = 0; for (let i = 0; i < 5; i++) { try { if (i == 2) { break } } finally { n++ } }; n`, "3"},
+		{`let n = 0; let i = 0; while (i < 5) { i++; try { if (i > 2) { continue }; n = n + 10 } finally { n++ } }; n`, "25"},
+		{`let r = ""; try { try { len(1) } catch (e) { throw e } } catch (e) { r = e["type"] }; r`, "TypeError"},
+		{`let log = []; try { try { throw 1 } catch (e) { throw e + 1 } finally { append(log, "f") } } catch (e) { append(log, e) }; log`, "[f, 2]"},
+		{`let f = fn() { try { throw 1 } catch (e) { return e + 1 } }; [1, 2, f(), try { throw 1 } catch (e) { 3 }]`, "[1, 2, 2, null]"},
+		{`let fs = []; try { throw 7 } catch (e) { append(fs, fn() { e }) }; fs[0]()`, "7"},
+		{`let f = fn() { try { return 1 } finally { return 2 } }; f()`, "2"},
+		{`let f = fn() { try { throw 1 } finally { return 2 } }; f()`, "2"},
+		{`let log = []; try { try { append(log, 1) } finally { append(log, 2) } } finally { append(log, 3) }; log`, "[1, 2, 3]"},
+		{`let log = []; try { try { try { throw "x" } finally { append(log, 1) } } finally { append(log, 2) } } catch (e) { append(log, e) }; log`, "[1, 2, x]"},
+		{`let log = []; let f = fn() { try { try { return 1 } finally { append(log, "a") } } finally { append(log, "b") } }; append(log, f()); log`, "[a, b, 1]"},
+		{`let log = []; try { try { throw "x" } finally { try { append(log, 1) } finally { append(log, 2) } } } catch (e) { append(log, e) }; log`, "[1, 2, x]"},
+		{`let n = 0; while (true) { try { try { break } finally { n++ } } finally { n = n * 10 } }; n`, "10"},
+		{`let r = 0; for (let i = 0; i < 3; i++) { try { throw i } catch (e) { r = r + e } }; r`, "3"},
+		{`let r = 0; let f = fn() { try { throw 1 } catch (e) { r = e } }; f(); try { f(); throw 2 } catch (e) { r = r + e }; r`, "3"},
+		{`let e = 1; try { throw 2 } catch (e) { e }; e`, "1"},
+		{`try { 1 } catch (e) { 2 }`, "null"},
+		{`let r = ""; try { 1 / 0 } catch (e) { r = e["type"] + ": " + e["message"] }; r`, "RuntimeError: division by zero"},
+		{`let f = fn(n) { 10 / n }; let r = ""; try { f(0) } catch (e) { r = e["message"] }; r`, "division by zero"},
+		{`let r = 0; try { 1.0 / 0 } catch (e) { r = 1 }; r`, "0"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(roundTrip(t, comp.Bytecode()))
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+		got := vm.LastPoppedStackElement().Inspect()
+		if got != tt.expected {
+			t.Errorf("wrong result for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+		if len(vm.handlers) != 0 {
+			t.Errorf("handlers left installed for %q: %d", tt.input, len(vm.handlers))
+		}
+	}
+}
+
+func TestUncaughtErrors(t *testing.T) {
+	tests := []vmTestCase{
+		{`throw "boom"`, "uncaught exception: boom"},
+		{`try { 1 } catch (e) { 2 }; throw 3`, "uncaught exception: 3"},
+		{`throw {"message": "custom", "type": "MyError"}`, "custom"},
+		{`try { len(1) } finally { 1 }`, "len(1): argument to `len` not supported, got INTEGER"},
+		{`try { throw 1 } catch (e) { throw e + 1 }`, "uncaught exception: 2"},
+		{`try { 1 + "a" } catch (e) { throw e }`, "unsupported types for binary operation: INTEGER STRING"},
+	}
+	runVmErrorTests(t, tests)
+}
+
+func TestUncaughtErrorPosition(t *testing.T) {
+	input := `let f = fn() {
+  throw "boom";
+};
+try { 1 } catch (e) { 2 };
+f();`
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err = New(roundTrip(t, comp.Bytecode())).Run()
+	expected := "2:3: uncaught exception: boom" +
+		"\n\tat f (2:3)" +
+		"\n\tat <main> (5:2)"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("wrong VM error:\nwant=%q\ngot =%v", expected, err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		input  string
+		limits object.Limits
+		target interface{} // a pointer to the expected error type
+	}{
+		{`while (true) {}`, object.Limits{MaxSteps: 1000}, new(*object.StepLimitError)},
+		{`let f = fn(n) { 1 + f(n + 1) }; f(0)`, object.Limits{MaxCallDepth: 100}, new(*object.CallDepthError)},
+		{`while (true) { [1] }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`let s = ""; while (true) { s = s + "a" }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`let a = [1]; while (true) { rest(a) }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`let h = {1: 2}; while (true) { items(h) }`, object.Limits{MaxAllocations: 100}, new(*object.AllocationLimitError)},
+		{`while (true) {}`, object.Limits{Timeout: 10 * time.Millisecond}, new(*object.DeadlineError)},
+		{`try { while (true) {} } catch (e) {} finally { 1 }`, object.Limits{MaxSteps: 1000}, new(*object.StepLimitError)},
+		{`let f = fn() { try { f() } catch (e) { 1 } }; f()`, object.Limits{MaxCallDepth: 50}, new(*object.CallDepthError)},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(roundTrip(t, comp.Bytecode()))
+		vm.Limits = tt.limits
+		err = vm.RunContext(context.Background())
+		if _, ok := err.(*RuntimeError); !ok {
+			t.Fatalf("error for %q is not *RuntimeError. got=%T (%+v)", tt.input, err, err)
+		}
+		if !errors.As(err, tt.target) {
+			t.Errorf("wrong error for %q. want=%T, got=%v", tt.input, tt.target, err)
+		}
+	}
+
+	comp := compiler.New()
+	err := comp.Compile(parse(`let f = fn(n) { if (n == 0) { return [] }; f(n - 1) }; f(10)`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := New(roundTrip(t, comp.Bytecode()))
+	vm.Limits = object.Limits{MaxSteps: 1000, MaxCallDepth: 11, MaxAllocations: 2, Timeout: time.Minute}
+	if err := vm.Run(); err != nil {
+		t.Fatalf("run within limits failed: %s", err)
+	}
+	testExpectedObject(t, []int{}, vm.LastPoppedStackElement())
+
+	// first, last, append and delete return values that already exist
+	comp = compiler.New()
+	err = comp.Compile(parse(`let a = [[1], [2]]; let h = {"k": [3]}; let n = 0; while (n < 1000) { first(a); last(a); append(a[0]); delete(h, "x"); n++ }; len(first(a))`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm = New(roundTrip(t, comp.Bytecode()))
+	vm.Limits = object.Limits{MaxAllocations: 10}
+	if err := vm.Run(); err != nil {
+		t.Fatalf("run within limits failed: %s", err)
+	}
+	testExpectedObject(t, 1, vm.LastPoppedStackElement())
+}
+
+func TestRunContext(t *testing.T) {
+	comp := compiler.New()
+	err := comp.Compile(parse(`while (true) {}`))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = New(roundTrip(t, comp.Bytecode())).RunContext(ctx)
+	if !errors.As(err, new(*object.CanceledError)) || !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error for a canceled context. got=%v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = New(roundTrip(t, comp.Bytecode())).RunContext(ctx)
+	if !errors.As(err, new(*object.DeadlineError)) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wrong error for a context deadline. got=%v", err)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	tests := []struct {
+		input    string
+		config   Config
+		expected string
+	}{
+		{`let f = fn() { 1 + f() }; f()`, Config{}, "stack overflow at depth 65536 in function f"},
+		{`let f = fn() { 1 + f() }; f()`, Config{MaxFrames: 10}, "stack overflow at depth 10 in function f"},
+		{`let f = fn() { 1 + f() }; f()`, Config{MaxStack: 100}, "stack overflow at depth 50 in function f"},
+		{`[1, 2, 3, 4, 5]`, Config{MaxStack: 4}, "stack overflow at depth 0 in function <main>"},
+		{`let f = fn(a, b, c, d) { let e = 5 }; f(1, 2, 3, 4)`, Config{MaxStack: 6}, "stack overflow at depth 1 in function f"},
+		{
+			`let fibonacci = fn(x) { fibonacci(x - 1) + fibonacci(x - 2) }; fibonacci(15)`,
+			Config{MaxStack: 2048, MaxFrames: 1025},
+			"stack overflow at depth 1023 in function fibonacci",
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err = NewWithConfig(roundTrip(t, comp.Bytecode()), tt.config).Run()
+		var overflow *StackOverflowError
+		if !errors.As(err, &overflow) {
+			t.Fatalf("no stack overflow for %q. got=%v", tt.input, err)
+		}
+		if overflow.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, overflow.Error())
+		}
+	}
+}
+
+func TestStackOverflowTrace(t *testing.T) {
+	tests := []struct {
+		input    string
+		config   Config
+		expected string
+	}{
+		{
+			"let f = fn() { 1 + f() };\nf()",
+			Config{MaxFrames: 100},
+			"1:21: stack overflow at depth 100 in function f" +
+				"\n\tat f (1:21)" +
+				"\n\t... repeated 98 more times" +
+				"\n\tat <main> (2:2)",
+		},
+		{
+			// the mutual recursion alternates between two entries
+			"let g = 0;\nlet f = fn() { 1 + g() };\ng = fn() { 1 + f() };\nf()",
+			Config{MaxFrames: 100},
+			"2:21: stack overflow at depth 100 in function <anonymous>" +
+				strings.Repeat("\n\tat f (2:21)\n\tat <anonymous> (3:17)", 5) +
+				"\n\t... 80 more lines" +
+				strings.Repeat("\n\tat f (2:21)\n\tat <anonymous> (3:17)", 4) +
+				"\n\tat f (2:21)" +
+				"\n\tat <main> (4:2)",
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err = NewWithConfig(roundTrip(t, comp.Bytecode()), tt.config).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("wrong error for %q.\nwant=%q\ngot =%v", tt.input, tt.expected, err)
+		}
+	}
+
+	// the default frame limit leaves a short message too
+	comp := compiler.New()
+	err := comp.Compile(parse("let f = fn() { 1 + f() }; f()"))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	err = New(comp.Bytecode()).Run()
+	if err == nil || len(err.Error()) > 200 {
+		t.Errorf("error message too long: %d bytes", len(err.Error()))
+	}
+}
+
+func TestStackOverflowIsCatchable(t *testing.T) {
+	input := `let f = fn() { 1 + f() }; let r = ""; try { f() } catch (e) { r = e["message"] }; [r, f]`
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	vm := NewWithConfig(roundTrip(t, comp.Bytecode()), Config{MaxFrames: 20})
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	result := vm.LastPoppedStackElement().(*object.Array)
+	if result.Items[0].Inspect() != "stack overflow at depth 20 in function f" {
+		t.Errorf("wrong caught error. got=%q", result.Items[0].Inspect())
+	}
+}
+
+func TestGrowOnDemand(t *testing.T) {
+	tests := []vmTestCase{
+		{`let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(10000)`, 10000},
+		{`let f = fn(n, acc) { if (n == 0) { acc } else { f(n - 1, push(acc, n)) } }; len(f(3000, []))`, 3000},
+	}
+
+	runVmTests(t, tests)
+}
+
+// TestTailCalls runs deep tail recursion with room for only a few frames.
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let count = fn(n, acc) { if (n == 0) { acc } else { count(n - 1, acc + 1) } }; count(100000, 0)`, "100000"},
+		{`let f = fn(n) { if (n == 0) { return "done" }; return f(n - 1) }; f(50000)`, "done"},
+		{`let sum = fn(arr, acc) { if (len(arr) == 0) { return acc }; sum(rest(arr), acc + first(arr)) }; let a = []; let i = 0; while (i < 2000) { a = push(a, i); i++ }; sum(a, 0)`, "1999000"},
+		{`let odd = fn(n) { n }; let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; if (even(10001)) { "even" } else { "odd" }`, "odd"},
+		{`let f = fn(a) { len(a) }; f([1, 2])`, "2"},
+		{`let f = fn(n, fs) { if (n == 0) { fs } else { f(n - 1, push(fs, fn() { n })) } }; let fs = f(3, []); fs[0]() * 100 + fs[1]() * 10 + fs[2]()`, "321"},
+		{`let r = ""; let g = fn() { throw "x" }; let f = fn() { try { g() } catch (e) { r = "caught" }; r }; f()`, "caught"},
+		{`let f = fn(n) { if (n > 0) { return f(n - 1) }; 9 }; f(100000)`, "9"},
+		{`let f = fn(n) { let x = if (n > 0) { return f(n - 1) } else { 9 }; x }; f(100000)`, "9"},
+		{`let g = fn() { 5 }; let f = fn() { while (true) { return g() } }; f()`, "5"},
+		{`let g = fn() { throw "x" }; let f = fn() { try { return g() } catch (e) { return "caught" } }; f()`, "caught"},
+		{`let g = fn() { 7 }; let f = fn() { try { return g() } finally { 1 } }; f()`, "7"},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := NewWithConfig(roundTrip(t, comp.Bytecode()), Config{MaxFrames: 10})
+		vm.Limits = object.Limits{MaxCallDepth: 5}
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error for %q: %s", tt.input, err)
+		}
+		if got := vm.LastPoppedStackElement().Inspect(); got != tt.expected {
+			t.Errorf("wrong result for %q. want=%s, got=%s", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestGlobalsCap(t *testing.T) {
+	input := `let a = 1; let b = 2; let c = 3; a + b + c`
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewWithConfig(roundTrip(t, comp.Bytecode()), Config{MaxGlobals: 3})
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if err := testIntegerObject(6, vm.LastPoppedStackElement()); err != nil {
+		t.Error(err)
+	}
+
+	err = NewWithConfig(roundTrip(t, comp.Bytecode()), Config{MaxGlobals: 2}).Run()
+	if err == nil || !strings.Contains(err.Error(), "too many globals: 3, the limit is 2") {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
+
+// TestWideOperands runs programs with operands too large for the usual
+// instructions.
+func TestWideOperands(t *testing.T) {
+	var locals, args, params, sum, items []string
+	for i := 0; i < 300; i++ {
+		locals = append(locals, fmt.Sprintf("let %s = %d;", name("a", i), i))
+		args = append(args, fmt.Sprint(i))
+		params = append(params, name("p", i))
+		sum = append(sum, name("a", i))
+	}
+	for i := 0; i < 70000; i++ {
+		items = append(items, fmt.Sprint(i))
+	}
+	repeat := strings.Repeat("total = total + 1;\n", 5000)
+
+	tests := []vmTestCase{
+		{fmt.Sprintf("fn() { %s %s + %s + %s }()", strings.Join(locals, " "), name("a", 0), name("a", 150), name("a", 299)), 449},
+		{fmt.Sprintf("fn(%s) { %s - %s }(%s)", strings.Join(params, ", "), name("p", 299), name("p", 1), strings.Join(args, ", ")), 298},
+		{fmt.Sprintf("fn() { %s fn() { %s } }()()", strings.Join(locals, " "), strings.Join(sum, " + ")), 44850},
+		// more than 64KB of code before the loop, and in it
+		{fmt.Sprintf("let total = 0; %s let i = 0; while (i < 3) { %s i++ }; if (total > 0) { total } else { -1 }",
+			repeat, repeat), 20000},
+		{fmt.Sprintf("let a = [%s]; a[69999] + len(a)", strings.Join(items, ", ")), 139999},
+	}
+
+	runVmTests(t, tests)
+}
+
+// name returns an identifier made of prefix and the letters for i.
+func name(prefix string, i int) string {
+	for {
+		prefix += string(rune('a' + i%26))
+		i /= 26
+		if i == 0 {
+			return prefix
+		}
+	}
+}